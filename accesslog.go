@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// accessLogEntry holds the information about a single client request that is logged once the request
+// has been handled.
+type accessLogEntry struct {
+	Method    string
+	Path      string
+	ClientIP  string
+	RequestID string
+	Backend   string
+	Retries   int
+	// Pool is the pool the request was forwarded to, whose statistics it counts towards. It is nil for
+	// the requests that didn't get to a pool.
+	Pool    *ServerPool
+	Status  int
+	Start   time.Time
+	Latency time.Duration
+}
+
+// newAccessLogEntry starts an access log entry for req.
+func newAccessLogEntry(req *http.Request) *accessLogEntry {
+	return &accessLogEntry{
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIP: clientIP(req),
+		Start:    time.Now(),
+	}
+}
+
+// finish records the final status code and the total latency of the request, and logs the entry.
+func (e *accessLogEntry) finish(status int) {
+	e.Status = status
+	e.Latency = time.Since(e.Start)
+	if e.Pool != nil {
+		e.Pool.requestStats().Record(e.Start.Add(e.Latency), e.Status, e.Latency)
+	}
+
+	backend := e.Backend
+	if backend == "" {
+		backend = "-"
+	}
+	fields := []logField{
+		{"client", e.ClientIP},
+		{"backend", backend},
+		{"status", e.Status},
+		{"retries", e.Retries},
+		{"latency", e.Latency},
+	}
+	if e.RequestID != "" {
+		fields = append(fields, logField{"request_id", e.RequestID})
+	}
+	logEvent(levelInfo, e.Method+" "+e.Path, fields...)
+}
+
+// statusRecorder wraps a http.ResponseWriter so that we can find out the status code that was sent
+// to the client.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Hijack takes over the client connection, for a connection upgrade. The status code is recorded as
+// 101, as the response is then written straight to the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap returns the original http.ResponseWriter, so that http.ResponseController can reach it.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the status code sent to the client. It is 200 if nothing has been written yet, as
+// that's what the client would get.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// The admin API lets operators inspect and control the load balancer at runtime. It is served by a server
+// of its own, apart from the proxied traffic, so that it can be kept off the public interfaces.
+
+// AdminAddress is the address the admin server listens on. The admin API is off when it is empty.
+var AdminAddress = "127.0.0.1:8889"
+
+// AdminUser and AdminPassword protect the admin API with HTTP basic auth, when they are set. The proxied
+// requests never need them.
+var (
+	AdminUser     string
+	AdminPassword string
+)
+
+// ServerInfo is the admin API representation of a target server.
+type ServerInfo struct {
+	Address       string             `json:"address"`
+	Health        HealthStatus       `json:"health"`
+	HealthUpdated time.Time          `json:"health_updated"`
+	HealthHistory []HealthTransition `json:"health_history"`
+	Draining      bool               `json:"draining"`
+	Weight        int                `json:"weight"`
+	Tier          string             `json:"tier"`
+	Load          int                `json:"load"`
+	MaxConns      int                `json:"max_conns"`
+	InMaintenance bool               `json:"in_maintenance"`
+	Ejected       bool               `json:"ejected"`
+	BackingOff    bool               `json:"backing_off"`
+	Penalized     bool               `json:"penalized"`
+	Latency       LatencyPercentiles `json:"latency"`
+	Score         int                `json:"score"`
+}
+
+// newServerInfo creates the admin API representation of the target server s.
+func newServerInfo(s *TargetServer) ServerInfo {
+	settings := s.Settings()
+	return ServerInfo{
+		Address:       s.Address,
+		Health:        s.Status(),
+		HealthUpdated: s.LastHealthUpdate(),
+		HealthHistory: s.HealthHistory(),
+		Draining:      s.IsDraining(),
+		Weight:        settings.Weight,
+		Tier:          settings.Tier,
+		Load:          int(s.conns.Load()),
+		MaxConns:      settings.MaxConns,
+		InMaintenance: s.IsInMaintenance(),
+		Ejected:       s.IsEjected(time.Now()),
+		BackingOff:    s.IsBackingOff(time.Now()),
+		Penalized:     s.IsPenalized(time.Now()),
+		Latency:       s.ResponseStats().Latency,
+		Score:         s.HealthScore(),
+	}
+}
+
+// newAdminMux creates a http.ServeMux with all the admin API endpoints of lb registered.
+func (lb *LoadBalancer) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", lb.adminServersHandler)
+	mux.HandleFunc("/servers/drain", lb.adminDrainHandler)
+	mux.HandleFunc("/servers/weight", lb.adminWeightHandler)
+	mux.HandleFunc("/recheck", lb.adminRecheckHandler)
+	mux.HandleFunc("/canary", lb.adminCanaryHandler)
+	mux.HandleFunc("/nagios", lb.adminNagiosHandler)
+	mux.HandleFunc("/stats", lb.adminStatsHandler)
+	mux.HandleFunc("/maintenance", lb.adminMaintenanceHandler)
+	mux.HandleFunc("/_drain", lb.adminLBDrainHandler)
+	return mux
+}
+
+// AdminHandler returns the handler for the admin server, which serves the admin API of lb behind basic
+// auth if it is set up, along with the probe endpoints.
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	admin := lb.newAdminMux()
+	return lb.withProbeRoutes(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !checkAdminAuth(w, req) {
+			return
+		}
+		admin.ServeHTTP(w, req)
+	}))
+}
+
+// newAdminServer creates the admin server, listening on addr.
+func newAdminServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		ReadTimeout: ListenerReadTimeout,
+		IdleTimeout: ListenerIdleTimeout,
+	}
+}
+
+// checkAdminAuth returns true if req can use the admin API. Otherwise, it asks the client for the
+// credentials with a 401 and returns false.
+func checkAdminAuth(w http.ResponseWriter, req *http.Request) bool {
+	if AdminUser == "" && AdminPassword == "" {
+		return true
+	}
+	user, password, ok := req.BasicAuth()
+	if ok && secureCompare(user, AdminUser) && secureCompare(password, AdminPassword) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="load balancer admin", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// secureCompare returns true if a and b are equal, in a time that doesn't depend on how much of them
+// matches. Their hashes are compared so that the time doesn't give their length away either.
+func secureCompare(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// adminPool returns the pool given by the pool query parameter of req, by the names given by namedPools,
+// or the default pool if it is not set. If there is no such pool, it responds with a 404 and returns nil.
+func (lb *LoadBalancer) adminPool(w http.ResponseWriter, req *http.Request) *ServerPool {
+	name := req.URL.Query().Get("pool")
+	if name == "" {
+		name = "default"
+	}
+	pool, ok := lb.namedPools()[name]
+	if !ok {
+		http.Error(w, "No pool found with the name: "+name, http.StatusNotFound)
+		return nil
+	}
+	return pool
+}
+
+// adminServersHandler lists all the target servers in the pool given by the pool query parameter along
+// with their health, including the recent health transitions of each server.
+func (lb *LoadBalancer) adminServersHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool := lb.adminPool(w, req)
+	if pool == nil {
+		return
+	}
+	servers := pool.ServerList()
+	infos := make([]ServerInfo, len(servers))
+	for i, s := range servers {
+		infos[i] = newServerInfo(s)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// adminDrainHandler puts the server with the address given by the addr query parameter, in the pool
+// given by the pool query parameter, in draining mode, so that it doesn't get any new requests. Passing
+// draining=false takes it out of draining mode.
+func (lb *LoadBalancer) adminDrainHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool := lb.adminPool(w, req)
+	if pool == nil {
+		return
+	}
+	server, err := pool.FindServer(req.URL.Query().Get("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	draining := true
+	if v := req.URL.Query().Get("draining"); v != "" {
+		draining, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid value for draining: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	server.SetDraining(draining)
+	writeJSON(w, http.StatusOK, newServerInfo(server))
+}
+
+// adminRecheckHandler checks the health of all the servers in the pool given by the pool query parameter
+// right away, or only of the server with the address given by the addr query parameter, and lists the
+// checked servers once the checks are done. It is meant to bring a fixed server back without waiting for
+// its next health check.
+func (lb *LoadBalancer) adminRecheckHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool := lb.adminPool(w, req)
+	if pool == nil {
+		return
+	}
+	servers := pool.ServerList()
+	if addr := req.URL.Query().Get("addr"); addr != "" {
+		server, err := pool.FindServer(addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		servers = []*TargetServer{server}
+	}
+
+	refreshServersHealth(servers, HealthCheckInterval)
+	infos := make([]ServerInfo, len(servers))
+	for i, s := range servers {
+		infos[i] = newServerInfo(s)
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// writeJSON writes v as the JSON body of the response, with the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		clog.Errorf("Failed to write the JSON response: %s", err)
+	}
+}
+
+// adminWeightHandler sets the weight of the server with the address given by the addr query parameter,
+// in the pool given by the pool query parameter, to the value of the weight query parameter. A weight
+// of 0 takes the server out of rotation for the weighted algorithms.
+func (lb *LoadBalancer) adminWeightHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	pool := lb.adminPool(w, req)
+	if pool == nil {
+		return
+	}
+	server, err := pool.FindServer(req.URL.Query().Get("addr"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	v := req.URL.Query().Get("weight")
+	weight, err := strconv.Atoi(v)
+	if err != nil || weight < 0 {
+		http.Error(w, "Weight should be a non-negative integer: "+v, http.StatusBadRequest)
+		return
+	}
+
+	server.UpdateSettings(func(settings *ServerSettings) {
+		settings.Weight = weight
+	})
+	writeJSON(w, http.StatusOK, newServerInfo(server))
+}
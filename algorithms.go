@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// LogSelectionDecisions enables a debug log line for every server selection, listing the candidates
+// the algorithm considered along with their scores, and why the winner was picked.
+var LogSelectionDecisions bool
+
+// Algorithm picks a server for the request req out of servers, a snapshot of the servers of the pool
+// taken with ServerList, and returns its index in servers. The pool is passed along for the state the
+// algorithms keep in it, like the round robin index. The algorithms only pick the backup servers of the
+// pool while none of its primary servers are selectable, which selectableInTier takes care of. Most
+// algorithms don't care about the request, and are plain func(*ServerPool, []*TargetServer) (int, error)
+// functions that are adapted with ignoreRequest.
+type Algorithm func(pool *ServerPool, servers []*TargetServer, req *http.Request) (int, error)
+
+// Algorithms maps the names accepted by the -algo flag to the selection algorithms.
+var Algorithms = map[string]Algorithm{
+	"roundrobin":         ignoreRequest(RoundRobin),
+	"random":             ignoreRequest(Random),
+	"leastconn":          ignoreRequest(LeastConnections),
+	"leasttime":          ignoreRequest(LeastResponseTime),
+	"weightedleastconn":  ignoreRequest(WeightedLeastConnections),
+	"iphash":             IPHash,
+	"weightedrandom":     ignoreRequest(WeightedRandom),
+	"weightedroundrobin": ignoreRequest(WeightedRoundRobin),
+	"scorebased":         ignoreRequest(ScoreBased),
+}
+
+// SelectionAlgorithm is the name of the algorithm used to pick a target server for every request.
+var SelectionAlgorithm = "roundrobin"
+
+// selectionAlgorithm is the algorithm named by SelectionAlgorithm.
+var selectionAlgorithm = Algorithms["roundrobin"]
+
+var ErrUnknownAlgorithm = errors.New("unknown selection algorithm")
+
+// initSelectionAlgorithm looks up the algorithm named by SelectionAlgorithm. It returns an error listing
+// the valid names if there is no such algorithm.
+func initSelectionAlgorithm() error {
+	algo, ok := Algorithms[SelectionAlgorithm]
+	if !ok {
+		var names []string
+		for name := range Algorithms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("%w %q, should be one of: %s", ErrUnknownAlgorithm, SelectionAlgorithm, strings.Join(names, ", "))
+	}
+	selectionAlgorithm = algo
+	return nil
+}
+
+// selectionFor returns the configured selection algorithm bound to req, to be passed to
+// GetTargetServer.
+func selectionFor(req *http.Request) func(*ServerPool, []*TargetServer) (int, error) {
+	return func(pool *ServerPool, servers []*TargetServer) (int, error) {
+		return selectionAlgorithm(pool, servers, req)
+	}
+}
+
+// ignoreRequest adapts an algorithm that doesn't need the request into an Algorithm.
+func ignoreRequest(algo func(*ServerPool, []*TargetServer) (int, error)) Algorithm {
+	return func(pool *ServerPool, servers []*TargetServer, _ *http.Request) (int, error) {
+		return algo(pool, servers)
+	}
+}
+
+// rng is the source of randomness for the selection algorithms. rand.Rand is not safe for concurrent
+// use, hence the lock.
+var rng = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// randIntn returns a random number in [0, n) from rng.
+func randIntn(n int) int {
+	rng.Lock()
+	defer rng.Unlock()
+	return rng.Intn(n)
+}
+
+// randFloat64 returns a random number in [0, 1) from rng.
+func randFloat64() float64 {
+	rng.Lock()
+	defer rng.Unlock()
+	return rng.Float64()
+}
+
+// Random picks a selectable server from the pool at random, with the same chance for all of them.
+func Random(pool *ServerPool, servers []*TargetServer) (int, error) {
+	selectable := selectableInTier(servers)
+	var candidates []int
+	for i, s := range servers {
+		if selectable(s) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return -1, ErrNoHealthyServer
+	}
+
+	pick := candidates[randIntn(len(candidates))]
+	if LogSelectionDecisions {
+		logSelection("Random", servers, pick, fmt.Sprintf("random pick out of %d selectable servers", len(candidates)), nil)
+	}
+	return pick, nil
+}
+
+// LeastConnections picks the selectable server with the fewest requests in flight. Ties are broken in
+// round robin order, so that idle servers take turns rather than the first one getting everything.
+func LeastConnections(pool *ServerPool, servers []*TargetServer) (int, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	selectable := selectableInTier(servers)
+
+	var best = -1
+	start := pool.CurrentIndex
+	for cnt := 0; cnt < len(servers); cnt++ {
+		i := (start + cnt) % len(servers)
+		s := servers[i]
+		if !selectable(s) {
+			continue
+		}
+		if best < 0 || s.Load < servers[best].Load {
+			best = i
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoHealthyServer
+	}
+	pool.incrementCurrentIndex(len(servers))
+
+	if LogSelectionDecisions {
+		logSelection("LeastConnections", servers, best, fmt.Sprintf("it has the fewest requests in flight: %d", servers[best].Load), nil)
+	}
+	return best, nil
+}
+
+// WeightedLeastConnections picks the selectable server with the fewest requests in flight relative to
+// its weight, so that a server with 3 times the weight of another carries about 3 times its requests.
+// Servers with a weight of 0 are never picked. Ties are broken in round robin order, like in
+// LeastConnections.
+func WeightedLeastConnections(pool *ServerPool, servers []*TargetServer) (int, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	selectable := selectableInTier(servers)
+
+	var best, bestWeight = -1, 0
+	start := pool.CurrentIndex
+	for cnt := 0; cnt < len(servers); cnt++ {
+		i := (start + cnt) % len(servers)
+		s := servers[i]
+		weight := s.Settings().Weight
+		if !selectable(s) || weight <= 0 {
+			continue
+		}
+		// Compare the load/weight ratios without dividing
+		if best < 0 || s.Load*bestWeight < servers[best].Load*weight {
+			best, bestWeight = i, weight
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoHealthyServer
+	}
+	pool.incrementCurrentIndex(len(servers))
+
+	if LogSelectionDecisions {
+		logSelection("WeightedLeastConnections", servers, best, "it has the fewest requests in flight for its weight", func(s *TargetServer) string {
+			return fmt.Sprintf("load_per_weight=%.2f", float64(s.Load)/float64(s.Settings().Weight))
+		})
+	}
+	return best, nil
+}
+
+// LeastResponseTime picks the selectable server with the lowest score, which is the moving average of
+// its response time multiplied by its requests in flight plus one. That way a fast server that is
+// already busy doesn't get all the requests. Servers that haven't responded yet are scored with the
+// average response time of the others, so it's their load that decides whether they are tried, and
+// they can't win every pick before their first response. Ties go to the server with the fewest
+// requests in flight, and then in round robin order.
+func LeastResponseTime(pool *ServerPool, servers []*TargetServer) (int, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	selectable := selectableInTier(servers)
+
+	var average time.Duration
+	var observed int
+	for _, s := range servers {
+		if selectable(s) && s.responseTime > 0 {
+			average += s.responseTime
+			observed++
+		}
+	}
+	if observed > 0 {
+		average /= time.Duration(observed)
+	}
+	score := func(s *TargetServer) float64 {
+		responseTime := s.responseTime
+		if responseTime == 0 {
+			responseTime = average
+		}
+		return float64(responseTime) * float64(s.Load+1)
+	}
+
+	var best = -1
+	start := pool.CurrentIndex
+	for cnt := 0; cnt < len(servers); cnt++ {
+		i := (start + cnt) % len(servers)
+		s := servers[i]
+		if !selectable(s) {
+			continue
+		}
+		if best < 0 {
+			best = i
+			continue
+		}
+		b := servers[best]
+		if score(s) < score(b) || (score(s) == score(b) && s.Load < b.Load) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoHealthyServer
+	}
+	pool.incrementCurrentIndex(len(servers))
+
+	if LogSelectionDecisions {
+		logSelection("LeastResponseTime", servers, best, "it has the lowest response time score", func(s *TargetServer) string {
+			return fmt.Sprintf("response_time=%s, score=%.0f", s.responseTime, score(s))
+		})
+	}
+	return best, nil
+}
+
+// IPHash picks a selectable server based on the IP of the client, so that a client keeps going to the
+// same server for as long as that server is selectable. It uses rendezvous hashing: the server with the
+// highest hash of the client IP and its address wins, so when a server comes or goes, only the clients
+// of that server move.
+func IPHash(pool *ServerPool, servers []*TargetServer, req *http.Request) (int, error) {
+	ip := clientIP(req)
+	selectable := selectableInTier(servers)
+
+	var best = -1
+	var bestScore uint64
+	for i, s := range servers {
+		if !selectable(s) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte(s.Address))
+		if score := h.Sum64(); best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoHealthyServer
+	}
+
+	if LogSelectionDecisions {
+		logSelection("IPHash", servers, best, fmt.Sprintf("it has the highest hash for the client IP %s", ip), nil)
+	}
+	return best, nil
+}
+
+// WeightedRandom picks a random selectable server from the pool, where the chance of picking a server
+// is proportional to its weight. Servers with a weight of 0 are never picked, and the chances are
+// spread over the rest.
+func WeightedRandom(pool *ServerPool, servers []*TargetServer) (int, error) {
+	// Both passes go over the same weights, so that a change in between can't move the pick
+	selectable := selectableInTier(servers)
+	weights := make([]int, len(servers))
+	var total int
+	for i, s := range servers {
+		if selectable(s) {
+			weights[i] = max(s.Settings().Weight, 0)
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return -1, ErrNoHealthyServer
+	}
+
+	r := randIntn(total)
+	pick := r
+	for i, weight := range weights {
+		if r < weight {
+			if LogSelectionDecisions {
+				logSelection("WeightedRandom", servers, i, fmt.Sprintf("random pick %d out of a total weight of %d", pick, total), nil)
+			}
+			return i, nil
+		}
+		r -= weight
+	}
+	// Not reached, as r is below the total of the weights
+	return -1, ErrNoHealthyServer
+}
+
+// WeightedRoundRobin goes through the selectable servers in the pool like RoundRobin, but picks each
+// server in proportion to its weight. It uses the smooth weighted round robin algorithm (as in nginx)
+// so that a heavy server's turns are spread out rather than bunched together. Servers with a weight of
+// 0 are never picked.
+func WeightedRoundRobin(pool *ServerPool, servers []*TargetServer) (int, error) {
+	pool.Lock()
+	defer pool.Unlock()
+	selectable := selectableInTier(servers)
+
+	var total int
+	var best = -1
+	for i, s := range servers {
+		weight := s.Settings().Weight
+		if !selectable(s) || weight <= 0 {
+			s.currentWeight = 0
+			continue
+		}
+		s.currentWeight += weight
+		total += weight
+		if best < 0 || s.currentWeight > servers[best].currentWeight {
+			best = i
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoHealthyServer
+	}
+
+	if LogSelectionDecisions {
+		logSelection("WeightedRoundRobin", servers, best, "it has the highest current weight", func(s *TargetServer) string {
+			return fmt.Sprintf("current_weight=%d", s.currentWeight)
+		})
+	}
+	servers[best].currentWeight -= total
+	return best, nil
+}
+
+// logSelection logs the decision of a selection algorithm: all the servers it looked at with their
+// state and scores, the one it picked out of them, and the reason for picking it. servers should be the
+// same snapshot the algorithm picked from. score adds algorithm specific scores for a server, and can be
+// nil. The load is read from the mirror of Load, as not every algorithm holds the pool lock.
+func logSelection(algo string, servers []*TargetServer, chosen int, reason string, score func(*TargetServer) string) {
+	candidates := make([]string, len(servers))
+	for i, s := range servers {
+		var state = s.Status().String()
+		if s.Settings().Tier == TierBackup {
+			state += ", backup"
+		}
+		if s.IsDraining() {
+			state += ", draining"
+		}
+		if s.IsInMaintenance() {
+			state += ", in maintenance"
+		}
+		if s.IsEjected(time.Now()) {
+			state += ", ejected"
+		}
+		if s.IsBackingOff(time.Now()) {
+			state += ", backing off"
+		}
+		if s.IsPenalized(time.Now()) {
+			state += ", penalized"
+		}
+		desc := fmt.Sprintf("%s (%s, load=%d, weight=%d", s.Address, state, s.conns.Load(), s.Settings().Weight)
+		if score != nil {
+			desc += ", " + score(s)
+		}
+		candidates[i] = desc + ")"
+	}
+	clog.Debugf("[%s] picked %s: %s. Candidates: %s",
+		algo, servers[chosen].Address, reason, strings.Join(candidates, "; "))
+}
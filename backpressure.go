@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryAfterMax caps how long a target server is left alone after it responds with a 503 and a
+// Retry-After header, so that a misconfigured server can't take itself out of rotation for days.
+var RetryAfterMax = 5 * time.Minute
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an
+// HTTP date, into the time to wait from now. It returns false if there is no valid value, or if it
+// doesn't ask for any wait.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		// Cap the seconds first, as a huge number of them would overflow the duration. The extra second
+		// keeps a RetryAfterMax under a second from rounding down to no wait at all.
+		d = time.Duration(min(secs, int(RetryAfterMax/time.Second)+1)) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d <= 0 {
+		return 0, false
+	}
+	if d > RetryAfterMax {
+		d = RetryAfterMax
+	}
+	return d, true
+}
+
+// BackOffUntil keeps the target server s from being picked for new requests until t, as it asked us to
+// with a Retry-After header.
+func (s *TargetServer) BackOffUntil(t time.Time) {
+	s.backOffUntil.Store(t.UnixNano())
+	logEvent(levelNotice, "A server asked for no requests for a while", logField{"backend", s.Address}, logField{"until", t.Format(time.RFC3339)})
+}
+
+// IsBackingOff returns true if the target server s asked for no new requests at now.
+func (s *TargetServer) IsBackingOff(now time.Time) bool {
+	until := s.backOffUntil.Load()
+	return until != 0 && now.UnixNano() < until
+}
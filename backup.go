@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// Tiers of the target servers. The backup servers, e.g. a static server with a sorry page, only get
+// requests while none of the primary servers of their pool can take them.
+const (
+	TierPrimary = "primary"
+	TierBackup  = "backup"
+)
+
+// isValidTier returns true if tier is one of the tiers, or empty for the primary tier.
+func isValidTier(tier string) bool {
+	return tier == "" || tier == TierPrimary || tier == TierBackup
+}
+
+// selectableInTier returns a function that tells whether a server out of servers can be picked by the
+// selection algorithms. Only the selectable servers of the tier that is taking the requests can: the
+// primary tier, or the backup tier if none of the primary servers are selectable. Among those, the
+// servers in the penalty box after a failed request are skipped, unless all of them are in it.
+func selectableInTier(servers []*TargetServer) func(*TargetServer) bool {
+	now := time.Now()
+	tier := TierBackup
+	for _, s := range servers {
+		if s.Settings().Tier != TierBackup && s.IsSelectable() {
+			tier = TierPrimary
+			break
+		}
+	}
+	inTier := func(s *TargetServer) bool {
+		return (s.Settings().Tier == TierBackup) == (tier == TierBackup) && s.IsSelectable()
+	}
+	skipPenalized := false
+	for _, s := range servers {
+		if inTier(s) && !s.IsPenalized(now) {
+			skipPenalized = true
+			break
+		}
+	}
+	return func(s *TargetServer) bool {
+		return inTier(s) && !(skipPenalized && s.IsPenalized(now))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// RetryBodyMaxBytes is the largest request body that is buffered in memory so that the request can be
+// retried with a different target server. Larger bodies are streamed to the target server as they are
+// read, so their requests are never retried: if the target server fails, the client gets its response.
+// A value of 0 disables buffering altogether.
+var RetryBodyMaxBytes int64 = 1 << 20
+
+// MaxBodyBytes is the largest request body that is accepted from clients. Requests with a larger body
+// are rejected with a 413 instead of being forwarded. A value of 0 means there is no limit.
+var MaxBodyBytes int64
+
+var (
+	ErrReadRequestBody     = errors.New("Failed to read the request body")
+	ErrRequestBodyTooLarge = errors.New("Request body is larger than the allowed maximum")
+)
+
+// limitRequestBody makes reading the body of req fail once more than MaxBodyBytes have been read. It
+// returns false if the request declares a body larger than that upfront, so it can be rejected right
+// away.
+func limitRequestBody(w http.ResponseWriter, req *http.Request) bool {
+	if MaxBodyBytes <= 0 {
+		return true
+	}
+	if req.ContentLength > MaxBodyBytes {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
+	}
+	return true
+}
+
+// isBodyTooLarge returns true if err is caused by the request body going over MaxBodyBytes.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// bufferRequestBody reads the body of req into memory, up to RetryBodyMaxBytes, and sets req.GetBody so
+// that a fresh copy of the body can be sent with every attempt. If the body is larger than that, req.Body
+// is replaced with a reader that streams what has been read so far followed by the rest of the body, and
+// req.GetBody is left nil.
+func bufferRequestBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, RetryBodyMaxBytes+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > RetryBodyMaxBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		req.GetBody = nil
+		return nil
+	}
+
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
+}
+
+// isReplayable returns true if the body of req can be sent again with a retry.
+func isReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
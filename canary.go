@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// CanaryConfig is the configuration of the canary, which gets a percentage of the requests that would
+// otherwise go to the default pool, e.g. to try out a new version of the backends.
+type CanaryConfig struct {
+	// Backends lists the target servers of the canary pool.
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+	// Percent is the percentage of the requests to the default pool that go to the canary pool instead.
+	// It can be changed at runtime through the admin API.
+	Percent float64 `json:"percent" yaml:"percent"`
+}
+
+// validate checks the canary config found under the field name.
+func (c *CanaryConfig) validate(field string) error {
+	if c == nil {
+		return nil
+	}
+	if len(c.Backends) == 0 {
+		return &ConfigError{field + ".backends", "must not be empty"}
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return &ConfigError{field + ".percent", "must be between 0 and 100"}
+	}
+	return validateBackends(field+".backends", c.Backends)
+}
+
+// Canary splits the requests to the default pool between it and a canary pool by percentage.
+type Canary struct {
+	Pool *ServerPool
+	// percent holds the bits of the float64 percentage, so that it can be changed while requests are
+	// being served.
+	percent atomic.Uint64
+}
+
+// Canary settings passed on the command line. The ones in the config file are used when -canary isn't.
+var (
+	CanaryAddresses ServerAddresses
+	CanaryPercent   float64
+)
+
+var ErrInvalidCanaryPercent = errors.New("canary percentage should be between 0 and 100")
+
+// NewCanary creates a Canary with a new pool for the backends, that gets percent of the requests.
+func NewCanary(backends []BackendConfig, percent float64) (*Canary, error) {
+	p, err := NewServerPoolFromBackends(backends)
+	if err != nil {
+		return nil, err
+	}
+	c := &Canary{Pool: p}
+	if err := c.SetPercent(percent); err != nil {
+		p.Stop()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Percent returns the percentage of the requests that go to the canary pool.
+func (c *Canary) Percent() float64 {
+	return math.Float64frombits(c.percent.Load())
+}
+
+// SetPercent changes the percentage of the requests that go to the canary pool.
+func (c *Canary) SetPercent(percent float64) error {
+	if percent < 0 || percent > 100 || math.IsNaN(percent) {
+		return ErrInvalidCanaryPercent
+	}
+	c.percent.Store(math.Float64bits(percent))
+	return nil
+}
+
+// pick returns the canary pool for the share of the requests that go to it, and def otherwise. The
+// requests stay on def while none of the canary servers can take them.
+func (c *Canary) pick(def *ServerPool) *ServerPool {
+	if randFloat64()*100 >= c.Percent() {
+		return def
+	}
+	for _, s := range c.Pool.ServerList() {
+		if s.IsSelectable() {
+			return c.Pool
+		}
+	}
+	return def
+}
+
+// adminCanaryHandler returns the percentage of the requests that go to the canary pool, and changes it to
+// the value of the percent query parameter on a POST.
+func (lb *LoadBalancer) adminCanaryHandler(w http.ResponseWriter, req *http.Request) {
+	if lb.Canary == nil {
+		http.Error(w, "No canary is set up", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		v := req.URL.Query().Get("percent")
+		percent, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			err = lb.Canary.SetPercent(percent)
+		}
+		if err != nil {
+			http.Error(w, "Percent should be a number between 0 and 100: "+v, http.StatusBadRequest)
+			return
+		}
+		logEvent(levelNotice, "Canary percentage changed", logField{"percent", percent})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]float64{"percent": lb.Canary.Percent()})
+}
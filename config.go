@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the structure of the config file that can be passed using the -config flag. The file can
+// be either YAML or JSON, based on its extension. Settings passed explicitly on the command line take
+// precedence over the ones in the file, and the -b target servers are added to the ones in the file.
+type Config struct {
+	// Port is the port at which the load balancer listens.
+	Port int `json:"port" yaml:"port"`
+	// HealthInterval is the interval between two health checks of the target servers.
+	HealthInterval Duration `json:"health_interval" yaml:"health_interval"`
+	// Backends lists the target servers of the default pool, which gets the requests that match none
+	// of the routes.
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+	// ResponseHeaders are the changes made to the headers of the responses from the default pool. They
+	// are only read at startup.
+	ResponseHeaders *HeaderRules `json:"response_headers" yaml:"response_headers"`
+	// HealthHeaders are sent with the health checks of the servers in the default pool, including the
+	// ones passed with -b.
+	HealthHeaders map[string]string `json:"health_headers" yaml:"health_headers"`
+	// Routes send the requests under a path prefix to pools of their own. They are only read at startup.
+	Routes []RouteConfig `json:"routes" yaml:"routes"`
+	// Hosts send the requests for a host name to pools of their own, ahead of the routes. They are only
+	// read at startup.
+	Hosts map[string]VirtualHostConfig `json:"hosts" yaml:"hosts"`
+	// Canary sends a percentage of the requests to the default pool to a canary pool instead. It is only
+	// read at startup, and is overridden by -canary.
+	Canary *CanaryConfig `json:"canary" yaml:"canary"`
+}
+
+// BackendConfig is the configuration of a single target server.
+type BackendConfig struct {
+	// Address is the address of the target server e.g. http://localhost:9000
+	Address string `json:"address" yaml:"address"`
+	// Resolve expands the backend into a target server for each of the IP addresses its host name
+	// resolves to, e.g. the pods behind a Kubernetes service, refreshed every DNSRefreshInterval.
+	Resolve bool `json:"resolve" yaml:"resolve"`
+	// Weight is the weight of the target server for the weighted algorithms. It defaults to 1.
+	Weight *int `json:"weight" yaml:"weight"`
+	// Tier is "backup" for a target server that only gets requests while none of the primary servers
+	// of its pool can take them, e.g. a server with a sorry page. It defaults to "primary".
+	Tier string `json:"tier" yaml:"tier"`
+	// MaxConns is the most requests the target server can have in flight at the same time, instead of
+	// the cap set on the command line.
+	MaxConns int `json:"max_conns" yaml:"max_conns"`
+	// HealthPath is the path of the health endpoint of the target server. It defaults to HealthEndpoint.
+	HealthPath string `json:"health_path" yaml:"health_path"`
+	// Maintenance is an optional daily window during which the target server is drained.
+	Maintenance *MaintenanceWindow `json:"maintenance" yaml:"maintenance"`
+	// HealthHeaders are sent with the health checks of the target server, on top of the ones of its
+	// pool. A Host header sets the host the health check is made for.
+	HealthHeaders map[string]string `json:"health_headers" yaml:"health_headers"`
+	// HealthExpect is what the body of the health responses of the target server should meet, instead
+	// of the expectation set on the command line.
+	HealthExpect *HealthExpectation `json:"health_expect" yaml:"health_expect"`
+	// HealthyThreshold and UnhealthyThreshold are the numbers of health checks in a row that need to
+	// pass or fail for the target server to become healthy or degraded, instead of the ones set on the
+	// command line.
+	HealthyThreshold   int `json:"healthy_threshold" yaml:"healthy_threshold"`
+	UnhealthyThreshold int `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+	// HealthInterval is how often the health of the target server is checked while it is healthy,
+	// instead of the health_interval of the config.
+	HealthInterval Duration `json:"health_interval" yaml:"health_interval"`
+	// StripPrefix is removed from the path of the requests before they are forwarded to the target
+	// server e.g. with /service, /service/users is forwarded as /users.
+	StripPrefix string `json:"strip_prefix" yaml:"strip_prefix"`
+	// AddPrefix is added to the path of the requests, after StripPrefix is removed, before they are
+	// forwarded to the target server.
+	AddPrefix string `json:"add_prefix" yaml:"add_prefix"`
+
+	// serverName is the host name an https backend with Resolve set was resolved from, which its address
+	// no longer has in place of the IP address. It is sent for SNI and checked against the certificate
+	// of the target server.
+	serverName string
+}
+
+// Duration is a time.Duration that can be read from config files as a string like "10s".
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler, which is used by both the JSON and YAML decoders.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConfigError is returned when the config file has an invalid value. It names the offending field.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s: %s", e.Field, e.Reason)
+}
+
+// LoadConfig reads, parses and validates the config file at path. Files with a .json extension are
+// parsed as JSON, and everything else as YAML. Unknown fields are rejected, so that typos don't go
+// unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the config file: %s", err)
+	}
+
+	var cfg Config
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the config file %s: %s", path, err)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks that all the values in the config are valid. It returns a *ConfigError for the first
+// invalid value it finds.
+func (cfg *Config) Validate() error {
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return &ConfigError{"port", fmt.Sprintf("%d is not a valid port", cfg.Port)}
+	}
+	if cfg.HealthInterval < 0 {
+		return &ConfigError{"health_interval", "must not be negative"}
+	}
+	if err := validateBackends("backends", cfg.Backends); err != nil {
+		return err
+	}
+	if err := cfg.ResponseHeaders.validate("response_headers"); err != nil {
+		return err
+	}
+	if err := validateHeaderNames("health_headers", cfg.HealthHeaders); err != nil {
+		return err
+	}
+	if err := validateRoutes(cfg.Routes); err != nil {
+		return err
+	}
+	if err := cfg.Canary.validate("canary"); err != nil {
+		return err
+	}
+	return validateHosts(cfg.Hosts)
+}
+
+// validateHosts checks that each virtual host has a distinct host name and valid backends.
+func validateHosts(hosts map[string]VirtualHostConfig) error {
+	var seen = make(map[string]bool)
+	for host, h := range hosts {
+		field := fmt.Sprintf("hosts[%s]", host)
+		name := normalizeHost(host)
+		if name == "" {
+			return &ConfigError{field, "host name must not be empty"}
+		}
+		if seen[name] {
+			return &ConfigError{field, "duplicate host name " + name}
+		}
+		seen[name] = true
+		if len(h.Backends) == 0 {
+			return &ConfigError{field + ".backends", "must not be empty"}
+		}
+		if err := validateBackends(field+".backends", h.Backends); err != nil {
+			return err
+		}
+		if err := h.ResponseHeaders.validate(field + ".response_headers"); err != nil {
+			return err
+		}
+		if err := validateHeaderNames(field+".health_headers", h.HealthHeaders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRoutes checks that each route has a distinct path prefix and valid backends.
+func validateRoutes(routes []RouteConfig) error {
+	var seen = make(map[string]bool)
+	for i, r := range routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if !strings.HasPrefix(r.PathPrefix, "/") {
+			return &ConfigError{field + ".path_prefix", "must start with /"}
+		}
+		prefix := strings.TrimSuffix(r.PathPrefix, "/")
+		if seen[prefix] {
+			return &ConfigError{field + ".path_prefix", "duplicate path prefix " + r.PathPrefix}
+		}
+		seen[prefix] = true
+		if len(r.Backends) == 0 {
+			return &ConfigError{field + ".backends", "must not be empty"}
+		}
+		if err := validateBackends(field+".backends", r.Backends); err != nil {
+			return err
+		}
+		if err := r.ResponseHeaders.validate(field + ".response_headers"); err != nil {
+			return err
+		}
+		if err := validateHeaderNames(field+".health_headers", r.HealthHeaders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBackends checks the list of backends found under the field name.
+func validateBackends(field string, backends []BackendConfig) error {
+	var seen = make(map[string]bool)
+	for i, b := range backends {
+		if strings.TrimSpace(b.Address) == "" {
+			return &ConfigError{fmt.Sprintf("%s[%d].address", field, i), "must not be empty"}
+		}
+		if seen[b.Address] {
+			return &ConfigError{fmt.Sprintf("%s[%d].address", field, i), "duplicate address " + b.Address}
+		}
+		seen[b.Address] = true
+		server, err := NewTargetServer(b.Address)
+		if err != nil {
+			return &ConfigError{fmt.Sprintf("%s[%d].address", field, i), err.Error()}
+		}
+		if (b.Resolve || isSRVAddress(b.Address)) && server.URL.Hostname() == "" {
+			return &ConfigError{fmt.Sprintf("%s[%d].address", field, i), "must have a host name to resolve"}
+		}
+		if b.Weight != nil && *b.Weight < 0 {
+			return &ConfigError{fmt.Sprintf("%s[%d].weight", field, i), "must not be negative"}
+		}
+		if !isValidTier(b.Tier) {
+			return &ConfigError{fmt.Sprintf("%s[%d].tier", field, i), fmt.Sprintf("must be %s or %s", TierPrimary, TierBackup)}
+		}
+		if b.MaxConns < 0 {
+			return &ConfigError{fmt.Sprintf("%s[%d].max_conns", field, i), "must not be negative"}
+		}
+		if b.HealthyThreshold < 0 {
+			return &ConfigError{fmt.Sprintf("%s[%d].healthy_threshold", field, i), "must not be negative"}
+		}
+		if b.UnhealthyThreshold < 0 {
+			return &ConfigError{fmt.Sprintf("%s[%d].unhealthy_threshold", field, i), "must not be negative"}
+		}
+		if b.HealthInterval < 0 {
+			return &ConfigError{fmt.Sprintf("%s[%d].health_interval", field, i), "must not be negative"}
+		}
+		if b.StripPrefix != "" && !strings.HasPrefix(b.StripPrefix, "/") {
+			return &ConfigError{fmt.Sprintf("%s[%d].strip_prefix", field, i), "must start with /"}
+		}
+		if b.AddPrefix != "" && !strings.HasPrefix(b.AddPrefix, "/") {
+			return &ConfigError{fmt.Sprintf("%s[%d].add_prefix", field, i), "must start with /"}
+		}
+		if err := validateHeaderNames(fmt.Sprintf("%s[%d].health_headers", field, i), b.HealthHeaders); err != nil {
+			return err
+		}
+		if err := b.HealthExpect.validate(fmt.Sprintf("%s[%d].health_expect", field, i)); err != nil {
+			return err
+		}
+		if b.Maintenance != nil {
+			if err := b.Maintenance.parse(); err != nil {
+				cerr := err.(*ConfigError)
+				return &ConfigError{fmt.Sprintf("%s[%d].maintenance.%s", field, i, cerr.Field), cerr.Reason}
+			}
+		}
+	}
+	return nil
+}
+
+// validateHeaderNames checks that all the keys of the headers found under the field name are valid
+// header names.
+func validateHeaderNames(field string, headers map[string]string) error {
+	for name := range headers {
+		if !isValidHeaderName(name) {
+			return &ConfigError{field, fmt.Sprintf("%q is not a valid header name", name)}
+		}
+	}
+	return nil
+}
+
+// withHealthHeaders returns a copy of backends where each backend also has the health headers of its
+// pool. The headers of a backend win over the ones of the pool.
+func withHealthHeaders(backends []BackendConfig, headers map[string]string) []BackendConfig {
+	if len(headers) == 0 {
+		return backends
+	}
+	merged := make([]BackendConfig, len(backends))
+	for i, b := range backends {
+		h := make(map[string]string, len(headers)+len(b.HealthHeaders))
+		for name, value := range headers {
+			h[name] = value
+		}
+		for name, value := range b.HealthHeaders {
+			h[name] = value
+		}
+		b.HealthHeaders = h
+		merged[i] = b
+	}
+	return merged
+}
+
+// backendConfigsFromAddresses creates the default backend config for each of the addresses, which have
+// their host names resolved if ResolveAddresses is set.
+func backendConfigsFromAddresses(addrs ServerAddresses) []BackendConfig {
+	backends := make([]BackendConfig, len(addrs))
+	for i, addr := range addrs {
+		backends[i] = BackendConfig{Address: addr, Resolve: ResolveAddresses}
+	}
+	return backends
+}
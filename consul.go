@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consul settings, for a default pool whose servers are the healthy instances of a service registered in
+// Consul, instead of the ones passed with -b and in the config file. Consul only reports the instances
+// that pass their Consul checks, and the load balancer still checks their health on its own on top.
+var (
+	// ConsulAddress is the address of the Consul agent e.g. http://localhost:8500
+	ConsulAddress = "http://localhost:8500"
+	// ConsulService is the name of the service whose instances are the target servers. The Consul
+	// integration is off when it is empty.
+	ConsulService string
+	// ConsulTag only keeps the instances of the service that have the tag, if it is set.
+	ConsulTag string
+	// ConsulToken is the ACL token sent to Consul, if it is set.
+	ConsulToken string
+	// ConsulScheme is the scheme the target servers are reached with.
+	ConsulScheme = "http"
+	// ConsulRefreshInterval is how often Consul is asked for the instances of the service.
+	ConsulRefreshInterval time.Duration = 10 * time.Second
+	// ConsulTimeout is the longest a request to Consul can take.
+	ConsulTimeout time.Duration = 5 * time.Second
+)
+
+var ErrConsulNoInstances = errors.New("Consul has no healthy instances of the service")
+
+// ConsulDiscoverer is a Discoverer for the healthy instances of a service registered in Consul, through
+// its health API.
+type ConsulDiscoverer struct {
+	// Address is the address of the Consul agent.
+	Address string
+	// Service is the name of the service, and Tag an optional tag its instances should have.
+	Service string
+	Tag     string
+	// Token is the ACL token sent to Consul, if it is set.
+	Token string
+	// Scheme is the scheme the target servers are reached with, http by default.
+	Scheme string
+	// Interval is how often Consul is asked for the instances.
+	Interval time.Duration
+	// Client makes the requests to Consul. http.DefaultClient is used when it is nil.
+	Client *http.Client
+}
+
+// NewConsulDiscoverer creates a ConsulDiscoverer from the Consul settings passed on the command line.
+func NewConsulDiscoverer() *ConsulDiscoverer {
+	return &ConsulDiscoverer{
+		Address:  ConsulAddress,
+		Service:  ConsulService,
+		Tag:      ConsulTag,
+		Token:    ConsulToken,
+		Scheme:   ConsulScheme,
+		Interval: ConsulRefreshInterval,
+	}
+}
+
+// consulServiceEntry is the part of an entry of the Consul health API response that we use.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		ID      string
+		Address string
+		Port    int
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+// Discover returns a backend for each of the instances of the service that pass their Consul checks,
+// weighted like their passing weight in Consul.
+func (c *ConsulDiscoverer) Discover(ctx context.Context) ([]BackendConfig, error) {
+	query := url.Values{"passing": {"true"}}
+	if c.Tag != "" {
+		query.Set("tag", c.Tag)
+	}
+	endpoint := strings.TrimSuffix(c.Address, "/") + "/v1/health/service/" + url.PathEscape(c.Service) + "?" + query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, ConsulTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query Consul: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to query Consul: unexpected status %d", resp.StatusCode)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("Failed to read the Consul response: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, ErrConsulNoInstances
+	}
+
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	var backends []BackendConfig
+	var seen = make(map[string]bool)
+	for _, e := range entries {
+		// Instances registered without an address of their own are reached at the address of their node
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		address := scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port))
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		b := BackendConfig{Address: address}
+		if e.Service.Weights.Passing > 0 {
+			weight := e.Service.Weights.Passing
+			b.Weight = &weight
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// Updates asks for the instances to be discovered again every Interval.
+func (c *ConsulDiscoverer) Updates(ctx context.Context) <-chan struct{} {
+	return pollUpdates(ctx, c.Interval)
+}
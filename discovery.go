@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// Discoverer is a source of backends for a pool, like a service registry, that can change while the load
+// balancer is running. A pool created with NewServerPoolFromDiscoverer reconciles its servers with the
+// backends of its discoverer every time it signals an update.
+type Discoverer interface {
+	// Discover returns the backends that the pool should have right now.
+	Discover(ctx context.Context) ([]BackendConfig, error)
+	// Updates returns a channel that receives a value whenever the backends may have changed, and Discover
+	// should be called again. The channel is closed once ctx is done.
+	Updates(ctx context.Context) <-chan struct{}
+}
+
+// pollUpdates returns a channel for Discoverer.Updates that receives a value every interval, for the
+// discoverers that have no way of being told about changes.
+func pollUpdates(ctx context.Context, interval time.Duration) <-chan struct{} {
+	updates := make(chan struct{})
+	if interval <= 0 {
+		go func() {
+			<-ctx.Done()
+			close(updates)
+		}()
+		return updates
+	}
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			select {
+			case updates <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return updates
+}
+
+// StaticDiscoverer is a Discoverer for a fixed list of backends, like the ones passed with -b.
+type StaticDiscoverer struct {
+	Backends []BackendConfig
+}
+
+// Discover returns the backends of the list.
+func (s *StaticDiscoverer) Discover(ctx context.Context) ([]BackendConfig, error) {
+	return s.Backends, nil
+}
+
+// Updates never receives anything, as the list never changes.
+func (s *StaticDiscoverer) Updates(ctx context.Context) <-chan struct{} {
+	return pollUpdates(ctx, 0)
+}
+
+// discovererFor returns the discoverer for a list of backends: a DNSDiscoverer if the host names of some
+// of them need to be resolved, and a StaticDiscoverer otherwise.
+func discovererFor(backends []BackendConfig) Discoverer {
+	if hasResolvedBackends(backends) {
+		return &DNSDiscoverer{Backends: backends, Interval: DNSRefreshInterval}
+	}
+	return &StaticDiscoverer{Backends: backends}
+}
+
+// setDiscoverer replaces the discoverer of the pool with d.
+func (pool *ServerPool) setDiscoverer(d Discoverer) {
+	pool.Lock()
+	defer pool.Unlock()
+	pool.discoverer = d
+	if pool.discovererChanged != nil {
+		close(pool.discovererChanged)
+	}
+	pool.discovererChanged = make(chan struct{})
+}
+
+// RunDiscovery is blocking and should be run as a separate goroutine. Until ctx is done, it reconciles the
+// servers of the pool with the backends of its discoverer every time the discoverer has an update,
+// moving on to the new discoverer whenever it is replaced.
+func (pool *ServerPool) RunDiscovery(ctx context.Context) {
+	for {
+		pool.Lock()
+		d, changed := pool.discoverer, pool.discovererChanged
+		pool.Unlock()
+
+		dctx, cancel := context.WithCancel(ctx)
+		updates := d.Updates(dctx)
+	watch:
+		for {
+			select {
+			case <-ctx.Done():
+				cancel()
+				return
+			case <-changed:
+				break watch
+			case <-updates:
+				pool.discover(dctx, d)
+			}
+		}
+		cancel()
+	}
+}
+
+// discover reconciles the servers of the pool with the backends of d, as long as d is still the
+// discoverer of the pool. If d fails, or finds no backends at all, the servers are left as they are
+// until the next update.
+func (pool *ServerPool) discover(ctx context.Context, d Discoverer) {
+	backends, err := d.Discover(ctx)
+	if err == nil && len(backends) == 0 {
+		err = ErrNoServerAddressForPool
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			clog.Warningf("Failed to discover the backends, keeping the current servers: %s", err)
+		}
+		return
+	}
+
+	pool.Lock()
+	current := pool.discoverer == d
+	pool.Unlock()
+	if !current {
+		return
+	}
+	added, removed, err := pool.reconcile(backends)
+	if err != nil {
+		clog.Warningf("Failed to apply the discovered backends, keeping the current servers: %s", err)
+		return
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		clog.Infof("Discovered backends: %d servers, %d added %v, %d removed %v",
+			len(backends), len(added), added, len(removed), removed)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backends with Resolve set, e.g. a Kubernetes service name, are expanded into a target server for every
+// IP address their host name resolves to, so that each of them is load balanced and health checked on
+// its own. Backends with an srv:// address are expanded into a target server for every target of their
+// SRV record in the same way. The names are resolved again every DNSRefreshInterval, and the servers are
+// added and removed as the addresses come and go.
+var (
+	// ResolveAddresses makes the target servers passed with -b resolve their host names.
+	ResolveAddresses bool
+	// DNSRefreshInterval is how often the host names of the backends with Resolve set are resolved again.
+	DNSRefreshInterval time.Duration = 30 * time.Second
+	// DNSTimeout is the longest a single host name can take to resolve.
+	DNSTimeout time.Duration = 5 * time.Second
+)
+
+// lookupHost resolves a host name to its IP addresses. It is a variable so that the tests can fake it.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// lookupSRV resolves an SRV record. It is a variable so that the tests can fake it.
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// schemeSRV is the scheme of the backend addresses that are resolved through SRV records, e.g.
+// srv://_http._tcp.my-service.example.com
+const schemeSRV = "srv"
+
+// resolveBackends returns backends, with each backend that has Resolve set replaced by one backend per
+// IP address its host name resolves to, and each srv:// backend by one backend per target of its SRV
+// record, with the same settings. An address that more than one of the backends resolve to is only kept
+// once.
+func resolveBackends(ctx context.Context, backends []BackendConfig) ([]BackendConfig, error) {
+	var resolved []BackendConfig
+	var seen = make(map[string]bool)
+	for _, b := range backends {
+		var expanded []BackendConfig
+		switch {
+		case isSRVAddress(b.Address):
+			srv, err := resolveSRV(ctx, b)
+			if err != nil {
+				return nil, err
+			}
+			expanded = srv
+		case b.Resolve:
+			addrs, err := resolveAddress(ctx, b.Address)
+			if err != nil {
+				return nil, err
+			}
+			// The certificate of an https server is for its host name rather than its IP addresses
+			var serverName string
+			if u, err := url.Parse(b.Address); err == nil && u.Scheme == "https" {
+				serverName = u.Hostname()
+			}
+			for _, addr := range addrs {
+				r := b
+				r.Address, r.Resolve, r.serverName = addr, false, serverName
+				expanded = append(expanded, r)
+			}
+		default:
+			resolved = append(resolved, b)
+			continue
+		}
+
+		for _, r := range expanded {
+			if seen[r.Address] {
+				continue
+			}
+			seen[r.Address] = true
+			resolved = append(resolved, r)
+		}
+	}
+	return resolved, nil
+}
+
+// isSRVAddress returns true if address is to be resolved through its SRV record.
+func isSRVAddress(address string) bool {
+	u, err := url.Parse(address)
+	return err == nil && u.Scheme == schemeSRV
+}
+
+// resolveSRV resolves the SRV record named by the address of b, and returns a backend for each of the
+// targets with the lowest priority, as the others are only meant to be used when those are all down.
+// The targets get the weight of their record, unless b has a weight of its own. Their scheme is https
+// for an _https service, tcp in the TCP mode, and http otherwise.
+func resolveSRV(ctx context.Context, b BackendConfig) ([]BackendConfig, error) {
+	u, err := url.Parse(b.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse to URL: %s", err)
+	}
+	name := u.Hostname()
+	if name == "" {
+		return nil, fmt.Errorf("%s has no SRV record name to resolve", b.Address)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DNSTimeout)
+	defer cancel()
+	_, records, err := lookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve the SRV record %s: %w", name, err)
+	}
+	// A single target of "." means that the service is explicitly not available
+	if len(records) == 0 || (len(records) == 1 && records[0].Target == ".") {
+		return nil, fmt.Errorf("The SRV record %s has no targets", name)
+	}
+
+	scheme := "http"
+	if strings.HasPrefix(name, "_https.") {
+		scheme = "https"
+	} else if ProxyMode == ProxyModeTCP {
+		scheme = "tcp"
+	}
+
+	priority := records[0].Priority
+	for _, rec := range records {
+		if rec.Priority < priority {
+			priority = rec.Priority
+		}
+	}
+	var backends []BackendConfig
+	for _, rec := range records {
+		if rec.Priority != priority {
+			continue
+		}
+		r := b
+		target := url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))),
+			Path:   u.Path,
+		}
+		r.Address, r.Resolve = target.String(), false
+		if b.Weight == nil {
+			// A weight of 0 is for the targets that should get very few requests, not none at all
+			weight := max(int(rec.Weight), 1)
+			r.Weight = &weight
+		}
+		backends = append(backends, r)
+	}
+	return backends, nil
+}
+
+// resolveAddress resolves the host name of the URL address, and returns the address with the host name
+// replaced by each of the IP addresses, keeping the scheme, port and path.
+func resolveAddress(ctx context.Context, address string) ([]string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse to URL: %s", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s has no host name to resolve", address)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DNSTimeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, u.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve %s: %w", u.Hostname(), err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s didn't resolve to any address", u.Hostname())
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		r := *u
+		r.Host = ip
+		if port := u.Port(); port != "" {
+			r.Host = net.JoinHostPort(ip, port)
+		} else if net.ParseIP(ip).To4() == nil {
+			r.Host = "[" + ip + "]"
+		}
+		addrs[i] = r.String()
+	}
+	return addrs, nil
+}
+
+// setTLSServerName makes the requests to the https target server s, whose address has the IP address its
+// host name resolved to, use name for SNI and to verify its certificate, with a transport of its own.
+func (s *TargetServer) setTLSServerName(name string) {
+	s.tlsServerName = name
+	s.transport = newBackendTransport(name)
+}
+
+// serverName returns the host name of the target server s for TLS: the one its address was resolved
+// from, if it was, or the host of its address.
+func (s *TargetServer) serverName() string {
+	if s.tlsServerName != "" {
+		return s.tlsServerName
+	}
+	return s.URL.Hostname()
+}
+
+// hasResolvedBackends returns true if any of the backends has its host name or SRV record resolved.
+func hasResolvedBackends(backends []BackendConfig) bool {
+	for _, b := range backends {
+		if b.Resolve || isSRVAddress(b.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// DNSDiscoverer is a Discoverer for a list of backends, some of which have their host names or SRV
+// records resolved.
+type DNSDiscoverer struct {
+	Backends []BackendConfig
+	// Interval is how often the names are resolved again.
+	Interval time.Duration
+}
+
+// Discover returns the backends, resolved.
+func (d *DNSDiscoverer) Discover(ctx context.Context) ([]BackendConfig, error) {
+	return resolveBackends(ctx, d.Backends)
+}
+
+// Updates asks for the names to be resolved again every Interval.
+func (d *DNSDiscoverer) Updates(ctx context.Context) <-chan struct{} {
+	return pollUpdates(ctx, d.Interval)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ErrorPageFile is the path of a file, like an HTML page, that is served instead of the plain text
+// errors when no target server can give a response e.g. when none of them are healthy or they time out.
+// It is only served to clients that explicitly accept its content type.
+var ErrorPageFile string
+
+// errorPage is the contents of ErrorPageFile, and errorPageContentType is its content type. errorPage
+// is nil if there is no error page.
+var (
+	errorPage            []byte
+	errorPageContentType string
+)
+
+// initErrorPage reads ErrorPageFile, if it is set. It should be called once the flags have been parsed.
+func initErrorPage() error {
+	if ErrorPageFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(ErrorPageFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read the error page: %s", err)
+	}
+	errorPage = b
+	errorPageContentType = mime.TypeByExtension(filepath.Ext(ErrorPageFile))
+	if errorPageContentType == "" {
+		errorPageContentType = http.DetectContentType(b)
+	}
+	return nil
+}
+
+// writeGatewayError responds to req with the status code, for an error on our side of the request. It
+// serves the error page if there is one that the client accepts, and the plain text msg otherwise.
+func writeGatewayError(w http.ResponseWriter, req *http.Request, msg string, code int) {
+	if errorPage == nil || !acceptsMediaType(req, errorPageContentType) {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", errorPageContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(errorPage)
+}
+
+// acceptsMediaType returns true if the Accept header of req names the media type of contentType, either
+// exactly or with a wildcard subtype like text/*. A bare */* doesn't count, so that API clients and
+// tools like curl keep getting the plain text errors.
+func acceptsMediaType(req *http.Request, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	mainType := strings.SplitN(mediaType, "/", 2)[0]
+	for _, v := range req.Header.Values("Accept") {
+		for _, accepted := range strings.Split(v, ",") {
+			accepted = strings.ToLower(strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0]))
+			if accepted == mediaType || accepted == mainType+"/*" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FairQueueCapacity is the number of requests the fair queue admits for forwarding at the same time.
+// A value of 0 disables the fair queue.
+var FairQueueCapacity int
+
+// FairQueueTimeout is how long a request can wait in the fair queue before it is rejected.
+var FairQueueTimeout time.Duration = 5 * time.Second
+
+// FairQueueKeyHeader is the request header used to identify a client in the fair queue. When empty,
+// the client IP is used.
+var FairQueueKeyHeader string
+
+// FairQueueWeights holds the weights of the clients in the fair queue. Clients that are not listed
+// have a weight of 1.
+var FairQueueWeights = ClientWeights{}
+
+// fairQueue is the admission controller that sits in front of backend forwarding. It is nil when
+// the fair queue is disabled.
+var fairQueue *FairQueue
+
+var ErrFairQueueTimeout = errors.New("Request waited too long to be admitted")
+
+// initFairQueue sets up the fair queue admission controller based on the FairQueue* settings. It
+// should be called once the flags have been parsed.
+func initFairQueue() {
+	fairQueue = nil
+	if FairQueueCapacity > 0 {
+		fairQueue = NewFairQueue(FairQueueCapacity, FairQueueTimeout, FairQueueWeights)
+	}
+}
+
+// fairQueueKey returns the key that identifies the client of req in the fair queue.
+func fairQueueKey(req *http.Request) string {
+	if FairQueueKeyHeader != "" {
+		if key := req.Header.Get(FairQueueKeyHeader); key != "" {
+			return key
+		}
+	}
+	return clientIP(req)
+}
+
+// FairQueue is a weighted fair queuing admission controller. It admits up to capacity requests at a
+// time. Once full, the waiting requests are admitted in the order of their virtual finish time, so
+// that every client gets a share of the capacity proportional to its weight, no matter how many
+// requests it sends. A client that floods the load balancer only delays its own requests.
+type FairQueue struct {
+	capacity int
+	timeout  time.Duration
+	weights  ClientWeights
+
+	mu          sync.Mutex
+	active      int
+	virtualTime float64
+	lastFinish  map[string]float64
+	waiting     fairQueueHeap
+	seq         uint64
+}
+
+// NewFairQueue creates a FairQueue that admits capacity requests at a time, and rejects requests
+// that have been waiting for longer than timeout.
+func NewFairQueue(capacity int, timeout time.Duration, weights ClientWeights) *FairQueue {
+	return &FairQueue{
+		capacity:   capacity,
+		timeout:    timeout,
+		weights:    weights,
+		lastFinish: make(map[string]float64),
+	}
+}
+
+// Acquire blocks until the request from client key is admitted. It returns an error if the request
+// couldn't be admitted within the timeout, or if ctx is done first. Every successful Acquire must be
+// followed by a call to Release.
+func (q *FairQueue) Acquire(ctx context.Context, key string) error {
+	q.mu.Lock()
+	if q.active < q.capacity && len(q.waiting) == 0 {
+		q.active++
+		q.mu.Unlock()
+		return nil
+	}
+
+	// Queue the request with a finish tag based on how much the client has been served lately
+	start := q.virtualTime
+	if last := q.lastFinish[key]; last > start {
+		start = last
+	}
+	w := &fairQueueWaiter{
+		start:  start,
+		finish: start + 1/q.weights.Get(key),
+		seq:    q.seq,
+		ready:  make(chan struct{}),
+	}
+	q.seq++
+	q.lastFinish[key] = w.finish
+	heap.Push(&q.waiting, w)
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = ErrFairQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.index < 0 {
+		// We were admitted while giving up, so pass the slot on to someone else
+		q.releaseLocked()
+		return err
+	}
+	heap.Remove(&q.waiting, w.index)
+	return err
+}
+
+// Release frees the slot held by an admitted request, admitting the next waiting request if any.
+func (q *FairQueue) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked()
+}
+
+func (q *FairQueue) releaseLocked() {
+	if len(q.waiting) == 0 {
+		q.active--
+		if q.active == 0 {
+			// The queue is idle, so past usage no longer matters
+			q.virtualTime = 0
+			q.lastFinish = make(map[string]float64)
+		}
+		return
+	}
+
+	// Hand the slot over to the waiter with the smallest finish tag
+	w := heap.Pop(&q.waiting).(*fairQueueWaiter)
+	q.virtualTime = w.start
+	close(w.ready)
+
+	// Forget the clients that are no longer ahead of the virtual time
+	for k, finish := range q.lastFinish {
+		if finish <= q.virtualTime {
+			delete(q.lastFinish, k)
+		}
+	}
+}
+
+// fairQueueWaiter is a request waiting to be admitted by the FairQueue.
+type fairQueueWaiter struct {
+	start  float64
+	finish float64
+	seq    uint64
+	ready  chan struct{}
+	index  int // index in the heap, -1 once popped
+}
+
+// fairQueueHeap implements heap.Interface, ordering the waiters by finish tag and then by arrival.
+type fairQueueHeap []*fairQueueWaiter
+
+func (h fairQueueHeap) Len() int { return len(h) }
+
+func (h fairQueueHeap) Less(i, j int) bool {
+	if h[i].finish != h[j].finish {
+		return h[i].finish < h[j].finish
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h fairQueueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *fairQueueHeap) Push(x interface{}) {
+	w := x.(*fairQueueWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *fairQueueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
+}
+
+// ClientWeights implements flag.Var interface so it can allow us to pass multiple client weights for
+// the fair queue in the command line, in the form of key=weight.
+type ClientWeights map[string]float64
+
+// Get returns the weight of the client key, defaulting to 1.
+func (cw ClientWeights) Get(key string) float64 {
+	if w, ok := cw[key]; ok {
+		return w
+	}
+	return 1
+}
+
+func (cw ClientWeights) String() string {
+	return "ClientWeights"
+}
+
+func (cw ClientWeights) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("client weight should be in the form key=weight: %s", s)
+	}
+	w, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || w <= 0 {
+		return fmt.Errorf("client weight should be a positive number: %s", s)
+	}
+	cw[strings.TrimSpace(parts[0])] = w
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// isGRPCRequest returns true if req is a gRPC call. gRPC carries the status of a call in the trailers
+// rather than in the HTTP status code, so a gRPC response is always passed on as is.
+func isGRPCRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// announceTrailers declares the trailers of resp in the Trailer header of the response to the client.
+// It has to be called before the headers are written.
+func announceTrailers(w http.ResponseWriter, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		return
+	}
+	names := make([]string, 0, len(resp.Trailer))
+	for name := range resp.Trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Add("Trailer", strings.Join(names, ", "))
+}
+
+// copyTrailers passes the trailers of resp on to the client. It has to be called once the body of resp
+// has been read, as some trailers are only known by then.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Trailer {
+		// The prefix lets trailers through even if they weren't announced up front
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Gzip compression of the responses to the clients that accept it, for the backends that don't compress
+// their responses themselves.
+var (
+	// GzipResponses turns on the compression of the responses.
+	GzipResponses bool
+	// GzipMinSize is the smallest response body, in bytes, that is compressed. Smaller bodies aren't worth
+	// the overhead. Responses whose length isn't known up front are always compressed.
+	GzipMinSize int64 = 1024
+)
+
+// gzipContentTypes are the media types, besides text/*, of the responses that are worth compressing.
+var gzipContentTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/xhtml+xml":  true,
+	"application/rss+xml":    true,
+	"application/atom+xml":   true,
+	"application/wasm":       true,
+	"image/svg+xml":          true,
+}
+
+// gzipWriters keeps the gzip writers around between responses, as they are costly to allocate.
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(ioutil.Discard) },
+}
+
+// shouldGzip returns true if the response resp to req should be compressed on its way to the client.
+func shouldGzip(req *http.Request, resp *http.Response) bool {
+	if !GzipResponses || req.Method == http.MethodHead || !acceptsGzip(req) {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	// Don't compress what the target server has already encoded
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < GzipMinSize {
+		return false
+	}
+	return isCompressible(resp.Header.Get("Content-Type"))
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of req allows a gzip encoded response.
+func acceptsGzip(req *http.Request) bool {
+	for _, v := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			// gzip;q=0 means the client explicitly doesn't want it
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressible returns true if a body of contentType is worth compressing. Event streams are left
+// alone, so that their events aren't held up in the compressor.
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || gzipContentTypes[mediaType]
+}
+
+// setGzipHeaders changes the response headers h for a gzip encoded body.
+func setGzipHeaders(h http.Header) {
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	// The encoded body isn't byte for byte the one a strong ETag was computed for
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// copyGzipResponseBody compresses the body of resp into w. Like copyResponseBody, streaming responses are
+// flushed to the client after every write.
+func copyGzipResponseBody(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	gz := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(gz)
+	gz.Reset(w)
+
+	var dst io.Writer = gz
+	if isStreamingResponse(resp) {
+		dst = &flushWriter{w: gz, rc: http.NewResponseController(w), gz: gz}
+	}
+	n, err := io.Copy(dst, resp.Body)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
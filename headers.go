@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hopHeaders are the hop-by-hop headers, which only apply to a single connection and must not be
+// forwarded by a proxy (RFC 7230, section 6.1). This is the same list as net/http/httputil uses.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // non-standard but still sent by some clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, along with any header listed in its
+// Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// AddViaHeader makes the load balancer add itself to the Via header of the requests it forwards.
+var AddViaHeader bool
+
+// DefaultUserAgent is the User-Agent sent to the target servers for requests that come without one. It
+// is empty by default, which keeps the Go HTTP client from sending its own.
+var DefaultUserAgent string
+
+// viaPseudonym identifies the load balancer in the Via header.
+const viaPseudonym = "teejays-lb"
+
+// addViaHeader appends the load balancer to the Via header of req, after any proxies the request has
+// already been through, with the protocol version that the client used to reach it.
+func addViaHeader(req *http.Request) {
+	version := fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor)
+	if req.ProtoMajor >= 2 {
+		version = strconv.Itoa(req.ProtoMajor)
+	}
+	via := version + " " + viaPseudonym
+	if prior := req.Header.Values("Via"); len(prior) > 0 {
+		via = strings.Join(prior, ", ") + ", " + via
+	}
+	req.Header.Set("Via", via)
+}
+
+// HeaderRules are changes made to the headers of the responses from the target servers of a pool,
+// before they are sent to the client e.g. to add security headers or hide the server software.
+type HeaderRules struct {
+	// Add sets headers on the response, replacing any value the target server set.
+	Add map[string]string `json:"add" yaml:"add"`
+	// Remove deletes headers from the response.
+	Remove []string `json:"remove" yaml:"remove"`
+}
+
+// Apply makes the changes of the rules to h. Headers are removed first, so a header that is both
+// removed and added ends up with the added value. It is a no-op on nil rules.
+func (r *HeaderRules) Apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, name := range r.Remove {
+		h.Del(name)
+	}
+	for name, value := range r.Add {
+		h.Set(name, value)
+	}
+}
+
+// validate checks that all the header names in the rules are valid. field is the name of the rules in
+// the config, for the errors.
+func (r *HeaderRules) validate(field string) error {
+	if r == nil {
+		return nil
+	}
+	for name := range r.Add {
+		if !isValidHeaderName(name) {
+			return &ConfigError{field + ".add", fmt.Sprintf("%q is not a valid header name", name)}
+		}
+	}
+	for i, name := range r.Remove {
+		if !isValidHeaderName(name) {
+			return &ConfigError{fmt.Sprintf("%s.remove[%d]", field, i), fmt.Sprintf("%q is not a valid header name", name)}
+		}
+	}
+	return nil
+}
+
+// isValidHeaderName returns true if name can be used as an HTTP header name.
+func isValidHeaderName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\r\n:")
+}
+
+// DebugHeaders makes the load balancer tag every proxied response with the target server that served it
+// and the number of retries it took, for troubleshooting. It should be off in production, as it exposes
+// the addresses of the target servers to the clients.
+var DebugHeaders bool
+
+// Names of the debug headers.
+const (
+	debugBackendHeader = "X-LB-Backend"
+	debugRetriesHeader = "X-LB-Retries"
+)
+
+// setDebugHeaders sets the debug headers on h, for a response served by the target server after the
+// number of retries. Any debug headers set by the target server itself are overwritten.
+func setDebugHeaders(h http.Header, target *TargetServer, retries int) {
+	h.Set(debugBackendHeader, target.Address)
+	h.Set(debugRetriesHeader, strconv.Itoa(retries))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HealthExpectation is an assertion on the body of the health check responses of a target server, for
+// target servers that respond with a 200 even when they are unhealthy. It is checked on top of what the
+// health check mode looks at, and a server whose health response doesn't meet it is degraded.
+type HealthExpectation struct {
+	// BodyContains is a string that the body must contain.
+	BodyContains string `json:"body_contains" yaml:"body_contains"`
+	// JSONField is the dot separated path of a field in the JSON body e.g. checks.db.status, and
+	// JSONValue the value it must have. Values that aren't strings are compared in their JSON form e.g.
+	// true or 3.
+	JSONField string `json:"json_field" yaml:"json_field"`
+	JSONValue string `json:"json_value" yaml:"json_value"`
+}
+
+// HealthExpect is the expectation on the health responses of the target servers that don't have one of
+// their own. The zero value expects nothing.
+var HealthExpect HealthExpectation
+
+var ErrHealthExpectationFailed = errors.New("health response doesn't meet the expectation")
+
+// IsZero returns true if e expects nothing of the body.
+func (e *HealthExpectation) IsZero() bool {
+	return e == nil || (e.BodyContains == "" && e.JSONField == "")
+}
+
+// Check returns an error wrapping ErrHealthExpectationFailed if body doesn't meet the expectation.
+func (e *HealthExpectation) Check(body []byte) error {
+	if e.IsZero() {
+		return nil
+	}
+	if e.BodyContains != "" && !strings.Contains(string(body), e.BodyContains) {
+		return fmt.Errorf("%w: the body doesn't contain %q", ErrHealthExpectationFailed, e.BodyContains)
+	}
+	if e.JSONField == "" {
+		return nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("%w: the body is not valid JSON: %s", ErrHealthExpectationFailed, err)
+	}
+	for _, key := range strings.Split(e.JSONField, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%w: field %s not found", ErrHealthExpectationFailed, e.JSONField)
+		}
+		if v, ok = obj[key]; !ok {
+			return fmt.Errorf("%w: field %s not found", ErrHealthExpectationFailed, e.JSONField)
+		}
+	}
+
+	var got string
+	if s, ok := v.(string); ok {
+		got = s
+	} else {
+		b, _ := json.Marshal(v)
+		got = string(b)
+	}
+	if got != e.JSONValue {
+		return fmt.Errorf("%w: field %s is %s, expected %s", ErrHealthExpectationFailed, e.JSONField, got, e.JSONValue)
+	}
+	return nil
+}
+
+// setJSON sets the JSON field assertion of e from a field=value string, as passed on the command line.
+func (e *HealthExpectation) setJSON(s string) error {
+	field, value, ok := strings.Cut(s, "=")
+	if !ok || field == "" {
+		return fmt.Errorf("expected field=value but got %q", s)
+	}
+	e.JSONField, e.JSONValue = field, value
+	return nil
+}
+
+// validate checks the expectation found under the field name.
+func (e *HealthExpectation) validate(field string) error {
+	if e != nil && e.JSONValue != "" && e.JSONField == "" {
+		return &ConfigError{field + ".json_field", "must be set along with json_value"}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MaxInflightRequests caps the number of client requests that the load balancer proxies at the same
+// time. A value of 0 means there is no limit.
+var MaxInflightRequests int
+
+// Overflow modes, which decide what happens to a request that comes in when all the in-flight slots are
+// taken.
+const (
+	// OverflowReject turns the request away with a 503 right away.
+	OverflowReject = "reject"
+	// OverflowQueue makes the request wait up to OverflowQueueTimeout for a slot to free up.
+	OverflowQueue = "queue"
+)
+
+// OverflowMode is the overflow mode used when MaxInflightRequests is reached.
+var OverflowMode = OverflowReject
+
+// OverflowQueueTimeout is the longest a request waits for an in-flight slot in the queue overflow mode.
+var OverflowQueueTimeout time.Duration = 100 * time.Millisecond
+
+// inflight is the global concurrency semaphore. Each request being proxied holds one slot in the
+// channel. It is nil when there is no limit on the number of in-flight requests.
+var inflight chan struct{}
+
+var (
+	ErrTooManyInflightRequests = errors.New("Too many requests are being processed, try again later")
+	ErrInvalidOverflowMode     = fmt.Errorf("overflow mode should be one of: %s, %s", OverflowReject, OverflowQueue)
+)
+
+// ValidateOverflowMode returns an error if mode is not a known overflow mode.
+func ValidateOverflowMode(mode string) error {
+	if mode != OverflowReject && mode != OverflowQueue {
+		return ErrInvalidOverflowMode
+	}
+	return nil
+}
+
+// initInflightLimiter sets up the global concurrency semaphore based on MaxInflightRequests. It should
+// be called once the flags have been parsed, and before the listener starts accepting requests.
+func initInflightLimiter() {
+	inflight = nil
+	if MaxInflightRequests > 0 {
+		inflight = make(chan struct{}, MaxInflightRequests)
+	}
+}
+
+// acquireInflightSlot tries to take a slot in the global concurrency semaphore for a request with
+// context ctx. It returns false if all the slots are taken, after waiting for up to OverflowQueueTimeout
+// for one to free up in the queue overflow mode. Otherwise, it returns a release function
+// that frees the slot. The slot is also freed as soon as ctx is done, so a client that disconnects
+// mid-request doesn't hold on to the slot until the target server finishes. The release function is
+// safe to call more than once.
+func acquireInflightSlot(ctx context.Context) (func(), bool) {
+	if inflight == nil {
+		return func() {}, true
+	}
+
+	select {
+	case inflight <- struct{}{}:
+	default:
+		if OverflowMode != OverflowQueue || !waitInflightSlot(ctx) {
+			return nil, false
+		}
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { <-inflight })
+	}
+	go func() {
+		<-ctx.Done()
+		release()
+	}()
+
+	return release, true
+}
+
+// waitInflightSlot waits for a slot in the global concurrency semaphore to free up, for up to
+// OverflowQueueTimeout. It returns true if it took a slot.
+func waitInflightSlot(ctx context.Context) bool {
+	timer := time.NewTimer(OverflowQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case inflight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
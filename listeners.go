@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/teejays/clog"
+	"golang.org/x/sync/errgroup"
+)
+
+// ShutdownTimeout is how long the listener servers wait for the requests in flight to finish when the
+// load balancer is shut down, before closing their connections anyway.
+var ShutdownTimeout time.Duration = 30 * time.Second
+
+// ListenerPorts implements flag.Var interface so it can allow us to pass multiple ports for the listener
+// servers, by repeating the -p flag.
+type ListenerPorts []int
+
+func (p *ListenerPorts) String() string {
+	return fmt.Sprint([]int(*p))
+}
+
+func (p *ListenerPorts) Set(s string) error {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %s", s)
+	}
+	*p = append(*p, port)
+	return nil
+}
+
+// startListeners starts a listener server on each of the ports, all of them serving handler, along with
+// the admin server if it isn't nil. It is blocking, and only returns once all the servers are closed. If
+// one of them fails, e.g. because its port is taken, the others are shut down and the error is returned.
+// When ctx is done, all the servers are shut down gracefully and it returns nil.
+func startListeners(ctx context.Context, ports []int, handler http.Handler, admin *http.Server) error {
+	servers := make([]*http.Server, len(ports))
+	for i, port := range ports {
+		servers[i] = newListenerServer(port, handler)
+	}
+	if admin != nil {
+		servers = append(servers, admin)
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i := range servers {
+		server := servers[i]
+		// The admin server is only meant to be reached directly, in plain HTTP
+		public := server != admin
+		g.Go(func() error {
+			clog.Infof("Staring the server: %s", server.Addr)
+			l, err := net.Listen("tcp", server.Addr)
+			if err != nil {
+				return err
+			}
+			if ProxyProtocol && public {
+				l = &proxyProtoListener{l}
+			}
+			if TLSCertFile != "" && public {
+				err = server.ServeTLS(l, TLSCertFile, TLSKeyFile)
+			} else {
+				err = server.Serve(l)
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	// Shut all the servers down once we're asked to, or as soon as one of them fails
+	g.Go(func() error {
+		<-gctx.Done()
+		clog.Infof("Shutting down the listener servers")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				clog.Errorf("Failed to shut down the server %s gracefully: %s", server.Addr, err)
+			}
+		}
+		return nil
+	})
+
+	return g.Wait()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// LoadBalancer balances the requests it serves over its pools of target servers. It is an http.Handler,
+// so it can be mounted in any server, and any number of them can run side by side in one process. The
+// settings that come from the command line, like the timeouts, limits and retry policy, are shared by
+// all of them.
+type LoadBalancer struct {
+	// Pool is the default pool, for the requests that match none of the routes and virtual hosts.
+	Pool *ServerPool
+	// Router sends the requests that match a route or a virtual host to their own pool. It is nil when
+	// there are none.
+	Router *Router
+	// Canary takes a share of the requests to the default pool. It is nil when there is no canary.
+	Canary *Canary
+
+	// draining is true once the load balancer has been asked to drain, ahead of being shut down. Its
+	// probe endpoints then fail, so that whatever is in front of it stops sending it traffic, while the
+	// requests that still come in are served as usual. It is toggled through the admin API.
+	draining atomic.Bool
+	// maintenance is true while the load balancer is in maintenance mode, during which every request
+	// gets the maintenance page and no request reaches the target servers. It is toggled through the
+	// admin API.
+	maintenance atomic.Bool
+}
+
+// LoadBalancerOptions are the settings of a LoadBalancer created with NewLoadBalancer.
+type LoadBalancerOptions struct {
+	// Backends are the target servers of the default pool.
+	Backends []BackendConfig
+	// Discoverer finds the target servers of the default pool instead of Backends, if it is set.
+	Discoverer Discoverer
+	// ResponseHeaders are the rules applied to the headers of the responses from the default pool.
+	ResponseHeaders *HeaderRules
+	// Routes and Hosts send the requests that match them to pools of their own.
+	Routes []RouteConfig
+	Hosts  map[string]VirtualHostConfig
+	// Canary takes a share of the requests to the default pool, if it is set.
+	Canary *CanaryConfig
+	// Transport makes the requests to the target servers of all the pools. The transport set up from
+	// the command line is used when it is nil.
+	Transport http.RoundTripper
+}
+
+// NewLoadBalancer creates a LoadBalancer with a pool for each of the backends, routes, virtual hosts and
+// canary in opts, and starts their health checks. Stop should be called once the load balancer is no
+// longer used.
+func NewLoadBalancer(opts LoadBalancerOptions) (*LoadBalancer, error) {
+	var lb LoadBalancer
+	var err error
+
+	routed := len(opts.Routes) > 0 || len(opts.Hosts) > 0
+	hasDefault := len(opts.Backends) > 0 || opts.Discoverer != nil
+	switch {
+	case opts.Discoverer != nil:
+		lb.Pool, err = NewServerPoolFromDiscoverer(opts.Discoverer)
+		if err != nil {
+			return nil, err
+		}
+	case !hasDefault && routed:
+		// Everything goes through the router, and the requests that match nothing get a 404
+		lb.Pool = &ServerPool{}
+	default:
+		lb.Pool, err = NewServerPoolFromBackends(opts.Backends)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lb.Pool.ResponseHeaders = opts.ResponseHeaders
+
+	if routed {
+		var defaultPool *ServerPool
+		if hasDefault {
+			defaultPool = lb.Pool
+		}
+		lb.Router, err = NewRouter(opts.Routes, opts.Hosts, defaultPool)
+		if err != nil {
+			lb.Stop()
+			return nil, err
+		}
+		clog.Infof("Router created with %d virtual hosts and %d routes.", len(opts.Hosts), len(opts.Routes))
+	}
+
+	if opts.Canary != nil {
+		lb.Canary, err = NewCanary(opts.Canary.Backends, opts.Canary.Percent)
+		if err != nil {
+			lb.Stop()
+			return nil, err
+		}
+		clog.Infof("Canary created with %d servers, getting %g%% of the requests.", len(opts.Canary.Backends), opts.Canary.Percent)
+	}
+
+	if opts.Transport != nil {
+		for _, p := range lb.pools() {
+			p.Transport = opts.Transport
+		}
+	}
+	return &lb, nil
+}
+
+// Handler returns the handler for the listener servers, which serves the probe endpoints of lb ahead of
+// the proxied requests. The admin API is served by AdminHandler instead.
+func (lb *LoadBalancer) Handler() http.Handler {
+	return lb.withProbeRoutes(lb)
+}
+
+// pools returns all the pools of the load balancer.
+func (lb *LoadBalancer) pools() []*ServerPool {
+	pools := []*ServerPool{lb.Pool}
+	if lb.Router != nil {
+		pools = append(pools, lb.Router.pools()...)
+	}
+	if lb.Canary != nil {
+		pools = append(pools, lb.Canary.Pool)
+	}
+	return pools
+}
+
+// hasDefaultPool returns false if everything goes through the router, in which case lb.Pool is an
+// empty placeholder that never gets any requests.
+func (lb *LoadBalancer) hasDefaultPool() bool {
+	return lb.Router == nil || lb.Router.Default != nil
+}
+
+// namedPools returns the pools of the load balancer by name, as shown in the admin API: "default" for
+// the default pool, unless everything goes through the router, "canary" for the canary pool, and the
+// names given by Router.namedPools for the pools of the virtual hosts and routes.
+func (lb *LoadBalancer) namedPools() map[string]*ServerPool {
+	pools := make(map[string]*ServerPool)
+	if lb.hasDefaultPool() {
+		pools["default"] = lb.Pool
+	}
+	if lb.Router != nil {
+		for name, p := range lb.Router.namedPools() {
+			pools[name] = p
+		}
+	}
+	if lb.Canary != nil {
+		pools["canary"] = lb.Canary.Pool
+	}
+	return pools
+}
+
+// Stats returns the stats of all the pools of the load balancer added up, as if all their servers were in
+// a single pool.
+func (lb *LoadBalancer) Stats() PoolStats {
+	var stats PoolStats
+	for _, p := range lb.pools() {
+		s := p.Stats()
+		stats.Total += s.Total
+		stats.Healthy += s.Healthy
+		stats.Degraded += s.Degraded
+		stats.Unknown += s.Unknown
+		stats.Warming += s.Warming
+		stats.Selectable += s.Selectable
+		stats.Servers = append(stats.Servers, s.Servers...)
+	}
+	return stats
+}
+
+// WaitForHealthy blocks until at least one of the servers in any of the pools of the load balancer is
+// healthy, checking every interval, or returns ErrStartupTimeout once ctx is done.
+func (lb *LoadBalancer) WaitForHealthy(ctx context.Context, interval time.Duration) error {
+	return waitForHealthy(ctx, interval, func() []*TargetServer {
+		var servers []*TargetServer
+		for _, p := range lb.pools() {
+			servers = append(servers, p.ServerList()...)
+		}
+		return servers
+	})
+}
+
+// Stop stops the health checks of all the pools of the load balancer.
+func (lb *LoadBalancer) Stop() {
+	for _, p := range lb.pools() {
+		p.Stop()
+	}
+}
+
+// poolFor returns the pool that req should be forwarded to, or nil if there is none.
+func (lb *LoadBalancer) poolFor(req *http.Request) *ServerPool {
+	p := lb.Pool
+	if lb.Router != nil {
+		p = lb.Router.Match(req)
+	}
+	if lb.Canary != nil && p == lb.Pool {
+		return lb.Canary.pick(p)
+	}
+	return p
+}
+
+// ServeHTTP implements http.Handler. It implements the logic for load-balancing, where it finds a
+// healthy target server from the pool for req, forwards the request to it, and copies over its response
+// to the response for the client request.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	// Log a line for every request once we're done with it
+	entry := newAccessLogEntry(req)
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() { entry.finish(rec.Status()) }()
+
+	// Tag the request with an ID, which the target server gets along with the request, and the client
+	// along with the response
+	if RequestIDHeader != "" {
+		entry.RequestID = ensureRequestID(req)
+		w.Header().Set(RequestIDHeader, entry.RequestID)
+	}
+
+	// Trace the request, if tracing is enabled
+	req, endSpan := startRequestSpan(req)
+	defer func() { endSpan(rec.Status()) }()
+
+	// Nothing goes through while the load balancer is in maintenance mode
+	if lb.serveMaintenancePage(w) {
+		return
+	}
+
+	// Derive a context that is cancelled once we are done with the request, as soon as the client
+	// goes away, or once the request deadline passes. Everything downstream, including the upstream
+	// request, uses it too so it gets cancelled along with the client request.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if RequestDeadline > 0 {
+		ctx, cancel = context.WithTimeout(req.Context(), RequestDeadline)
+	} else {
+		ctx, cancel = context.WithCancel(req.Context())
+	}
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	// Find the pool of target servers for the request
+	targetPool := lb.poolFor(req)
+	if targetPool == nil {
+		http.Error(w, ErrNoRoute.Error(), http.StatusNotFound)
+		return
+	}
+	entry.Pool = targetPool
+
+	// Turn away clients that are over their rate limit, before they take up any capacity
+	if rateLimiter != nil && !rateLimiter.Allow(clientIP(req), time.Now()) {
+		http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	// Hold a slot in the global concurrency semaphore while the request is being processed
+	release, ok := acquireInflightSlot(ctx)
+	if !ok {
+		http.Error(w, ErrTooManyInflightRequests.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	// Wait for our turn if the fair queue is enabled, so that no single client can starve the others
+	if fairQueue != nil {
+		err := fairQueue.Acquire(ctx, fairQueueKey(req))
+		if errors.Is(err, context.DeadlineExceeded) {
+			writeGatewayError(w, req, ErrRequestDeadlineExceeded.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer fairQueue.Release()
+	}
+
+	// Connection upgrades, like WebSockets, need a tunnel to the target server rather than a plain
+	// request and response
+	if isUpgradeRequest(req) {
+		tunnelRequest(w, req, targetPool, entry)
+		return
+	}
+
+	// Reject bodies that are over the limit, and buffer the body so that it can be sent again if the
+	// retry policy allows retrying the request with a different server, or if it is mirrored to the
+	// shadow target server. This is done once the request is admitted, so that the buffered bodies are
+	// bounded by the in-flight limit.
+	if !limitRequestBody(w, req) {
+		http.Error(w, ErrRequestBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	shadow := shouldShadow()
+	if canRetryMethod(req.Method) || shadow {
+		if err := bufferRequestBody(req); err != nil {
+			if isBodyTooLarge(err) {
+				http.Error(w, ErrRequestBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, ErrReadRequestBody.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lb.forwardRequest(w, req, targetPool, entry)
+
+	// Mirror the request only once the client has its response, so that it is never held up by it
+	if shadow {
+		shadowRequest(req)
+	}
+}
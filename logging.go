@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// Log formats, for the -log-format flag.
+const (
+	// LogFormatText logs through clog, with the fields appended to the message as key=value pairs.
+	LogFormatText = "text"
+	// LogFormatJSON logs every line as a JSON object, for log pipelines.
+	LogFormatJSON = "json"
+)
+
+// LogFormat is the format of the structured log lines, like the access logs and the health transitions.
+var LogFormat = LogFormatText
+
+var ErrInvalidLogFormat = fmt.Errorf("log format should be one of: %s, %s", LogFormatText, LogFormatJSON)
+
+// ValidateLogFormat returns an error if format is not a known log format.
+func ValidateLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return ErrInvalidLogFormat
+	}
+	return nil
+}
+
+// logOutput is where the JSON log lines are written.
+var logOutput io.Writer = os.Stdout
+
+// logOutputLock makes sure that concurrent JSON log lines don't get interleaved.
+var logOutputLock sync.Mutex
+
+// logLevel is the severity of a log line. The names match the clog levels.
+type logLevel string
+
+const (
+	levelDebug   logLevel = "debug"
+	levelInfo    logLevel = "info"
+	levelNotice  logLevel = "notice"
+	levelWarning logLevel = "warning"
+	levelError   logLevel = "error"
+)
+
+// logField is a key and value attached to a structured log line. Durations are logged as milliseconds
+// in JSON, under the key with a _ms suffix.
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// logEvent logs msg along with fields at level, in LogFormat.
+func logEvent(level logLevel, msg string, fields ...logField) {
+	if LogFormat == LogFormatJSON {
+		logJSON(level, msg, fields)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	line := b.String()
+
+	switch level {
+	case levelDebug:
+		clog.Debug(line)
+	case levelNotice:
+		clog.Notice(line)
+	case levelWarning:
+		clog.Warning(line)
+	case levelError:
+		clog.Error(line)
+	default:
+		clog.Info(line)
+	}
+}
+
+// logJSON writes a log line as a JSON object with the time, level, msg and the fields.
+func logJSON(level logLevel, msg string, fields []logField) {
+	line := make(map[string]interface{}, len(fields)+3)
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = msg
+	for _, f := range fields {
+		if d, ok := f.Value.(time.Duration); ok {
+			line[f.Key+"_ms"] = float64(d) / float64(time.Millisecond)
+			continue
+		}
+		line[f.Key] = f.Value
+	}
+
+	logOutputLock.Lock()
+	defer logOutputLock.Unlock()
+	json.NewEncoder(logOutput).Encode(line)
+}
@@ -1,6 +1,6 @@
 // main package implements a sample load balancer in Golang. The program
 // accepts two different kinds of parameters:
-// -p: port at which the run the listener server
+// -p: port at which the run the listener server, can be repeated
 // -b: address for backend servers
 //
 // The application has three main components:
@@ -23,8 +23,8 @@
 // 1. Listener webserver accepts the request
 // 2. It uses a Round Robin type algorithm to get a healthy target server from the pool. If
 //    no healthy server, return error.
-// 3. Make a request to the healthy target server. If status code is 500, repeat from 1.
-//    To-do: Implement a limit on how many retries on a 500 response.
+// 3. Make a request to the healthy target server. If status code is 500, repeat from 1, up to
+//    -max-retries times.
 // 4. Copy the response from the target server to the resonse for the client http request.
 //
 //
@@ -34,116 +34,551 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/teejays/clog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	// listenerPostDefault is the port that is used by listener webserver when a port is not explicitly specified in the command line.
 	listenerPortDeault int = 8888
+	// StatusClientClosedRequest is the non-standard status, borrowed from nginx, that is logged for the
+	// requests that the client gave up on before getting a response.
+	StatusClientClosedRequest int = 499
+)
 
-	// listenerReadTimeout is the listener server timeout for reading the request.
-	listenerReadTimeout time.Duration = 10 * time.Second
+// Timeouts of the connections of the clients to the listener server. A value of 0 means no timeout.
+var (
+	// ListenerReadTimeout bounds reading the whole request, including the body, from the client.
+	ListenerReadTimeout time.Duration = 10 * time.Second
+	// ListenerWriteTimeout bounds the time from the end of reading the request headers to the end of
+	// writing the response. It is off by default, as it would cut off streamed and long polling
+	// responses that take longer than it.
+	ListenerWriteTimeout time.Duration
+	// ListenerIdleTimeout is how long a keep-alive connection is kept open while waiting for the next
+	// request. If it is 0, ListenerReadTimeout is used instead.
+	ListenerIdleTimeout time.Duration = 2 * time.Minute
 )
 
-// pool is the singleton pattern instance of ServerPool. This holds all our target servers, and is the main
-// load balancer entity.
-var pool *ServerPool
+// ListenerMaxHeaderBytes is the largest request header block, in bytes, taken from a client, so that a
+// client can't tie up the memory of the load balancer with huge headers. Requests with larger headers
+// are rejected with a 431 before they are handled. It only applies to the requests of the clients: the
+// response headers of the target servers aren't limited by it.
+var ListenerMaxHeaderBytes = 64 << 10
+
+// RequestDeadline bounds the entire lifetime of a client request, as seen by the client. A value of 0
+// means there is no deadline. The timeouts compose as follows:
+//   - ListenerReadTimeout only bounds reading the request from the client, and is enforced by the
+//     listener server independently of the request deadline. The same goes for ListenerWriteTimeout
+//     and writing the response, if it is set.
+//   - FairQueueTimeout only bounds the wait in the fair queue. Whichever of it and the request
+//     deadline comes first applies.
+//   - RequestDeadline covers everything else: waiting for admission, every attempt to a target server
+//     including the retries, and copying the response back. Once it passes, all the in-flight work for
+//     the request is cancelled and the client gets a 504 if nothing has been sent to it yet.
+var RequestDeadline time.Duration
+
+var ErrRequestDeadlineExceeded = errors.New("Request took longer than the request deadline")
+
+// TLSCertFile and TLSKeyFile are the certificate and private key that the listener server uses to
+// serve HTTPS. Clients can then use HTTP/2, which is negotiated during the TLS handshake.
+var TLSCertFile, TLSKeyFile string
+
+// EnableH2C allows clients to use HTTP/2 without TLS, with prior knowledge, as gRPC clients do.
+var EnableH2C bool
+
+// Errors sent to the client when the request to the chosen target server fails. A target server that
+// cannot be reached results in a 502, and one that times out in a 504.
+var (
+	ErrBadGateway     = errors.New("Could not reach the target server")
+	ErrGatewayTimeout = errors.New("Target server took too long to respond")
+)
 
 func main() {
 	var err error
 
+	// The check subcommand reports the health of a running load balancer, and exits
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheckCommand(os.Args[2:]))
+	}
+
 	// Step 1: Process the flags
-	var listenerPort int
+	var listenerPorts ListenerPorts
 	var serverAddrs ServerAddresses
-	flag.IntVar(&listenerPort, "p", listenerPortDeault, "The port at which the load balancer server will listen.")
+	var configPath string
+	var showVersion bool
+	flag.BoolVar(&showVersion, "version", false, "Print the version of the load balancer, and exit.")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML or JSON config file. Command line flags take precedence over it.")
+	flag.Var(&listenerPorts, "p", fmt.Sprintf("A port at which the load balancer server will listen. Can be repeated to listen on more than one port. Defaults to %d.", listenerPortDeault))
 	flag.Var(&serverAddrs, "b", "One of more target server addresses")
+	flag.IntVar(&MaxInflightRequests, "max-inflight", 0, "Maximum number of requests proxied at the same time. 0 means no limit.")
+	flag.StringVar(&OverflowMode, "overflow", OverflowReject, "What happens to a request when -max-inflight is reached: 'reject' returns a 503 right away, 'queue' waits up to -overflow-timeout for a slot first.")
+	flag.DurationVar(&OverflowQueueTimeout, "overflow-timeout", OverflowQueueTimeout, "Longest a request waits for an in-flight slot in the 'queue' overflow mode.")
+	flag.StringVar(&HealthExpect.BodyContains, "health-expect-body", "", "A string that the body of the health responses of the target servers must contain for them to be healthy.")
+	flag.Func("health-expect-json", "A field=value assertion on the JSON body of the health responses of the target servers e.g. checks.db=ok, that must hold for them to be healthy. Nested fields are separated by dots.", HealthExpect.setJSON)
+	flag.IntVar(&HealthyThreshold, "healthy-threshold", HealthyThreshold, "Number of health checks in a row that need to pass for a target server to become healthy.")
+	flag.IntVar(&BackendMaxConns, "backend-max-conns", 0, "Most requests in flight to a single target server at the same time. A server at the cap is skipped until one of its requests is done. 0 means no limit.")
+	flag.IntVar(&UnhealthyThreshold, "unhealthy-threshold", UnhealthyThreshold, "Number of health checks in a row that need to fail for a target server to become degraded.")
+	flag.DurationVar(&HealthCheckTimeout, "health-timeout", HealthCheckTimeout, "Timeout for a health check of a target server, after which the server is considered degraded.")
+	flag.StringVar(&ProxyMode, "mode", ProxyModeHTTP, "What the load balancer proxies: 'http' for HTTP requests, or 'tcp' for raw TCP connections to target servers given as tcp://host:port, whose health is then checked by connecting to them.")
+	flag.DurationVar(&TCPDialTimeout, "tcp-dial-timeout", TCPDialTimeout, "How long to wait for a connection to a target server in the tcp mode.")
+	flag.StringVar(&HealthCheckMode, "health-mode", HealthModeJSON, "How target server health is checked: 'json' reads the State field from the health response, 'status' treats any 2xx response as healthy, 'tcp' only checks that the server accepts a TCP connection, 'grpc' calls the gRPC health service (in builds with the grpchealth tag).")
+	flag.BoolVar(&WaitHealthy, "wait-healthy", WaitHealthy, "Check the health of all the target servers once before serving traffic, so the ones that are up can be used right away.")
+	flag.DurationVar(&StartupTimeout, "startup-timeout", 0, "Wait up to this long at startup for a healthy target server, and exit with an error if there is none. 0 means don't wait.")
+	flag.DurationVar(&HealthCheckMaxBackoff, "health-max-backoff", HealthCheckMaxBackoff, "Longest wait between two health checks of a degraded server.")
+	flag.IntVar(&FairQueueCapacity, "fair-queue", 0, "Number of requests admitted for forwarding at the same time by the fair queue. 0 disables the fair queue.")
+	flag.DurationVar(&FairQueueTimeout, "fair-queue-timeout", FairQueueTimeout, "Longest a request can wait in the fair queue before getting a 503.")
+	flag.StringVar(&FairQueueKeyHeader, "fair-queue-key", "", "Request header that identifies a client in the fair queue. Defaults to the client IP.")
+	flag.Var(FairQueueWeights, "fair-queue-weight", "Weight of a client in the fair queue, in the form key=weight. Can be repeated.")
+	flag.DurationVar(&RequestDeadline, "request-deadline", 0, "Longest a client request can take end-to-end, including retries. 0 means no deadline.")
+	flag.IntVar(&BackendMaxIdleConns, "backend-max-idle-conns", BackendMaxIdleConns, "Maximum number of idle connections kept open to all the target servers together. 0 means no limit.")
+	flag.IntVar(&BackendMaxIdleConnsPerHost, "backend-max-idle-conns-per-host", BackendMaxIdleConnsPerHost, "Maximum number of idle connections kept open to each target server, for reuse by later requests. Set it to about the number of concurrent requests a target server gets.")
+	flag.DurationVar(&BackendIdleConnTimeout, "backend-idle-conn-timeout", BackendIdleConnTimeout, "How long an idle connection to a target server is kept open. Keep it below the keep-alive timeout of the target servers.")
+	flag.BoolVar(&BackendNoKeepAlive, "backend-no-keepalive", false, "Open a new connection for every request to a target server, ignoring the -backend-*idle* settings. For debugging target servers that mishandle persistent connections.")
+	flag.BoolVar(&BackendH2C, "backend-h2c", false, "Talk HTTP/2 without TLS to the http:// target servers, as needed for gRPC servers. Combine with -h2c or -tls-cert to proxy gRPC.")
+	flag.IntVar(&BackendH2MaxStreams, "backend-h2-max-streams", 0, "Maximum concurrent streams on a single HTTP/2 connection to a target server, opening more connections when saturated. 0 uses the server's limit.")
+	flag.BoolVar(&BackendH2StrictStreams, "backend-h2-strict-streams", false, "Wait for a free stream instead of opening more connections when an HTTP/2 target server's stream limit is reached.")
+	flag.StringVar(&SelectionAlgorithm, "algo", SelectionAlgorithm, "Algorithm for picking a target server: roundrobin, random, leastconn, leasttime, iphash, weightedrandom, weightedroundrobin, weightedleastconn or scorebased.")
+	flag.DurationVar(&ScoreLatencyTarget, "score-latency-target", ScoreLatencyTarget, "The p95 latency at which the latency part of the health score of a target server is halved.")
+	flag.DurationVar(&SlowStartWindow, "slow-start", SlowStartWindow, "How long a server that recovers from being degraded takes to ramp up to its full share of requests. 0 disables slow start.")
+	flag.StringVar(&LogFormat, "log-format", LogFormatText, "Format of the access logs and health transitions: 'text' or 'json'.")
+	flag.StringVar(&OtelEndpoint, "otel-endpoint", "", "URL of an OpenTelemetry collector to export traces to over OTLP/HTTP e.g. http://localhost:4318. Tracing is off when unset.")
+	flag.BoolVar(&LogSelectionDecisions, "debug-selection", false, "Log the candidates and scores behind every target server selection.")
+	flag.Int64Var(&MaxBodyBytes, "max-body-bytes", MaxBodyBytes, "Largest request body accepted from clients. Larger requests are rejected with a 413. 0 means no limit.")
+	flag.IntVar(&MaxRetries, "max-retries", MaxRetries, "Most times a request is retried with a different target server.")
+	flag.Var(&RetryOn, "retry-on", "Comma separated list of the target server response statuses, or ranges of them, that degrade the server and retry the request with another one e.g. 500,502-504. Other statuses are passed on to the client.")
+	flag.BoolVar(&RetryNonIdempotent, "retry-non-idempotent", false, "Also retry requests with non-idempotent methods like POST and PATCH with a different server, at the risk of processing them twice.")
+	flag.Int64Var(&RetryBodyMaxBytes, "retry-body-max-bytes", RetryBodyMaxBytes, "Largest request body that is buffered so that the request can be retried. Requests with larger bodies are streamed and never retried.")
+	flag.StringVar(&TLSCertFile, "tls-cert", "", "Certificate file for serving HTTPS. Requires -tls-key.")
+	flag.StringVar(&TLSKeyFile, "tls-key", "", "Private key file for serving HTTPS. Requires -tls-cert.")
+	flag.BoolVar(&EnableH2C, "h2c", false, "Accept HTTP/2 without TLS (h2c with prior knowledge) e.g. from gRPC clients.")
+	flag.StringVar(&MaintenancePageFile, "maintenance-page", "", "File served to all the clients while maintenance mode is on, with a content type based on its extension. A plain text message is served when unset.")
+	flag.IntVar(&MaintenanceStatus, "maintenance-status", MaintenanceStatus, "Status code of the responses while maintenance mode is on.")
+	flag.StringVar(&ErrorPageFile, "error-page", "", "File served instead of the plain text errors when no target server can respond, to clients that accept its content type e.g. an HTML page for browsers.")
+	flag.DurationVar(&ListenerReadTimeout, "read-timeout", ListenerReadTimeout, "Timeout for reading a whole request from a client, including the body. 0 disables it.")
+	flag.DurationVar(&ListenerWriteTimeout, "write-timeout", 0, "Timeout for writing a response to a client, counted from the end of the request headers. Off by default, as it cuts off streamed and long polling responses that take longer.")
+	flag.IntVar(&ListenerMaxHeaderBytes, "max-header-bytes", ListenerMaxHeaderBytes, "Largest request header block, in bytes, accepted from a client. Requests with larger headers get a 431. Raise it if the clients legitimately send large headers, e.g. big cookies set by the target servers.")
+	flag.DurationVar(&ListenerIdleTimeout, "idle-timeout", ListenerIdleTimeout, "How long an idle keep-alive client connection is kept open. 0 falls back to -read-timeout.")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", ShutdownTimeout, "How long the requests in flight get to finish when the load balancer is shut down with SIGINT or SIGTERM.")
+	flag.Float64Var(&OutlierErrorRate, "outlier-error-rate", 0, "Eject a target server once this fraction of its requests fail over -outlier-window, even if its health checks pass e.g. 0.5. 0 disables outlier detection.")
+	flag.DurationVar(&OutlierWindow, "outlier-window", OutlierWindow, "Rolling window over which the error rate of a target server is computed for outlier detection.")
+	flag.IntVar(&OutlierMinRequests, "outlier-min-requests", OutlierMinRequests, "Least number of requests to a target server over -outlier-window for it to be ejected.")
+	flag.DurationVar(&OutlierEjectionTime, "outlier-ejection-time", OutlierEjectionTime, "How long a target server is ejected the first time. Every following ejection in a row lasts this much longer.")
+	flag.DurationVar(&OutlierMaxEjectionTime, "outlier-max-ejection-time", OutlierMaxEjectionTime, "Cap on the ejection time of a target server.")
+	flag.DurationVar(&SlowThreshold, "slow-threshold", 0, "Eject a target server whose responses take longer than this for -slow-consecutive requests in a row, even if they succeed e.g. 2s. 0 disables slow server ejection.")
+	flag.IntVar(&SlowConsecutive, "slow-consecutive", SlowConsecutive, "Number of slow responses in a row that get a target server ejected.")
+	flag.DurationVar(&SlowEjectionTime, "slow-ejection-time", SlowEjectionTime, "How long a slow target server is ejected for, before it gets requests again.")
+	flag.DurationVar(&FailurePenalty, "failure-penalty", FailurePenalty, "How long a target server is passed over after a request to it fails, even if it is still healthy. 0 disables the penalty.")
+	flag.DurationVar(&RetryAfterMax, "max-retry-after", RetryAfterMax, "Longest a target server is left alone after a 503 with a Retry-After header.")
+	flag.StringVar(&WarmupPath, "warmup-path", "", "Path to send warmup requests to when a target server becomes healthy, before it gets any client requests. Warmup is off if empty.")
+	flag.StringVar(&WarmupMethod, "warmup-method", WarmupMethod, "HTTP method of the warmup requests.")
+	flag.IntVar(&WarmupRequests, "warmup-requests", WarmupRequests, "Number of warmup requests sent to a target server before it becomes selectable.")
+	flag.BoolVar(&ResolveAddresses, "resolve", false, "Resolve the host names of the -b target servers, and load balance over all the IP addresses they resolve to, e.g. the pods behind a Kubernetes service.")
+	flag.DurationVar(&DNSRefreshInterval, "dns-refresh", DNSRefreshInterval, "How often the host names of the resolved target servers are resolved again, to add and remove servers as their addresses change.")
+	flag.StringVar(&AdminAddress, "admin-addr", AdminAddress, "Address of the admin server, which serves the admin API apart from the proxied traffic. The admin API is off if empty.")
+	flag.StringVar(&AdminUser, "admin-user", "", "User name for HTTP basic auth on the admin API. Requires -admin-pass.")
+	flag.StringVar(&AdminPassword, "admin-pass", "", "Password for HTTP basic auth on the admin API. Requires -admin-user.")
+	flag.StringVar(&ConsulService, "consul-service", "", "Name of a service registered in Consul, whose healthy instances become the target servers instead of the -b ones.")
+	flag.StringVar(&ConsulAddress, "consul-addr", ConsulAddress, "Address of the Consul agent, for -consul-service.")
+	flag.StringVar(&ConsulTag, "consul-tag", "", "Only use the instances of -consul-service that have this tag.")
+	flag.StringVar(&ConsulToken, "consul-token", "", "ACL token for the Consul API.")
+	flag.StringVar(&ConsulScheme, "consul-scheme", ConsulScheme, "Scheme of the target servers found in Consul: 'http' or 'https'.")
+	flag.DurationVar(&ConsulRefreshInterval, "consul-refresh", ConsulRefreshInterval, "How often Consul is asked for the instances of -consul-service.")
+	flag.StringVar(&RequestIDHeader, "request-id-header", RequestIDHeader, "Header carrying the ID of every request, which is generated if the client didn't send one, forwarded to the target servers, echoed back to the client and logged. Request IDs are off if empty.")
+	flag.BoolVar(&GzipResponses, "gzip", false, "Gzip the responses to the clients that accept it, for text, JSON and other compressible content types, unless the target server already encoded them.")
+	flag.Int64Var(&GzipMinSize, "gzip-min-size", GzipMinSize, "Smallest response body in bytes that is gzipped with -gzip.")
+	flag.BoolVar(&ProxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol header (v1 or v2) on every incoming connection, and use the client address it carries, e.g. behind a network load balancer. Only in the http mode.")
+	flag.Var(&CanaryAddresses, "canary", "A canary target server address, which gets -canary-percent of the requests to the default servers. Can be repeated.")
+	flag.Float64Var(&CanaryPercent, "canary-percent", 0, "Percentage of the requests to the default servers that go to the -canary servers instead. It can be changed at runtime with POST /canary?percent=.")
+	flag.StringVar(&ShadowAddress, "shadow", "", "Address of a shadow target server, to which a copy of the requests is sent in the background once the client is served. Its responses are logged and dropped.")
+	flag.Float64Var(&ShadowRate, "shadow-rate", ShadowRate, "Fraction of the requests mirrored to the -shadow target server, between 0 and 1.")
+	flag.BoolVar(&DebugHeaders, "debug-headers", false, "Tag every response with the target server that served it in X-LB-Backend, and the number of retries in X-LB-Retries. Not meant for production, as it exposes the target server addresses.")
+	flag.BoolVar(&RewriteLocation, "rewrite-location", false, "Rewrite the Location header of the responses that redirect to the target server itself, so that the clients are sent to the load balancer instead. Redirects to other hosts are left as they are.")
+	flag.BoolVar(&AddViaHeader, "via", false, "Add the load balancer to the Via header of the requests sent to the target servers.")
+	flag.StringVar(&DefaultUserAgent, "default-ua", "", "User-Agent sent to the target servers for requests that have none. They are sent with an empty User-Agent when unset.")
+	flag.Float64Var(&RateLimit, "rate-limit", 0, "Requests per second allowed from a single client IP. Clients over the limit get a 429. 0 means no limit.")
+	flag.IntVar(&RateBurst, "rate-burst", 0, "Requests a single client IP can make at once before being held to -rate-limit. Defaults to the rate.")
+	flag.DurationVar(&StatsWindow, "stats-window", StatsWindow, "Length of the rolling window for the request statistics in the admin API e.g. 1m or 5m.")
 	flag.Parse()
-	clog.Infof("Flags succesfully parsed: port=%d, addresses=%s", listenerPort, serverAddrs)
+	if showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	clog.Infof("Starting %s", versionString())
+	clog.Infof("Flags succesfully parsed: ports=%v, addresses=%s", listenerPorts, serverAddrs)
+	if err = ValidateHealthCheckMode(HealthCheckMode); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = ValidateProxyMode(ProxyMode); err != nil {
+		clog.FatalErr(err)
+	}
+	if HealthyThreshold < 1 || UnhealthyThreshold < 1 {
+		clog.FatalErr(ErrInvalidHealthThreshold)
+	}
+	if err = initSelectionAlgorithm(); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = ValidateLogFormat(LogFormat); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = ValidateOverflowMode(OverflowMode); err != nil {
+		clog.FatalErr(err)
+	}
+	if (TLSCertFile == "") != (TLSKeyFile == "") {
+		clog.Fatal("Both -tls-cert and -tls-key need to be set to serve HTTPS")
+	}
+	if (AdminUser == "") != (AdminPassword == "") {
+		clog.Fatal("Both -admin-user and -admin-pass need to be set to protect the admin API")
+	}
+	initInflightLimiter()
+	initRateLimiter()
+	initFairQueue()
+	initBackendTransport()
+	if err = initMaintenanceMode(); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = initErrorPage(); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = initShadow(); err != nil {
+		clog.FatalErr(err)
+	}
+	if err = initTracing(); err != nil {
+		clog.FatalErr(err)
+	}
+
+	// Merge in the config file, if there is one
+	var backends = backendConfigsFromAddresses(serverAddrs)
+	var routes []RouteConfig
+	var hosts map[string]VirtualHostConfig
+	var responseHeaders *HeaderRules
+	var canaryConfig *CanaryConfig
+	if len(CanaryAddresses) > 0 {
+		canaryConfig = &CanaryConfig{Backends: backendConfigsFromAddresses(CanaryAddresses), Percent: CanaryPercent}
+	}
+	if configPath != "" {
+		cfg, err := LoadConfig(configPath)
+		if err != nil {
+			clog.FatalErr(err)
+		}
+		if cfg.Port != 0 && !isFlagSet("p") {
+			listenerPorts = ListenerPorts{cfg.Port}
+		}
+		if cfg.HealthInterval != 0 {
+			HealthCheckInterval = time.Duration(cfg.HealthInterval)
+		}
+		backends = withHealthHeaders(append(cfg.Backends, backends...), cfg.HealthHeaders)
+		routes = cfg.Routes
+		hosts = cfg.Hosts
+		responseHeaders = cfg.ResponseHeaders
+		if canaryConfig == nil && cfg.Canary != nil {
+			canaryConfig = &CanaryConfig{Backends: withHealthHeaders(cfg.Canary.Backends, cfg.HealthHeaders), Percent: cfg.Canary.Percent}
+		}
+		clog.Infof("Config file loaded: %s", configPath)
+	}
+
+	// The servers of the default pool come from Consul instead, if it is set up
+	var discoverer Discoverer
+	if ConsulService != "" {
+		if len(backends) > 0 {
+			clog.Warningf("The servers of the %s service in Consul are used instead of the %d servers passed with -b and in the config file", ConsulService, len(backends))
+			backends = nil
+		}
+		discoverer = NewConsulDiscoverer()
+	}
 
-	// Step 2: Initialize the pool of target servers
+	// Step 2: Initialize the load balancer, with its pools of target servers
 	clog.Info("Creating a new load balancer server pool...")
-	pool, err = NewServerPool(serverAddrs)
+	lb, err := NewLoadBalancer(LoadBalancerOptions{
+		Backends:        backends,
+		Discoverer:      discoverer,
+		ResponseHeaders: responseHeaders,
+		Routes:          routes,
+		Hosts:           hosts,
+		Canary:          canaryConfig,
+	})
 	if err != nil {
 		clog.FatalErr(err)
 	}
 	clog.Infof("Load balancer server pool created.")
 
-	// Step 3: Run the listener server
-	err = startListener(listenerPort)
+	// Apply changes to the servers in the config file whenever we get a SIGHUP. Only the default pool
+	// is reloaded, so there is nothing to reload if everything goes through the router.
+	if configPath != "" && discoverer == nil && lb.hasDefaultPool() {
+		go watchConfigReloads(configPath, backendConfigsFromAddresses(serverAddrs), lb.Pool)
+	}
+
+	// Don't start serving until there is a server that can take requests, if asked to
+	if StartupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), StartupTimeout)
+		err = lb.WaitForHealthy(ctx, HealthCheckInterval)
+		cancel()
+		if err != nil {
+			clog.FatalErr(err)
+		}
+	}
+
+	// Step 3: Run the listener servers, until we're asked to shut down
+	if len(listenerPorts) == 0 {
+		listenerPorts = ListenerPorts{listenerPortDeault}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var admin *http.Server
+	if AdminAddress != "" {
+		admin = newAdminServer(AdminAddress, lb.AdminHandler())
+	}
+	if ProxyMode == ProxyModeTCP {
+		if lb.Router != nil {
+			clog.Warning("Routes and virtual hosts only apply in the http mode, all the connections go to the default servers")
+		}
+		err = startTCPListeners(ctx, listenerPorts, lb.Pool, admin)
+	} else {
+		err = startListeners(ctx, listenerPorts, lb.Handler(), admin)
+	}
 	if err != nil {
 		clog.FatalErr(err)
 	}
+	lb.Stop()
+	clog.Infof("Load balancer shut down.")
+}
+
+// isFlagSet returns true if the flag with the name was explicitly passed on the command line.
+func isFlagSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-// startListener starts a webserver that listens on the localhost at the provided port. The
-// function call is blocking as it only returns if there is an error while starting the server.
-func startListener(port int) error {
+// newListenerServer creates the listener server for port, serving handler. HTTP/2 is served over TLS,
+// and also over cleartext if EnableH2C is set. The handlers don't rely on hijacking the connection for anything but
+// connection upgrades, which HTTP/2 doesn't have, so they work the same over both protocols.
+func newListenerServer(port int, handler http.Handler) *http.Server {
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(EnableH2C)
 
-	// Create a http.Server instance & start it
-	server := &http.Server{
-		Addr:        fmt.Sprintf(":%d", port),
-		ReadTimeout: listenerReadTimeout,
-		Handler:     http.HandlerFunc(listenerHandler),
+	return &http.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		ReadTimeout:    ListenerReadTimeout,
+		WriteTimeout:   ListenerWriteTimeout,
+		IdleTimeout:    ListenerIdleTimeout,
+		MaxHeaderBytes: ListenerMaxHeaderBytes,
+		Handler:        handler,
+		Protocols:      &protocols,
 	}
-	clog.Infof("Staring the server: %d", port)
-	return server.ListenAndServe()
 }
 
-// listenerHandler handles all the http requests to listenere server. It implements the logic for
-// load-balancing, where it finds a healthy target server from the pool, forwards the request to it, and
-// copies over its response to the response for the client request.
-func listenerHandler(w http.ResponseWriter, req *http.Request) {
+// forwardRequest picks a healthy target server from the pool and proxies the request to it. If the
+// target server turns out to be unhealthy, it retries the request with a different server, up to
+// MaxRetries times. The chosen server and the number of retries are recorded in entry.
+func (lb *LoadBalancer) forwardRequest(w http.ResponseWriter, req *http.Request, pool *ServerPool, entry *accessLogEntry) {
+	for {
+		// Don't bother with another attempt if the deadline has passed or the client has gone away
+		if err := req.Context().Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				writeGatewayError(w, req, ErrRequestDeadlineExceeded.Error(), http.StatusGatewayTimeout)
+			} else {
+				w.WriteHeader(StatusClientClosedRequest)
+			}
+			return
+		}
 
-	// Get a healthy target server from pool so we can forward the request to it
-	target, err := pool.GetTargetServer(RoundRobin)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
-	}
+		// Get a healthy target server from pool so we can forward the request to it
+		_, selectSpan := tracer.Start(req.Context(), "loadbalancer.select")
+		target, err := pool.GetTargetServer(selectionFor(req))
+		endSpanWithError(selectSpan, err)
+		if err != nil {
+			writeGatewayError(w, req, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		entry.Backend = target.Address
 
-	clog.Debug("Forwarding request to the target server...")
+		// Count the request towards the load of the target server until we're done with it. If other
+		// requests took its last slots since it was picked, nothing has been sent to it, so we pick
+		// another server without counting it as a retry, whatever the method of the request.
+		if !pool.acquireLoad(target) {
+			continue
+		}
 
-	proxyRequestToTarget(w, req, target)
+		clog.Debug("Forwarding request to the target server...")
 
+		attemptCtx, attemptSpan := tracer.Start(req.Context(), "loadbalancer.attempt",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("loadbalancer.backend", target.Address),
+				attribute.Int("loadbalancer.attempt", entry.Retries+1),
+			),
+		)
+		canRetry := isRetryable(req) && entry.Retries < MaxRetries
+		retry := lb.proxyRequestToTarget(w, req.WithContext(attemptCtx), pool, target, entry.Retries, canRetry)
+		pool.AddLoad(target, -1)
+		attemptSpan.SetAttributes(attribute.Bool("loadbalancer.retried", retry))
+		attemptSpan.End()
+		if !retry {
+			return
+		}
+		entry.Retries++
+	}
 }
 
 // proxyRequestToTarget reverse proxy a request to the target server, handling the case where
-// the target server becomes unhealthy by the time the request is made.
-func proxyRequestToTarget(w http.ResponseWriter, req *http.Request, target *TargetServer) {
+// the target server becomes unhealthy by the time the request is made. It returns true if nothing
+// has been written to w and the request should be retried with a different server. If canRetry is
+// false, the response of the target server is sent to the client even if it is unhealthy. retries is
+// the number of times the request has been retried so far. The request should already be counted
+// towards the load of the target server.
+func (lb *LoadBalancer) proxyRequestToTarget(w http.ResponseWriter, req *http.Request, pool *ServerPool, target *TargetServer, retries int, canRetry bool) bool {
 
-	// Make changes to the http.Request instance so we can point it to the target server
-	redirectRequestToServer(req, target)
+	// Make a copy of the http.Request instance and point it to the target server. We keep the original
+	// as is, so that it can be redirected again if we need to retry with a different server.
+	outReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		outReq.Body, _ = req.GetBody()
+	}
+	redirectRequestToServer(outReq, target)
 
 	// Make a request to target server
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	start := time.Now()
+	resp, err := pool.transportFor(target).RoundTrip(outReq)
+	if err != nil && isClientGone(req, err) {
+		// The client has gone away, which says nothing about the health of the target server, so it is
+		// neither recorded against it nor retried
+		clog.Debugf("Request to the target server %s was canceled by the client: %s", target.Address, err)
+		w.WriteHeader(StatusClientClosedRequest)
+		return false
+	}
+	elapsed := time.Since(start)
+	// Running out of the request deadline, or a request body over the limit, are on the client or the
+	// load balancer rather than the target server, so they are not recorded against it either
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeGatewayError(w, req, ErrRequestDeadlineExceeded.Error(), http.StatusGatewayTimeout)
+		return false
+	}
+	if isBodyTooLarge(err) {
+		// The body was too large to be buffered, so we only find out while streaming it. It's not the
+		// target server's fault, and there's no point retrying.
+		http.Error(w, ErrRequestBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return false
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
-		return
+		target.RecordResponse(http.StatusBadGateway, elapsed)
+		target.Penalize(time.Now())
+		pool.ObserveFailure(target, elapsed)
+	} else if RetryOn.Contains(resp.StatusCode) && !isGRPCRequest(req) {
+		target.RecordResponse(resp.StatusCode, elapsed)
+		pool.ObserveFailure(target, elapsed)
+	} else {
+		target.RecordResponse(resp.StatusCode, elapsed)
+		pool.ObserveResponseTime(target, elapsed)
+	}
+	if isConnectionError(err) {
+		// The server was picked as healthy but can't be reached, most likely because it went down since
+		// its last health check. Like a 500, we degrade it and try another one.
+		clog.Warningf("Could not connect to the target server %s: %s", target.Address, err)
+		target.Degrade()
+		if canRetry {
+			return true
+		}
+	}
+	if err != nil {
+		clog.Warningf("Request to the target server %s failed: %s", target.Address, err)
+		if isTimeout(err) {
+			writeGatewayError(w, req, ErrGatewayTimeout.Error(), http.StatusGatewayTimeout)
+			return false
+		}
+		writeGatewayError(w, req, ErrBadGateway.Error(), http.StatusBadGateway)
+		return false
 	}
 	defer resp.Body.Close()
 
-	// Special case: if resp.StatusCode is 500, that means the server is in degrade status.
-	// In this case, as suggested by the question prompt, we should redirect the request to
-	// use a different server.
-	if resp.StatusCode == http.StatusInternalServerError {
-		// This means the server is down! Degrade and try again
-		clog.Warning("The target server returned a 500, which means it is unhealthy...")
+	// A 503 with a Retry-After header means the server is overloaded rather than down, so we leave it
+	// alone for as long as it asked and try another one
+	backedOff := false
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			target.BackOffUntil(time.Now().Add(d))
+			backedOff = true
+			if canRetry {
+				return true
+			}
+		}
+	}
+
+	// A status in RetryOn means the server is failing, so we degrade it and redirect the request to a
+	// different server. This doesn't apply to gRPC, which has its own status in the trailers.
+	if !backedOff && RetryOn.Contains(resp.StatusCode) && !isGRPCRequest(req) {
+		clog.Warningf("The target server %s returned a %d, which means it is unhealthy...", target.Address, resp.StatusCode)
 		target.Degrade()
-		listenerHandler(w, req)
-		return
+		target.Penalize(time.Now())
+		if canRetry {
+			return true
+		}
 	}
 
 	// In a normal case, copy the response into the response for the original request
+	removeHopByHopHeaders(resp.Header)
+	removeEchoedRequestID(resp.Header)
 	copyHeader(w.Header(), resp.Header)
+	if RewriteLocation {
+		rewriteLocation(w.Header(), resp.StatusCode, req, target)
+	}
+	pool.ResponseHeaders.Apply(w.Header())
+	if DebugHeaders {
+		setDebugHeaders(w.Header(), target, retries)
+	}
+	gzipped := shouldGzip(req, resp)
+	if gzipped {
+		setGzipHeaders(w.Header())
+	}
+	announceTrailers(w, resp)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if gzipped {
+		copyGzipResponseBody(w, resp)
+	} else {
+		copyResponseBody(w, resp)
+	}
+	copyTrailers(w, resp)
+	return false
+}
+
+// isTimeout returns true if err is caused by a network operation timing out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isClientGone returns true if the request req failed with err because the client went away, e.g. it
+// disconnected or canceled the request, rather than because of the target server.
+func isClientGone(req *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(req.Context().Err(), context.Canceled)
+}
+
+// isConnectionError returns true if err is caused by a failure to connect to the target server, e.g. a
+// refused or reset connection.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
 }
 
 // copyHeader copies all the http headers from src to dest
@@ -155,6 +590,15 @@ func copyHeader(dst, src http.Header) {
 	}
 }
 
+// clientIP returns the IP address of the client that made the request req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
 // redirectRequestToServer modifies a request so it can be redirected to the target server.
 // The logic here has been inspired from Go's official net/http/httputil package.
 func redirectRequestToServer(req *http.Request, server *TargetServer) {
@@ -163,16 +607,65 @@ func redirectRequestToServer(req *http.Request, server *TargetServer) {
 	targetQuery := target.RawQuery
 	req.URL.Scheme = target.Scheme
 	req.URL.Host = target.Host
-	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+	req.URL.Path = singleJoiningSlash(target.Path, server.rewritePath(req.URL.Path))
 	if targetQuery == "" || req.URL.RawQuery == "" {
 		req.URL.RawQuery = targetQuery + req.URL.RawQuery
 	} else {
 		req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 	}
 	if _, ok := req.Header["User-Agent"]; !ok {
-		// explicitly disable User-Agent so it's not set to default value
-		req.Header.Set("User-Agent", "")
+		// explicitly set the User-Agent so it's not set to the Go default value
+		req.Header.Set("User-Agent", DefaultUserAgent)
+	}
+	if AddViaHeader {
+		addViaHeader(req)
+	}
+
+	// The hop-by-hop headers are meant for us, not the target server. A client that can take trailers
+	// can still do so through us though, which gRPC relies on.
+	acceptsTrailers := hasHeaderToken(req.Header, "Te", "trailers")
+	removeHopByHopHeaders(req.Header)
+	if acceptsTrailers {
+		req.Header.Set("Te", "trailers")
+	}
+
+	setForwardedHeaders(req)
+	injectTraceContext(req)
+}
+
+// setForwardedHeaders adds the standard forwarding headers to req, so that the target server can
+// find out about the original client and the request it made to the load balancer.
+func setForwardedHeaders(req *http.Request) {
+	// Append the client IP to the list of proxies the request has already been through, if any
+	ip := clientIP(req)
+	if prior, ok := req.Header["X-Forwarded-For"]; ok {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+
+	req.Header.Set("X-Forwarded-Host", req.Host)
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// rewritePath removes the StripPrefix of the server from path, if path is under it, and then adds its
+// AddPrefix. Prefixes are matched one path segment at a time, so /api doesn't strip anything from /apis.
+func (s *TargetServer) rewritePath(path string) string {
+	settings := s.Settings()
+	if settings.StripPrefix != "" && hasPathPrefix(path, settings.StripPrefix) {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(settings.StripPrefix, "/"))
+		if path == "" {
+			path = "/"
+		}
+	}
+	if settings.AddPrefix != "" {
+		path = singleJoiningSlash(strings.TrimSuffix(settings.AddPrefix, "/"), path)
 	}
+	return path
 }
 
 // singleJoiningSlash is a util function for redirectRequestToServer function. It is copied from
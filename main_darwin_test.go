@@ -1,6 +0,0 @@
-// +build darwin,!linux
-
-// main package code in this file will only be included in darwin systems
-package main
-
-const targetBinaryName string = "./bin/challenge-darwin"
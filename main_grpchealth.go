@@ -0,0 +1,57 @@
+//go:build grpchealth
+
+// main package code in this file will only be included when grpchealth build tag is passed.
+// It implements the grpc health check mode.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPCHealthService is the name of the service whose health is asked for in the grpc health check mode.
+// The empty name asks for the health of the server as a whole.
+var GRPCHealthService string
+
+func init() {
+	grpcHealthStatus = checkGRPCHealth
+	flag.StringVar(&GRPCHealthService, "grpc-health-service", "", "Name of the service whose health is asked for in the grpc health check mode. Empty for the server as a whole.")
+}
+
+// checkGRPCHealth calls the Check method of the gRPC health service of the target server s, and maps a
+// SERVING status to healthy, and anything else to degraded.
+func checkGRPCHealth(s *TargetServer, timeout time.Duration) (HealthStatus, error) {
+	target := net.JoinHostPort(s.URL.Hostname(), urlPort(s.URL))
+	creds := insecure.NewCredentials()
+	if s.SocketPath != "" {
+		target = "unix://" + s.SocketPath
+	} else if s.URL.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{ServerName: s.serverName()})
+	}
+
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return StatusDegraded, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: GRPCHealthService})
+	if err != nil {
+		return StatusDegraded, err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return StatusDegraded, fmt.Errorf("gRPC health status of the server is %s", resp.GetStatus())
+	}
+	return StatusHealthy, nil
+}
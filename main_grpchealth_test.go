@@ -0,0 +1,54 @@
+//go:build grpchealth
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// TestGRPCHealthMode tests that in the grpc health check mode a server is healthy while its gRPC health
+// service reports SERVING, and degraded otherwise.
+func TestGRPCHealthMode(t *testing.T) {
+	HealthCheckMode = HealthModeGRPC
+	defer func() { HealthCheckMode = HealthModeJSON }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer := health.NewServer()
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go grpcServer.Serve(l)
+	defer grpcServer.Stop()
+
+	server, err := NewTargetServer("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		status  healthpb.HealthCheckResponse_ServingStatus
+		healthy bool
+	}{
+		{healthpb.HealthCheckResponse_SERVING, true},
+		{healthpb.HealthCheckResponse_NOT_SERVING, false},
+		{healthpb.HealthCheckResponse_SERVING, true},
+	}
+	for _, c := range cases {
+		healthServer.SetServingStatus("", c.status)
+		status, err := server.GetNewHealthStatus()
+		if (status == StatusHealthy) != c.healthy {
+			t.Errorf("Expected healthy to be %t when the server reports %s but got %s (%v)", c.healthy, c.status, status, err)
+		}
+	}
+
+	grpcServer.Stop()
+	if status, _ := server.GetNewHealthStatus(); status != StatusDegraded {
+		t.Errorf("Expected a server that is down to be degraded but got %s", status)
+	}
+}
@@ -1,6 +0,0 @@
-// +build linux,!darwin
-
-// main package code in this file will only be included in linux systems
-package main
-
-const targetBinaryName string = "./bin/challenge-linux"
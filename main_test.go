@@ -1,131 +1,549 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/teejays/clog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
-var targetPorts = []int{9000, 9001, 9002, 9003, 9004, 9005}
+// testBackendCount is the number of fake backends behind the global pool used by the tests.
+const testBackendCount = 6
+
+var testBackends []*fakeBackend
 var serverAddrs ServerAddresses
 
+// sharedPool is the pool in front of testBackends, for the tests that only need a working pool.
+var sharedPool *ServerPool
+
 func init() {
 	// Make the interval smaller for testing
 	HealthCheckInterval = time.Second * 2
 
-	// Initialize the ServerAddress instance, just like if someone has passed all these args
-	for _, p := range targetPorts {
-		serverAddrs = append(serverAddrs, fmt.Sprintf("http://localhost:%d", p))
-	}
-
 	// Supress logging level
 	clog.LogLevel = 4
 
-	// Start the servers
-	err := startTargetServers()
-	if err != nil {
-		log.Fatalf("failed to start target servers: %s", err)
-	}
+	// Start the servers, and initialize the ServerAddresses just like if someone has passed them as args
+	testBackends, serverAddrs = startFakeBackends(testBackendCount)
 
-	// Initialize ServerAddresses & ServerPool
-	pool, err = NewServerPool(serverAddrs)
+	// Initialize ServerPool
+	var err error
+	sharedPool, err = NewServerPool(serverAddrs)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// // TestNewServerPool tests that we can successfully create a new ServerPool instance.
-// func TestNewServerPool(t *testing.T) {
-// 	err := startTargetServers()
-// 	if err != nil {
-// 		t.Fatalf("failed to start target servers: %s", err)
-// 	}
-// 	defer stopTargetServers()
-
-// 	// Initialize ServerAddresses & ServerPool
-// 	pool, err = NewServerPool(serverAddrs)
-// 	if err != nil {
-// 		t.Error(err)
-// 	}
-
-// 	pool.CancelHealthCheck()
-// 	pool = nil
-// }
-
-// TestNewServerPool tests that successfully get a 503 when there are no healthy servers
+// TestNoHealthyServer tests that successfully get a 503 when there are no healthy servers
 func TestNoHealthyServer(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 3)
+	lb := &LoadBalancer{Pool: testPool}
 
-	// Initialize the pool
-	// pool, err = NewServerPool(serverAddrs)
-	// if err != nil {
-	// 	t.Error(err)
-	// }
-	// defer func() {
-	// 	pool.CancelHealthCheck()
-	// 	pool = nil
-	// }()
-
-	// Degrade all the servers and keep in that state
-	pool.PauseHealthChecks()
-	pool.DegradeAll()
+	// Degrade all the servers
+	for _, b := range backends {
+		b.SetHealthy(false)
+	}
+	testPool.RunHealthCheck()
 
 	// Create a request to pass to our handler.
-	r := httptest.NewRequest("GET", fmt.Sprintf("localhost:%d", listenerPortDeault), nil)
+	r := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:%d", listenerPortDeault), nil)
 	w := httptest.NewRecorder()
 
-	listenerHandler(w, r)
+	lb.ServeHTTP(w, r)
 
 	// We should expect a 503
 	if w.Code != http.StatusServiceUnavailable {
 		t.Errorf("Expected a 503 status code but got %d", w.Code)
 	}
-
-	pool.Normalize()
-
+	for i, b := range backends {
+		if b.hits.Load() != 0 {
+			t.Errorf("Expected degraded backend %d to get no requests but it got %d", i, b.hits.Load())
+		}
+	}
 }
 
-// TestNewServerPool makes concurrent requests to the load balancer and fails if it receives anything
-// other than a 503 or 200
+// TestConcurrent makes concurrent requests to the load balancer while the health of a backend flips,
+// and fails if any of them doesn't get a 200 from a healthy backend.
 func TestConcurrent(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 4)
+	lb := &LoadBalancer{Pool: testPool}
 
-	// Create some load to pass to our handler
-	var concurrency = make(chan int, 1)
 	var wg sync.WaitGroup
+	var sendRequests = func(from int) {
+		for i := from; i < from+50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:%d", listenerPortDeault), nil)
+				w := httptest.NewRecorder()
+				lb.ServeHTTP(w, r)
 
-	for i := 0; i < 100; i++ {
-		wg.Add(1)
-		concurrency <- 4
-
-		go func(i int) {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Fatalf("Panic (recovered) during TestConcurrent(): %s", r)
+				if w.Code != http.StatusOK {
+					t.Errorf("[%d] Expected a 200 status code but got %d", i, w.Code)
 				}
-				<-concurrency
-				wg.Done()
-			}()
-			r := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:%d", listenerPortDeault), nil)
-			w := httptest.NewRecorder()
-			listenerHandler(w, r)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	sendRequests(0)
+
+	// Degrade a backend, it should not get any of the next requests
+	backends[0].SetHealthy(false)
+	testPool.RunHealthCheck()
+	hits := backends[0].hits.Load()
+	sendRequests(50)
+	if backends[0].hits.Load() != hits {
+		t.Errorf("Expected the degraded backend to get no requests but it got %d", backends[0].hits.Load()-hits)
+	}
+
+	// Bring it back, it should get its share again right away without slow start
+	defer func(w time.Duration) { SlowStartWindow = w }(SlowStartWindow)
+	SlowStartWindow = 0
+	backends[0].SetHealthy(true)
+	testPool.RunHealthCheck()
+	sendRequests(100)
+	if backends[0].hits.Load() == hits {
+		t.Error("Expected the backend to get requests once it is healthy again but it got none")
+	}
+}
+
+// TestPoolStop tests that Stop ends the health check process of a pool right away, without waiting for
+// the current interval to be over.
+func TestPoolStop(t *testing.T) {
+	backend := newFakeBackend(nil)
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	testPool.Stop()
+	if elapsed := time.Since(start); elapsed >= HealthCheckInterval/2 {
+		t.Errorf("Expected Stop to return right away but it took %s", elapsed)
+	}
+
+	// Stopping again, or a pool that has nothing running, should not block
+	testPool.Stop()
+	(&ServerPool{}).Stop()
+}
+
+// TestHealthCheckProcessInterval tests that the health check process checks the servers at the interval
+// it is given, rather than at HealthCheckInterval.
+func TestHealthCheckProcessInterval(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 1)
+	interval := HealthCheckInterval / 100
+	checks := backends[0].healthChecks.Load()
+
+	// The first check of the pool scheduled the next one after HealthCheckInterval
+	testPool.Servers[0].NextHealthCheck = time.Time{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		testPool.RunHealthCheckProcess(ctx, interval)
+		close(done)
+	}()
+	time.Sleep(20 * interval)
+	cancel()
+	<-done
+
+	// The process sleeps a little longer than the interval between the checks, so leave some room
+	if got := backends[0].healthChecks.Load() - checks; got < 5 {
+		t.Errorf("Expected the server to be checked about every %s but it was checked %d times in %s", interval, got, 20*interval)
+	}
+}
+
+// TestHealthCheckIntervalPerServer tests that a server with a health check interval of its own is
+// checked on that interval rather than the one of the pool.
+func TestHealthCheckIntervalPerServer(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 2)
+	interval := 20 * time.Millisecond
+	testPool.Servers[0].UpdateSettings(func(settings *ServerSettings) { settings.HealthCheckInterval = interval })
+	checks := []int64{backends[0].healthChecks.Load(), backends[1].healthChecks.Load()}
+
+	// The first check of the pool scheduled the next one after HealthCheckInterval
+	testPool.Servers[0].NextHealthCheck = time.Time{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		testPool.RunHealthCheckProcess(ctx, time.Hour)
+		close(done)
+	}()
+	time.Sleep(20 * interval)
+	cancel()
+	<-done
+
+	if got := backends[0].healthChecks.Load() - checks[0]; got < 5 {
+		t.Errorf("Expected the server to be checked about every %s but it was checked %d times in %s", interval, got, 20*interval)
+	}
+	if got := backends[1].healthChecks.Load() - checks[1]; got != 0 {
+		t.Errorf("Expected the other server to wait for the interval of the pool but it was checked %d times", got)
+	}
+}
 
-			// We should expect a 200 or 503
-			if w.Code != http.StatusServiceUnavailable && w.Code != http.StatusOK {
-				t.Errorf("[%d] Expected a 200 or 503 status code but got %d", i, w.Code)
+// TestHealthCheckBackoff tests that the wait before the next health check of a server doubles while it
+// stays degraded, up to HealthCheckMaxBackoff, and goes back to the health check interval once it is
+// healthy.
+func TestHealthCheckBackoff(t *testing.T) {
+	var cases = []struct {
+		name string
+		// interval is the health check interval of the server, or 0 for HealthCheckInterval.
+		interval time.Duration
+		healthy  []bool
+		waits    []time.Duration
+	}{
+		{
+			name:    "doubles up to the max",
+			healthy: []bool{true, false, false, false, false, false, false, false, false, false, true, true},
+			waits: []time.Duration{
+				HealthCheckInterval, 2 * HealthCheckInterval, 4 * HealthCheckInterval, 8 * HealthCheckInterval,
+				16 * HealthCheckInterval, 32 * HealthCheckInterval, 64 * HealthCheckInterval, 128 * HealthCheckInterval,
+				HealthCheckMaxBackoff, HealthCheckMaxBackoff, HealthCheckInterval, HealthCheckInterval,
+			},
+		},
+		{
+			name:     "interval of the server",
+			interval: time.Minute,
+			healthy:  []bool{true, false, false, false, false, true},
+			waits:    []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, HealthCheckMaxBackoff, HealthCheckMaxBackoff, time.Minute},
+		},
+		{
+			name:     "single failures",
+			interval: time.Second,
+			healthy:  []bool{true, false, true, false, false, true},
+			waits:    []time.Duration{time.Second, 2 * time.Second, time.Second, 2 * time.Second, 4 * time.Second, time.Second},
+		},
+	}
+	for _, c := range cases {
+		backends, testPool := newFakeBackendPool(t, 1)
+		server := testPool.Servers[0]
+		server.UpdateSettings(func(settings *ServerSettings) { settings.HealthCheckInterval = c.interval })
+
+		clock := server.NextHealthCheck
+		server.clock = func() time.Time { return clock }
+		for i, healthy := range c.healthy {
+			backends[0].SetHealthy(healthy)
+			checks := backends[0].healthChecks.Load()
+
+			// Nothing is checked until the next check is due
+			testPool.RunDueHealthChecks(clock.Add(-time.Nanosecond))
+			if got := backends[0].healthChecks.Load(); got != checks {
+				t.Errorf("%s: check %d: expected no health check before it is due but got %d", c.name, i, got-checks)
 			}
-		}(i)
 
-		time.Sleep(time.Millisecond * 200)
+			testPool.RunDueHealthChecks(clock)
+			if got := backends[0].healthChecks.Load(); got != checks+1 {
+				t.Errorf("%s: check %d: expected a health check once it is due but got %d", c.name, i, got-checks)
+			}
+			if wait := server.NextHealthCheck.Sub(clock); wait != c.waits[i] {
+				t.Errorf("%s: check %d: expected the next check after %s but got %s", c.name, i, c.waits[i], wait)
+			}
+			clock = server.NextHealthCheck
+		}
 	}
+}
 
-	wg.Wait()
+// TestWarmup tests that a server that becomes healthy is warming, and not selectable, until it has been
+// sent the warmup requests.
+func TestWarmup(t *testing.T) {
+	release := make(chan struct{})
+	var warmups atomic.Int64
+	backend := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/warmup" {
+			<-release
+			warmups.Add(1)
+		}
+	}))
+	defer backend.Close()
+	WarmupPath = "/warmup"
+	defer func() { WarmupPath = "" }()
+
+	server, err := NewTargetServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RefreshHealthStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if server.Status() != StatusWarming || server.IsSelectable() {
+		t.Fatalf("Expected the server to be warming and not selectable but it is %s", server.Status())
+	}
+
+	// Passing health checks doesn't cut the warmup short
+	server.RefreshHealthStatus()
+	if server.Status() != StatusWarming {
+		t.Errorf("Expected the server to keep warming until it has been warmed up but it is %s", server.Status())
+	}
+
+	close(release)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && !server.IsHealthy(); time.Sleep(10 * time.Millisecond) {
+	}
+	if !server.IsHealthy() || warmups.Load() != int64(WarmupRequests) {
+		t.Errorf("Expected the server to be healthy after %d warmup requests, but it is %s after %d", WarmupRequests, server.Status(), warmups.Load())
+	}
+}
+
+// TestHealthCheckProcessSkipsTicks tests that the health check process doesn't start a round of checks
+// while the previous one is still running, when the checks take longer than the interval.
+func TestHealthCheckProcessSkipsTicks(t *testing.T) {
+	interval := 10 * time.Millisecond
+	var checks, running, maxRunning atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		checks.Add(1)
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(3 * interval)
+		fmt.Fprint(w, `{"State":"healthy"}`)
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.Servers[0].NextHealthCheck = time.Time{}
+	checks.Store(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		testPool.RunHealthCheckProcess(ctx, interval)
+		close(done)
+	}()
+	time.Sleep(20 * interval)
+	cancel()
+	<-done
+
+	if maxRunning.Load() > 1 {
+		t.Errorf("Expected at most one health check at a time but there were %d", maxRunning.Load())
+	}
+	if got := checks.Load(); got < 3 || got > 7 {
+		t.Errorf("Expected a check about every %s but got %d checks in %s", 4*interval, got, 20*interval)
+	}
+}
+
+// TestHealthCheckConcurrency tests that the servers of a pool are checked in parallel, with no more than
+// HealthCheckConcurrency checks running at a time, so that a full round of checks takes about as many
+// health check delays as it takes batches of HealthCheckConcurrency servers.
+func TestHealthCheckConcurrency(t *testing.T) {
+	const n = 40
+	delay := 100 * time.Millisecond
+	var running, maxRunning atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			max := maxRunning.Load()
+			if n <= max || maxRunning.CompareAndSwap(max, n) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		fmt.Fprint(w, `{"State":"healthy"}`)
+	}))
+	defer backend.Close()
+
+	var addrs ServerAddresses
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, fmt.Sprintf("%s/%d", backend.URL, i))
+	}
+	testPool, err := NewServerPool(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	maxRunning.Store(0)
+
+	start := time.Now()
+	testPool.RunHealthCheck()
+	elapsed := time.Since(start)
+
+	if got := maxRunning.Load(); got > int64(HealthCheckConcurrency) || got < 2 {
+		t.Errorf("Expected up to %d health checks at a time but got %d", HealthCheckConcurrency, got)
+	}
+	batches := time.Duration((n + HealthCheckConcurrency - 1) / HealthCheckConcurrency)
+	if elapsed < batches*delay || elapsed > (batches+2)*delay {
+		t.Errorf("Expected the health checks of %d servers to take about %s but they took %s", n, batches*delay, elapsed)
+	}
+}
+
+// TestAdminAuth tests that the admin API asks for the credentials when basic auth is set up, while the
+// probes and the proxied requests go through without them.
+func TestAdminAuth(t *testing.T) {
+	AdminUser, AdminPassword = "admin", "s3cret"
+	defer func() {
+		AdminUser, AdminPassword = "", ""
+	}()
+	_, testPool := newFakeBackendPool(t, 1)
+	lb := &LoadBalancer{Pool: testPool}
+
+	var cases = []struct {
+		handler  http.Handler
+		path     string
+		user     string
+		password string
+		expected int
+	}{
+		{lb.AdminHandler(), "/servers", "", "", http.StatusUnauthorized},
+		{lb.AdminHandler(), "/servers", "admin", "wrong", http.StatusUnauthorized},
+		{lb.AdminHandler(), "/servers", "other", "s3cret", http.StatusUnauthorized},
+		{lb.AdminHandler(), "/servers", "admin", "s3cret", http.StatusOK},
+		{lb.AdminHandler(), LivenessEndpoint, "", "", http.StatusOK},
+		{lb.Handler(), "/", "", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://localhost"+c.path, nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+		w := httptest.NewRecorder()
+		c.handler.ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Errorf("Expected a %d for %s as %q but got %d", c.expected, c.path, c.user, w.Code)
+		}
+		if c.expected == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+			t.Errorf("Expected a 401 to ask for basic auth but got %q", w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// TestAdminRecheck tests that POST /recheck picks up a change in the health of the servers right away,
+// for a single server or for all of them, while the health check process is running.
+func TestAdminRecheck(t *testing.T) {
+	backends, addrs := startFakeBackends(2)
+	defer func() {
+		for _, b := range backends {
+			b.Close()
+		}
+	}()
+	testPool, err := NewServerPool(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testPool.Stop()
+	lb := &LoadBalancer{Pool: testPool}
+
+	handler := lb.AdminHandler()
+	type serverHealth struct {
+		Address string `json:"address"`
+		Health  string `json:"health"`
+	}
+	recheck := func(query string) []serverHealth {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/recheck"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 from /recheck%s but got %d: %s", query, w.Code, w.Body.String())
+		}
+		var infos []serverHealth
+		if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		return infos
+	}
+
+	backends[0].SetHealthy(false)
+	backends[1].SetHealthy(false)
+	infos := recheck("?addr=" + backends[0].URL)
+	if len(infos) != 1 || infos[0].Address != backends[0].URL || infos[0].Health != StatusDegraded.String() {
+		t.Errorf("Expected only the first server to be rechecked and degraded but got %+v", infos)
+	}
+	if !testPool.Servers[1].IsHealthy() {
+		t.Error("Expected the second server to keep its health until it is rechecked")
+	}
+
+	infos = recheck("")
+	if len(infos) != 2 || infos[1].Health != StatusDegraded.String() {
+		t.Errorf("Expected both servers to be rechecked and degraded but got %+v", infos)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/recheck?addr=http://unknown", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown server but got %d", w.Code)
+	}
+}
+
+// TestAdminPools tests that the admin API looks the servers up in the pool given by the pool query
+// parameter, so that the servers of the routes and the canary can be managed too.
+func TestAdminPools(t *testing.T) {
+	lb, err := NewLoadBalancer(LoadBalancerOptions{
+		Routes: []RouteConfig{{PathPrefix: "/api", Backends: []BackendConfig{{Address: "http://localhost:9901"}}}},
+		Canary: &CanaryConfig{Backends: []BackendConfig{{Address: "http://localhost:9902"}}, Percent: 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Stop()
+	routePool, canaryPool := lb.namedPools()["route /api"], lb.Canary.Pool
+
+	handler := lb.AdminHandler()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "http://localhost"+path, nil))
+		return w
+	}
+
+	if w := serve("POST", "/servers/drain?pool=route+/api&addr=http://localhost:9901"); w.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 from draining a server of the route but got %d: %s", w.Code, w.Body.String())
+	}
+	if !routePool.Servers[0].IsDraining() {
+		t.Error("Expected the server of the route to be draining")
+	}
 
+	if w := serve("POST", "/servers/weight?pool=canary&addr=http://localhost:9902&weight=5"); w.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 from reweighting a server of the canary but got %d: %s", w.Code, w.Body.String())
+	}
+	if weight := canaryPool.Servers[0].Settings().Weight; weight != 5 {
+		t.Errorf("Expected the server of the canary to have a weight of 5 but got %d", weight)
+	}
+
+	w := serve("GET", "/servers?pool=canary")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "http://localhost:9902") {
+		t.Errorf("Expected the servers of the canary to be listed but got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Everything goes through the router, so there is no default pool
+	for _, path := range []string{"/servers", "/servers/drain?addr=http://localhost:9901", "/recheck?pool=unknown"} {
+		method := "POST"
+		if path == "/servers" {
+			method = "GET"
+		}
+		if w := serve(method, path); w.Code != http.StatusNotFound {
+			t.Errorf("Expected a 404 from %s but got %d", path, w.Code)
+		}
+	}
 }
 
 // Todo: Write test for the case when the state of a healthy server changes after it has been picked up
@@ -133,14 +551,12 @@ func TestConcurrent(t *testing.T) {
 
 // TestRoundRobin tests that Round Robin behaves as expected, returning the next healthy server.
 func TestRoundRobin(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 6)
 
 	// Test 1: When all servers are healthy
-	pool.PauseHealthChecks()
-	pool.HealthyAll()
-	pool.CurrentIndex = 0
-
-	for i := 0; i < len(pool.Servers); i++ {
-		rrIdx, err := RoundRobin(pool)
+	testPool.CurrentIndex = 0
+	for i := 0; i < len(testPool.Servers); i++ {
+		rrIdx, err := RoundRobin(testPool, testPool.ServerList())
 		if err != nil {
 			t.Error(err)
 		}
@@ -151,12 +567,10 @@ func TestRoundRobin(t *testing.T) {
 
 	// Test 2: When server at index K is unhealthy
 	k := 2
-	if k >= len(pool.Servers) {
-		log.Fatalf("Invalid test: index is server to be marked unhealthy is out of bounds")
-	}
-	pool.Servers[k].Degrade()
-	for i := 0; i < len(pool.Servers); i++ {
-		rrIdx, err := RoundRobin(pool)
+	backends[k].SetHealthy(false)
+	testPool.RunHealthCheck()
+	for i := 0; i < len(testPool.Servers); i++ {
+		rrIdx, err := RoundRobin(testPool, testPool.ServerList())
 		if err != nil {
 			t.Error(err)
 		}
@@ -164,48 +578,4512 @@ func TestRoundRobin(t *testing.T) {
 			t.Errorf("Expected RoundRobin to to never chose unhealthy server at index %d but it did", k)
 		}
 	}
+}
+
+// TestRoundRobinConcurrent makes many concurrent GetTargetServer calls and tests that RoundRobin spreads
+// them evenly over the servers. It is meant to be run with -race as well.
+func TestRoundRobinConcurrent(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1, 1)
+
+	const goroutines, calls = 50, 100
+	var mu sync.Mutex
+	var counts = make(map[string]int)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < calls; i++ {
+				server, err := testPool.GetTargetServer(RoundRobin)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				counts[server.Address]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
 
-	pool.Normalize()
+	expected := goroutines * calls / len(testPool.Servers)
+	for _, s := range testPool.Servers {
+		if counts[s.Address] != expected {
+			t.Errorf("Expected server %s to be picked %d times but it was picked %d times", s.Address, expected, counts[s.Address])
+		}
+	}
+}
 
+// newTestPool creates a ServerPool with a healthy server for each of the weights, without starting
+// the health checks.
+func newTestPool(t *testing.T, weights ...int) *ServerPool {
+	var testPool ServerPool
+	for i, w := range weights {
+		server, err := NewTargetServer(fmt.Sprintf("http://localhost:%d", 9900+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.UpdateSettings(func(settings *ServerSettings) { settings.Weight = w })
+		testPool.Servers = append(testPool.Servers, server)
+	}
+	testPool.HealthyAll()
+	return &testPool
 }
 
-func BenchmarkServer(b *testing.B) {
-	for n := 0; n < b.N; n++ {
-		r := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:%d", listenerPortDeault), nil)
+// TestWeightedAlgorithms tests that the weighted algorithms pick servers in proportion to their weight,
+// and never pick a server with a weight of 0.
+func TestWeightedAlgorithms(t *testing.T) {
+	var algos = map[string]func(*ServerPool, []*TargetServer) (int, error){
+		"WeightedRandom":     WeightedRandom,
+		"WeightedRoundRobin": WeightedRoundRobin,
+	}
+
+	for name, algo := range algos {
+		testPool := newTestPool(t, 3, 0, 1)
+
+		var counts = make([]int, len(testPool.Servers))
+		for i := 0; i < 4000; i++ {
+			idx, err := algo(testPool, testPool.ServerList())
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			counts[idx]++
+		}
+
+		if counts[1] != 0 {
+			t.Errorf("%s: expected the zero weight server to never be picked, but it was picked %d times", name, counts[1])
+		}
+		if ratio := float64(counts[0]) / float64(counts[2]); ratio < 2.5 || ratio > 3.5 {
+			t.Errorf("%s: expected the weight 3 server to be picked about 3 times as often as the weight 1 server, but got %v", name, counts)
+		}
+	}
+}
+
+// TestBackupTier tests that every algorithm leaves the backup servers alone while a primary server is
+// selectable, and falls back to them once none is.
+func TestBackupTier(t *testing.T) {
+	backup := BackendConfig{Address: "http://localhost:9990", Tier: TierBackup}
+	backupServer, err := NewTargetServerFromConfig(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backupServer.Settings().Tier != TierBackup {
+		t.Fatalf("Expected the server to be a backup but got %q", backupServer.Settings().Tier)
+	}
+
+	for name, algo := range Algorithms {
+		testPool := newTestPool(t, 1, 1)
+		server, _ := NewTargetServerFromConfig(backup)
+		testPool.Servers = append([]*TargetServer{server}, testPool.Servers...)
+		testPool.HealthyAll()
+
+		pick := func() int {
+			idx, err := algo(testPool, testPool.ServerList(), httptest.NewRequest("GET", "http://localhost/", nil))
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			return idx
+		}
+		for i := 0; i < 20; i++ {
+			if idx := pick(); idx == 0 {
+				t.Fatalf("%s: expected the backup server not to be picked while a primary server is healthy", name)
+			}
+		}
+
+		testPool.Servers[1].Degrade()
+		testPool.Servers[2].Degrade()
+		if idx := pick(); idx != 0 {
+			t.Errorf("%s: expected the backup server to be picked once the primary servers are down but got %d", name, idx)
+		}
+
+		testPool.Servers[0].Degrade()
+		if _, err := algo(testPool, testPool.ServerList(), httptest.NewRequest("GET", "http://localhost/", nil)); err != ErrNoHealthyServer {
+			t.Errorf("%s: expected no healthy server once the backup is down too but got %v", name, err)
+		}
+	}
+}
+
+// TestBackendMaxConns tests that a server with as many requests in flight as its MaxConns is skipped
+// until one of them is done, and that the requests get a 503 once all the servers are at their cap.
+func TestBackendMaxConns(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 4)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	var backends []*fakeBackend
+	var configs []BackendConfig
+	for i := 0; i < 2; i++ {
+		b := newFakeBackend(handler)
+		defer b.Close()
+		backends = append(backends, b)
+		configs = append(configs, BackendConfig{Address: b.URL, MaxConns: 1})
+	}
+	testPool, err := NewServerPoolFromBackends(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}()
+		<-started
+	}
+	if backends[0].hits.Load() != 1 || backends[1].hits.Load() != 1 {
+		t.Errorf("Expected one request in flight to each server but got %d and %d", backends[0].hits.Load(), backends[1].hits.Load())
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 with both servers at their cap but got %d", w.Code)
+	}
+
+	// Connection upgrades are held to the cap too, even when the server got to its cap after it was
+	// picked for them
+	upgrade := func() *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		return req
+	}
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, upgrade())
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 for an upgrade with both servers at their cap but got %d", w.Code)
+	}
+	defer func(algo Algorithm) { selectionAlgorithm = algo }(selectionAlgorithm)
+	selectionAlgorithm = func(*ServerPool, []*TargetServer, *http.Request) (int, error) { return 0, nil }
+	upgraded := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, upgrade())
+		upgraded <- w.Code
+	}()
+	select {
+	case code := <-upgraded:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("Expected a 503 for an upgrade to a server at its cap but got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the upgrade not to reach the server at its cap but it got %d requests", backends[0].hits.Load())
+	}
+
+	close(release)
+	wg.Wait()
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a 200 once the servers are under their cap but got %d", w.Code)
+	}
+}
+
+// TestFailurePenalty tests that a server whose request failed is passed over for FailurePenalty, even
+// once it is healthy again, unless all the servers are penalized.
+func TestFailurePenalty(t *testing.T) {
+	failing := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	ok := newFakeBackend(nil)
+	defer ok.Close()
+	testPool, err := NewServerPool(ServerAddresses{failing.URL, ok.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	for i := 0; i < 2; i++ {
 		w := httptest.NewRecorder()
-		listenerHandler(w, r)
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the failed request to be retried on the other server but got %d", w.Code)
+		}
+	}
+	if failing.hits.Load() != 1 {
+		t.Fatalf("Expected the failing server to get one request but got %d", failing.hits.Load())
+	}
+	if !testPool.Servers[0].IsPenalized(time.Now()) {
+		t.Fatal("Expected the failing server to be penalized")
+	}
+
+	// The server passes its next health check, but stays out of rotation until its penalty is over
+	testPool.HealthyAll()
+	for i := 0; i < 4; i++ {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	}
+	if failing.hits.Load() != 1 {
+		t.Errorf("Expected the penalized server to get no requests but got %d", failing.hits.Load()-1)
+	}
+
+	var cases = []struct {
+		penalized []bool
+		expected  []bool
+	}{
+		{[]bool{true, false}, []bool{false, true}},
+		{[]bool{true, true}, []bool{true, true}},
+		{[]bool{false, false}, []bool{true, true}},
+	}
+	for _, c := range cases {
+		testPool := newTestPool(t, 1, 1)
+		for i, s := range testPool.Servers {
+			if c.penalized[i] {
+				s.Penalize(time.Now())
+			} else {
+				// A penalty that is already over
+				s.Penalize(time.Now().Add(-FailurePenalty))
+			}
+		}
+		selectable := selectableInTier(testPool.Servers)
+		for i, s := range testPool.Servers {
+			if got := selectable(s); got != c.expected[i] {
+				t.Errorf("Penalized %v: expected server %d to be selectable %t but got %t", c.penalized, i, c.expected[i], got)
+			}
+		}
+	}
+}
+
+// TestHealthScore tests that the health score follows the health checks, the error rate and the latency
+// of the servers, and that ScoreBased picks servers in proportion to their score.
+func TestHealthScore(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1)
+	if score := testPool.Servers[0].HealthScore(); score != 100 {
+		t.Errorf("Expected a healthy server without traffic to score 100 but got %d", score)
+	}
+
+	// Every response of the second server is an error, with a p95 latency of about 10ms
+	for i := 0; i < 10; i++ {
+		testPool.Servers[1].RecordResponse(http.StatusInternalServerError, 10*time.Millisecond)
+	}
+	if score := testPool.Servers[1].HealthScore(); score < 67 || score > 71 {
+		t.Errorf("Expected a server that only returns errors to score about 69 but got %d", score)
+	}
+
+	testPool.Servers[2].Degrade()
+	if score := testPool.Servers[2].HealthScore(); score != 50 {
+		t.Errorf("Expected a degraded server without traffic to score 50 but got %d", score)
+	}
+
+	var counts = make([]int, len(testPool.Servers))
+	for i := 0; i < 4000; i++ {
+		idx, err := ScoreBased(testPool, testPool.ServerList())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[idx]++
+	}
+	if counts[2] != 0 {
+		t.Errorf("Expected the degraded server to never be picked, but it was picked %d times", counts[2])
+	}
+	if ratio := float64(counts[0]) / float64(counts[1]); ratio < 1.25 || ratio > 1.7 {
+		t.Errorf("Expected the servers to be picked in proportion to their scores of 100 and 69, but got %v", counts)
+	}
+
+	// A failed health check that doesn't reach the threshold yet lowers the score of a healthy server
+	testPool.Servers[0].UpdateSettings(func(settings *ServerSettings) { settings.UnhealthyThreshold = 2 })
+	testPool.Servers[0].applyHealthCheck(StatusDegraded)
+	if score := testPool.Servers[0].HealthScore(); !testPool.Servers[0].IsHealthy() || score != 75 {
+		t.Errorf("Expected a healthy server halfway to its unhealthy threshold to score 75 but got %d", score)
+	}
+}
+
+// TestWeightedAlgorithmsAllZero tests that the weighted algorithms return ErrNoHealthyServer when all
+// the selectable servers have a weight of 0.
+func TestWeightedAlgorithmsAllZero(t *testing.T) {
+	var algos = map[string]func(*ServerPool, []*TargetServer) (int, error){
+		"WeightedRandom":     WeightedRandom,
+		"WeightedRoundRobin": WeightedRoundRobin,
+	}
+
+	for name, algo := range algos {
+		testPool := newTestPool(t, 0, 0, 5)
+		testPool.Servers[2].Degrade()
+
+		if _, err := algo(testPool, testPool.ServerList()); err != ErrNoHealthyServer {
+			t.Errorf("%s: expected %v but got %v", name, ErrNoHealthyServer, err)
+		}
 	}
 }
 
-// Functions to start/stop the target servers `go test`
+// TestLeastConnections tests that LeastConnections picks the server with the fewest requests in flight,
+// taking turns between the servers that are tied.
+func TestLeastConnections(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1)
+	testPool.Servers[0].Load = 2
+	testPool.Servers[1].Load = 1
+	testPool.Servers[2].Load = 1
 
-func startTargetServers() (err error) {
-	for _, p := range targetPorts {
-		err = startTargetServer(p)
+	var picked = make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		index, err := LeastConnections(testPool, testPool.ServerList())
 		if err != nil {
-			return err
+			t.Fatal(err)
 		}
-		time.Sleep(2 * time.Second)
+		if index == 0 {
+			t.Error("Expected LeastConnections to never pick the server with the most load")
+		}
+		picked[index] = true
+	}
+	if !picked[1] || !picked[2] {
+		t.Errorf("Expected LeastConnections to take turns between the tied servers, but picked %v", picked)
 	}
-	return nil
 }
 
-func stopTargetServers() {
-	cmd := exec.Command("pkill", "-f", targetBinaryName)
+// TestWeightedLeastConnections tests that the requests in flight are spread over the servers in
+// proportion to their weight, and never go to a server with a weight of 0.
+func TestWeightedLeastConnections(t *testing.T) {
+	testPool := newTestPool(t, 3, 1, 0)
 
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
+	// Keep all the requests in flight, like under sustained concurrent load
+	for i := 0; i < 40; i++ {
+		index, err := WeightedLeastConnections(testPool, testPool.ServerList())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.AddLoad(testPool.Servers[index], 1)
+	}
+	if loads := [3]int{testPool.Servers[0].Load, testPool.Servers[1].Load, testPool.Servers[2].Load}; loads != [3]int{30, 10, 0} {
+		t.Errorf("Expected the weight 3 server to carry 3 times the load of the weight 1 server, got %v", loads)
 	}
 }
 
-func startTargetServer(port int) error {
-	cmd := exec.Command(targetBinaryName, "server", "-p", fmt.Sprintf("%d", port))
+// TestLeastResponseTime tests that LeastResponseTime sends most of the requests to the faster of two
+// target servers.
+func TestLeastResponseTime(t *testing.T) {
+	var mu sync.Mutex
+	var counts = make(map[string]int)
+	newBackend := func(name string, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			counts[name]++
+			mu.Unlock()
+			time.Sleep(delay)
+		}))
+	}
+	fast := newBackend("fast", 0)
+	defer fast.Close()
+	slow := newBackend("slow", 20*time.Millisecond)
+	defer slow.Close()
 
-	err := cmd.Start()
+	testPool, err := NewServerPool(ServerAddresses{fast.URL, slow.URL})
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	defaultAlgorithm := selectionAlgorithm
+	lb := &LoadBalancer{Pool: testPool}
+	selectionAlgorithm = Algorithms["leasttime"]
+	defer func() { selectionAlgorithm = defaultAlgorithm }()
 
-	return nil
+	for i := 0; i < 40; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+	if counts["fast"] < 3*counts["slow"] {
+		t.Errorf("expected the fast server to get most of the requests, got %v", counts)
+	}
+}
+
+// TestLeastResponseTimeFailures tests that LeastResponseTime doesn't favour a server whose requests fail
+// fast, or a busy server that hasn't responded yet.
+func TestLeastResponseTimeFailures(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1)
+	testPool.ObserveResponseTime(testPool.Servers[0], 10*time.Millisecond)
+	// A refused connection fails right away
+	testPool.ObserveFailure(testPool.Servers[1], time.Millisecond)
+	// The third server has never responded, and has requests in flight
+	testPool.AddLoad(testPool.Servers[2], 2)
+
+	for i := 0; i < 3; i++ {
+		index, err := LeastResponseTime(testPool, testPool.ServerList())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index != 0 {
+			t.Errorf("Expected the server with the fastest responses to be picked but got %d", index)
+		}
+	}
+}
+
+// TestLogSelectionDecisions tests that with LogSelectionDecisions on, the algorithms log the server they
+// picked and why, along with the load and score of every candidate.
+func TestLogSelectionDecisions(t *testing.T) {
+	LogSelectionDecisions = true
+	defer func() { LogSelectionDecisions = false }()
+
+	testPool := newTestPool(t, 1, 1, 1)
+	for i, load := range []int{3, 1, 2} {
+		testPool.AddLoad(testPool.Servers[i], load-testPool.Servers[i].Load)
+	}
+	logs := captureLogs(t, func() {
+		if index, err := LeastConnections(testPool, testPool.ServerList()); index != 1 || err != nil {
+			t.Errorf("Expected LeastConnections to pick server 1 but got %d (%v)", index, err)
+		}
+	})
+	expected := []string{
+		"[LeastConnections] picked http://localhost:9901: it has the fewest requests in flight: 1. Candidates: ",
+		"http://localhost:9900 (healthy, load=3, weight=1)",
+		"http://localhost:9901 (healthy, load=1, weight=1)",
+		"http://localhost:9902 (healthy, load=2, weight=1)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(logs, e) {
+			t.Errorf("Expected the LeastConnections decision to be logged with %q but got %q", e, logs)
+		}
+	}
+
+	// The server that hasn't responded yet is scored with the average response time of the others
+	for i, load := range []int{0, 1, 0} {
+		testPool.AddLoad(testPool.Servers[i], load-testPool.Servers[i].Load)
+	}
+	testPool.Servers[0].responseTime = 100 * time.Millisecond
+	testPool.Servers[1].responseTime = 50 * time.Millisecond
+	logs = captureLogs(t, func() {
+		if index, err := LeastResponseTime(testPool, testPool.ServerList()); index != 2 || err != nil {
+			t.Errorf("Expected LeastResponseTime to pick server 2 but got %d (%v)", index, err)
+		}
+	})
+	expected = []string{
+		"[LeastResponseTime] picked http://localhost:9902: it has the lowest response time score. Candidates: ",
+		"http://localhost:9900 (healthy, load=0, weight=1, response_time=100ms, score=100000000)",
+		"http://localhost:9901 (healthy, load=1, weight=1, response_time=50ms, score=100000000)",
+		"http://localhost:9902 (healthy, load=0, weight=1, response_time=0s, score=75000000)",
+	}
+	for _, e := range expected {
+		if !strings.Contains(logs, e) {
+			t.Errorf("Expected the LeastResponseTime decision to be logged with %q but got %q", e, logs)
+		}
+	}
+
+	// The decision is logged with the servers the algorithm picked from, even if the pool has been
+	// reloaded since
+	added, err := NewTargetServer("http://localhost:9910")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added.SetStatus(StatusHealthy)
+	testPool.DegradeAll()
+	servers := append(testPool.ServerList(), added)
+	logs = captureLogs(t, func() {
+		if index, err := Random(testPool, servers); index != 3 || err != nil {
+			t.Errorf("Expected Random to pick server 3 but got %d (%v)", index, err)
+		}
+	})
+	if e := "[Random] picked http://localhost:9910: random pick out of 1 selectable servers"; !strings.Contains(logs, e) {
+		t.Errorf("Expected the Random decision to be logged with %q but got %q", e, logs)
+	}
+}
+
+// TestIPHash tests that IPHash keeps sending a client to the same server, and only moves the clients of
+// a server once it is no longer selectable.
+func TestIPHash(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1, 1)
+
+	var picks = make(map[string]int)
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+		index, err := IPHash(testPool, testPool.ServerList(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := IPHash(testPool, testPool.ServerList(), r); again != index {
+			t.Errorf("Expected IPHash to pick the same server for %s but got %d and %d", r.RemoteAddr, index, again)
+		}
+		picks[r.RemoteAddr] = index
+	}
+
+	testPool.Servers[0].SetDraining(true)
+	for addr, before := range picks {
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.RemoteAddr = addr
+		index, _ := IPHash(testPool, testPool.ServerList(), r)
+		if before != 0 && index != before {
+			t.Errorf("Expected %s to stay on server %d but it moved to %d", addr, before, index)
+		}
+		if index == 0 {
+			t.Errorf("Expected IPHash to never pick the draining server")
+		}
+	}
+}
+
+// TestInitSelectionAlgorithm tests that an unknown algorithm name is rejected.
+func TestInitSelectionAlgorithm(t *testing.T) {
+	defer func() {
+		SelectionAlgorithm = "roundrobin"
+		initSelectionAlgorithm()
+	}()
+
+	SelectionAlgorithm = "leastconn"
+	if err := initSelectionAlgorithm(); err != nil {
+		t.Errorf("Expected leastconn to be a valid algorithm but got: %s", err)
+	}
+	SelectionAlgorithm = "fastest"
+	if err := initSelectionAlgorithm(); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("Expected ErrUnknownAlgorithm for an unknown algorithm but got: %v", err)
+	}
+}
+
+// TestUnknownHealthNotSelectable tests that new servers start with an unknown health, and are not picked
+// for requests before their first health check says they are healthy.
+func TestUnknownHealthNotSelectable(t *testing.T) {
+	backends, addrs := startFakeBackends(3)
+	defer func() {
+		for _, b := range backends {
+			b.Close()
+		}
+	}()
+
+	var testPool ServerPool
+	for _, addr := range addrs {
+		server, err := NewTargetServer(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Health != StatusUnknown || server.IsSelectable() {
+			t.Errorf("Expected a new server to have an unknown health and not be selectable, but it is %s", server.Health)
+		}
+		testPool.Servers = append(testPool.Servers, server)
+	}
+
+	for name, algo := range Algorithms {
+		if _, err := algo(&testPool, testPool.ServerList(), httptest.NewRequest("GET", "http://localhost/", nil)); err != ErrNoHealthyServer {
+			t.Errorf("Expected %s to find no healthy server before the first health check, but got: %v", name, err)
+		}
+	}
+
+	// The liveness probe tells the unknown servers apart from the degraded ones
+	lb := &LoadBalancer{Pool: &testPool}
+	backends[0].SetHealthy(false)
+	testPool.Servers[0].RefreshHealthStatus()
+	w := httptest.NewRecorder()
+	lb.livenessHandler(w, httptest.NewRequest("GET", "http://localhost"+LivenessEndpoint, nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the liveness probe to respond with JSON but got %s", ct)
+	}
+	var liveness LivenessResponse
+	if err := json.NewDecoder(w.Body).Decode(&liveness); err != nil {
+		t.Fatal(err)
+	}
+	if liveness.Status != "ok" || liveness.Healthy != 0 || liveness.Degraded != 1 || liveness.Unknown != 2 {
+		t.Errorf("Expected the liveness probe to count 1 degraded and 2 unknown servers but got %+v", liveness)
+	}
+	if liveness.Version != Version || liveness.Commit != Commit {
+		t.Errorf("Expected the liveness probe to report the version but got %+v", liveness)
+	}
+
+	testPool.RunHealthCheck()
+	for name, algo := range Algorithms {
+		index, err := algo(&testPool, testPool.ServerList(), httptest.NewRequest("GET", "http://localhost/", nil))
+		if err != nil || index == 0 {
+			t.Errorf("Expected %s to pick a healthy server once checked, but got %d: %v", name, index, err)
+		}
+	}
+}
+
+// TestWaitHealthy tests that a new pool checks the health of its servers before it is returned when
+// WaitHealthy is set.
+func TestWaitHealthy(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State": "healthy"}`)
+	}))
+	defer healthy.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{healthy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	if h := testPool.Servers[0].Health; h != StatusHealthy {
+		t.Errorf("Expected the server to be healthy right away but it is %s", h)
+	}
+}
+
+// TestWaitForHealthy tests that waiting for a healthy server returns once there is one, and times out
+// if there is none.
+func TestWaitForHealthy(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+	testPool.DegradeAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := testPool.WaitForHealthy(ctx, 10*time.Millisecond); err != ErrStartupTimeout {
+		t.Errorf("Expected ErrStartupTimeout with no healthy server but got: %v", err)
+	}
+
+	testPool.Servers[1].SetStatus(StatusHealthy)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := testPool.WaitForHealthy(ctx, 10*time.Millisecond); err != nil {
+		t.Errorf("Expected a healthy server to be found but got: %s", err)
+	}
+}
+
+// TestSlowStart tests that a server that just recovered gets a growing share of the requests over the
+// slow start window.
+func TestSlowStart(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+	recovering := testPool.Servers[1]
+	recovering.Degrade()
+	recovering.SetStatus(StatusHealthy)
+
+	now := time.Now()
+	if f := recovering.SlowStartFactor(now.Add(SlowStartWindow / 4)); f < 0.24 || f > 0.26 {
+		t.Errorf("Expected a slow start factor of 0.25 a quarter into the window but got %f", f)
+	}
+	if f := recovering.SlowStartFactor(now.Add(SlowStartWindow)); f != 1 {
+		t.Errorf("Expected a slow start factor of 1 after the window but got %f", f)
+	}
+	if f := testPool.Servers[0].SlowStartFactor(now); f != 1 {
+		t.Errorf("Expected a slow start factor of 1 for a server that never recovered but got %f", f)
+	}
+
+	// Right after recovering, the server should get close to none of the requests
+	var picks int
+	for i := 0; i < 100; i++ {
+		server, err := testPool.GetTargetServer(RoundRobin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server == recovering {
+			picks++
+		}
+	}
+	if picks > 10 {
+		t.Errorf("Expected the recovering server to get few requests but it got %d out of 100", picks)
+	}
+}
+
+// TestGetTargetServerReload tests that the server returned is the one the algorithm picked, even if the
+// servers of the pool are reloaded while it is picking.
+func TestGetTargetServerReload(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+	picked := testPool.Servers[1]
+	server, err := testPool.GetTargetServer(func(pool *ServerPool, servers []*TargetServer) (int, error) {
+		pool.Lock()
+		pool.Servers = []*TargetServer{pool.Servers[0]}
+		pool.Unlock()
+		return 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server != picked {
+		t.Errorf("Expected the server picked by the algorithm, %s, but got %s", picked.Address, server.Address)
+	}
+}
+
+// TestDraining tests that RoundRobin never picks a draining server, even though it is healthy.
+func TestDraining(t *testing.T) {
+	sharedPool.PauseHealthChecks()
+	sharedPool.HealthyAll()
+
+	k := 1
+	sharedPool.Servers[k].SetDraining(true)
+	for i := 0; i < len(sharedPool.Servers)*2; i++ {
+		rrIdx, err := RoundRobin(sharedPool, sharedPool.ServerList())
+		if err != nil {
+			t.Error(err)
+		}
+		if rrIdx == k {
+			t.Errorf("Expected RoundRobin to never choose draining server at index %d but it did", k)
+		}
+	}
+
+	// Health checks should not take the server out of draining mode
+	sharedPool.RunHealthCheck()
+	if !sharedPool.Servers[k].IsDraining() {
+		t.Errorf("Expected server at index %d to still be draining after a health check", k)
+	}
+
+	sharedPool.Servers[k].SetDraining(false)
+	sharedPool.Normalize()
+}
+
+// TestRequestDeadline tests that a request that takes longer than the request deadline gets a 504.
+func TestRequestDeadline(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/"+HealthEndpoint {
+			fmt.Fprint(w, `{"State": "healthy"}`)
+			return
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+
+	// Swap in a pool that only has the slow server
+	testPool, err := NewServerPool(ServerAddresses{slow.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+	RequestDeadline = time.Millisecond * 50
+	defer func() {
+		RequestDeadline = 0
+	}()
+
+	r := httptest.NewRequest("GET", "http://localhost/slow", nil)
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected a 504 status code but got %d", w.Code)
+	}
+	if n := testPool.Servers[0].ResponseStats().Requests; n != 0 {
+		t.Errorf("Expected the request deadline not to be recorded against the server but got %d requests", n)
+	}
+}
+
+// TestFailureStatusCodes tests that the client gets a 503 when there is no healthy server, and a 502
+// when the chosen target server cannot be reached and the request can't be retried.
+func TestFailureStatusCodes(t *testing.T) {
+	// Nothing listens on the port of the test server
+	lb := &LoadBalancer{Pool: newTestPool(t, 1)}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a 502 status code for an unreachable server but got %d", w.Code)
+	}
+
+	// The unreachable server has been degraded, so there is no server left to retry with
+	lb.Pool.HealthyAll()
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 status code once the unreachable server is degraded but got %d", w.Code)
+	}
+
+	lb.Pool.DegradeAll()
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 status code when no server is healthy but got %d", w.Code)
+	}
+}
+
+// TestProbeRoutes tests that the self health endpoints are served without reaching the main handler,
+// and that readiness follows the health of the pool.
+func TestProbeRoutes(t *testing.T) {
+	lb := &LoadBalancer{Pool: newTestPool(t, 1)}
+
+	handler := lb.withProbeRoutes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Probe request to %s reached the main handler", r.URL.Path)
+	}))
+
+	var cases = []struct {
+		path     string
+		degraded bool
+		code     int
+	}{
+		{LivenessEndpoint, false, http.StatusOK},
+		{ReadinessEndpoint, false, http.StatusOK},
+		{LivenessEndpoint, true, http.StatusOK},
+		{ReadinessEndpoint, true, http.StatusServiceUnavailable},
+	}
+	for _, c := range cases {
+		if c.degraded {
+			lb.Pool.DegradeAll()
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("Expected a %d status code for %s (degraded: %t) but got %d", c.code, c.path, c.degraded, w.Code)
+		}
+	}
+}
+
+// TestRoutesOnlyProbes tests that the probes, the Nagios check and waiting for a healthy server at
+// startup take the pools of the routes into account when everything goes through the router.
+func TestRoutesOnlyProbes(t *testing.T) {
+	backend := newFakeBackend(nil)
+	defer backend.Close()
+	newRoutedLB := func(addr string) *LoadBalancer {
+		lb, err := NewLoadBalancer(LoadBalancerOptions{
+			Routes: []RouteConfig{{PathPrefix: "/api", Backends: []BackendConfig{{Address: addr}}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lb
+	}
+
+	down := newRoutedLB(fmt.Sprintf("http://localhost:%d", freePort(t)))
+	defer down.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := down.WaitForHealthy(ctx, 10*time.Millisecond); err != ErrStartupTimeout {
+		t.Errorf("Expected ErrStartupTimeout with no healthy server on the route but got: %v", err)
+	}
+
+	lb := newRoutedLB(backend.URL)
+	defer lb.Stop()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := lb.WaitForHealthy(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("Expected the healthy server on the route to be found but got: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	lb.Handler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+ReadinessEndpoint, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the load balancer to be ready with a healthy server on the route but got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/nagios", nil))
+	if !strings.HasPrefix(w.Body.String(), "LB OK - 1/1 backends healthy") {
+		t.Errorf("Expected the Nagios check to count the server on the route but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// freePort returns a port that nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestMultipleListeners tests that the load balancer serves on all the ports it is given, with the admin
+// API on a port of its own, and that they are all shut down once it is asked to.
+func TestMultipleListeners(t *testing.T) {
+	lb := &LoadBalancer{Pool: newTestPool(t, 1)}
+	ports := []int{freePort(t), freePort(t)}
+	adminPort := freePort(t)
+	admin := newAdminServer(fmt.Sprintf("127.0.0.1:%d", adminPort), lb.AdminHandler())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- startListeners(ctx, ports, lb.Handler(), admin) }()
+
+	urls := make(map[int]string)
+	for _, port := range ports {
+		urls[port] = fmt.Sprintf("http://localhost:%d%s", port, LivenessEndpoint)
+	}
+	urls[adminPort] = fmt.Sprintf("http://127.0.0.1:%d/servers", adminPort)
+	for port, url := range urls {
+		var resp *http.Response
+		var err error
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if resp, err = http.Get(url); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("Expected the load balancer to listen on %d but got: %s", port, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected a 200 on port %d but got %d", port, resp.StatusCode)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown but got: %s", err)
+	}
+	for port, url := range urls {
+		if _, err := http.Get(url); err == nil {
+			t.Errorf("Expected port %d to be closed after the shutdown", port)
+		}
+	}
+}
+
+// TestProxyProtocol tests that the listeners take the client address from the PROXY protocol header of
+// both versions, and close the connections that don't send one.
+func TestProxyProtocol(t *testing.T) {
+	backend := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.RunHealthCheck()
+	lb := &LoadBalancer{Pool: testPool}
+	ProxyProtocol = true
+	defer func() {
+		ProxyProtocol = false
+	}()
+
+	port := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- startListeners(ctx, []int{port}, lb.Handler(), nil) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	send := func(header []byte) (string, error) {
+		var conn net.Conn
+		var err error
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port)); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(header)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	got, err := send([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\n"))
+	if err != nil || got != "203.0.113.7" {
+		t.Errorf("Expected the v1 client address to be forwarded but got %q, %v", got, err)
+	}
+
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12)
+	v2 = append(v2, 198, 51, 100, 9, 192, 0, 2, 1, 0xdc, 0x04, 0, 80)
+	got, err = send(v2)
+	if err != nil || got != "198.51.100.9" {
+		t.Errorf("Expected the v2 client address to be forwarded but got %q, %v", got, err)
+	}
+
+	if got, err := send(nil); err == nil {
+		t.Errorf("Expected the connection without a header to be closed but got %q", got)
+	}
+}
+
+// TestListenerBindFailure tests that all the listeners are torn down when one of them can't listen on
+// its port.
+func TestListenerBindFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	ports := []int{freePort(t), taken.Addr().(*net.TCPAddr).Port}
+	done := make(chan error, 1)
+	go func() { done <- startListeners(context.Background(), ports, http.NotFoundHandler(), nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected an error when a port is already taken")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the listeners to be torn down when a port is already taken")
+	}
+}
+
+// TestTCPMode tests that the TCP mode pipes the connections to the target servers both ways, closes the
+// ones still open after the shutdown timeout, and checks the health of the target servers by connecting
+// to them.
+func TestTCPMode(t *testing.T) {
+	defaultShutdownTimeout := ShutdownTimeout
+	defer func() {
+		ProxyMode = ProxyModeHTTP
+		ShutdownTimeout = defaultShutdownTimeout
+	}()
+	ProxyMode = ProxyModeTCP
+	ShutdownTimeout = 50 * time.Millisecond
+
+	// The target server echoes back whatever it gets
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	testPool, err := NewServerPool(ServerAddresses{"tcp://" + backend.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	if !testPool.Servers[0].IsHealthy() {
+		t.Fatal("Expected the target server to be healthy once it accepts connections")
+	}
+
+	port := freePort(t)
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	adminURL := "http://" + adminAddr + "/servers"
+	admin := newAdminServer(adminAddr, (&LoadBalancer{Pool: testPool}).AdminHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- startTCPListeners(ctx, []int{port}, testPool, admin) }()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The admin API is served alongside the TCP listeners
+	resp, err := http.Get(adminURL)
+	if err != nil {
+		t.Fatalf("Expected the admin server to be up in the tcp mode but got: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a 200 from the admin API in the tcp mode but got %d", resp.StatusCode)
+	}
+	fmt.Fprint(conn, "hello over tcp")
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(b) != "hello over tcp" {
+		t.Errorf("Expected the target server to echo back the data but got %q: %v", b, err)
+	}
+
+	// A connection that is left open through the shutdown
+	idle, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	fmt.Fprint(idle, "ping")
+	if _, err := io.ReadFull(idle, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown but got: %s", err)
+	}
+	if _, err := http.Get(adminURL); err == nil {
+		t.Error("Expected the admin server to be closed after the shutdown")
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the open connection to be closed after the shutdown timeout but got %v", err)
+	}
+
+	backend.Close()
+	testPool.RunHealthCheck()
+	if testPool.Servers[0].IsHealthy() {
+		t.Error("Expected the target server to be degraded once it no longer accepts connections")
+	}
+}
+
+// TestValidateProxyMode tests that only the known proxy modes are accepted, and that the TCP mode is
+// turned down along with the PROXY protocol.
+func TestValidateProxyMode(t *testing.T) {
+	defer func() { ProxyProtocol = false }()
+
+	var cases = []struct {
+		mode          string
+		proxyProtocol bool
+		expected      error
+	}{
+		{ProxyModeHTTP, false, nil},
+		{ProxyModeHTTP, true, nil},
+		{ProxyModeTCP, false, nil},
+		{ProxyModeTCP, true, ErrProxyProtocolWithTCPMode},
+		{"udp", false, ErrInvalidProxyMode},
+	}
+	for _, c := range cases {
+		ProxyProtocol = c.proxyProtocol
+		if err := ValidateProxyMode(c.mode); err != c.expected {
+			t.Errorf("Expected %v for the %s mode (PROXY protocol: %t) but got %v", c.expected, c.mode, c.proxyProtocol, err)
+		}
+	}
+}
+
+// TestTCPModeDialFailure tests that in the tcp mode, a target server that refuses the connection is
+// degraded and penalized, and the connection goes to another server, up to MaxRetries times.
+func TestTCPModeDialFailure(t *testing.T) {
+	defer func() { ProxyMode = ProxyModeHTTP }()
+	defer func(max int) { MaxRetries = max }(MaxRetries)
+	ProxyMode = ProxyModeTCP
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// Pick the server that is down first
+	var picks atomic.Int32
+	defer func(algo Algorithm) { selectionAlgorithm = algo }(selectionAlgorithm)
+	selectionAlgorithm = func(_ *ServerPool, servers []*TargetServer, _ *http.Request) (int, error) {
+		return int(picks.Add(1)-1) % len(servers), nil
+	}
+
+	var cases = []struct {
+		maxRetries int
+		connected  bool
+	}{
+		{1, true},
+		{0, false},
+	}
+	for _, c := range cases {
+		MaxRetries = c.maxRetries
+		picks.Store(0)
+
+		// The server goes down once the pool has found it healthy
+		dead, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool, err := NewServerPool(ServerAddresses{"tcp://" + dead.Addr().String(), "tcp://" + echo.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		dead.Close()
+
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			proxyTCPConn(conn, testPool, newTCPConns())
+			close(done)
+		}()
+		client.SetDeadline(time.Now().Add(time.Second))
+		go fmt.Fprint(client, "ping")
+		b := make([]byte, 4)
+		_, err = io.ReadFull(client, b)
+		if c.connected && (err != nil || string(b) != "ping") {
+			t.Errorf("-max-retries %d: expected the connection to go to the server that is up but got %q: %v", c.maxRetries, b, err)
+		}
+		if !c.connected && err == nil {
+			t.Errorf("-max-retries %d: expected the connection to be closed", c.maxRetries)
+		}
+		client.Close()
+		<-done
+
+		down := testPool.Servers[0]
+		if down.IsHealthy() || !down.IsPenalized(time.Now()) {
+			t.Errorf("-max-retries %d: expected the server that is down to be degraded and penalized", c.maxRetries)
+		}
+		if testPool.Servers[0].Load != 0 || testPool.Servers[1].Load != 0 {
+			t.Errorf("-max-retries %d: expected the load of the servers to be released but got %d and %d", c.maxRetries, testPool.Servers[0].Load, testPool.Servers[1].Load)
+		}
+	}
+}
+
+// TestLBDrain tests that draining the load balancer fails its probes while requests still go through.
+func TestLBDrain(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+	handler, admin := lb.Handler(), lb.AdminHandler()
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/_drain", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a 200 from the drain endpoint but got %d", w.Code)
+	}
+
+	for _, path := range []string{LivenessEndpoint, ReadinessEndpoint} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+path, nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected a 503 from %s while draining but got %d", path, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected requests to be served while draining but got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/_drain?draining=false", nil))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+LivenessEndpoint, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a 200 from the liveness probe once undrained but got %d", w.Code)
+	}
+}
+
+// TestRetryRequestBody tests that a retried request carries the full body to the next target server,
+// and that a request with a body too large to be buffered is not retried.
+func TestRetryRequestBody(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	defaultMax := RetryBodyMaxBytes
+	defer func() {
+		RetryBodyMaxBytes = defaultMax
+	}()
+
+	var cases = []struct {
+		maxBytes int64
+		code     int
+	}{
+		{1024, http.StatusOK},
+		{4, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		// Round robin starts with the first server, so the failing server always gets the first attempt
+		testPool, err := NewServerPool(ServerAddresses{failing.URL, echo.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		testPool.HealthyAll()
+		lb := &LoadBalancer{Pool: testPool}
+		RetryBodyMaxBytes = c.maxBytes
+
+		body := "hello, target server"
+		r := httptest.NewRequest("PUT", "http://localhost/echo", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+
+		if w.Code != c.code {
+			t.Errorf("Expected a %d status code with a max of %d bytes but got %d", c.code, c.maxBytes, w.Code)
+		}
+		if c.code == http.StatusOK && w.Body.String() != body {
+			t.Errorf("Expected the retried request to have the body %q but got %q", body, w.Body.String())
+		}
+	}
+}
+
+// TestMaxBodyBytes tests that requests with a body over the limit get a 413, whether the body length
+// is declared upfront, found out while buffering the body, or found out while streaming it.
+func TestMaxBodyBytes(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{echo.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	defaultRetryMax := RetryBodyMaxBytes
+	lb := &LoadBalancer{Pool: testPool}
+	MaxBodyBytes = 16
+	defer func() {
+		MaxBodyBytes = 0
+		RetryBodyMaxBytes = defaultRetryMax
+	}()
+
+	var cases = []struct {
+		name          string
+		body          io.Reader
+		retryMaxBytes int64
+		code          int
+	}{
+		{"small body", strings.NewReader("small"), 1024, http.StatusOK},
+		{"declared length", strings.NewReader(strings.Repeat("x", 32)), 1024, http.StatusRequestEntityTooLarge},
+		{"buffered", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 32))), 1024, http.StatusRequestEntityTooLarge},
+		{"streamed", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 32))), 4, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		RetryBodyMaxBytes = c.retryMaxBytes
+		r := httptest.NewRequest("PUT", "http://localhost/upload", c.body)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: expected a %d status code but got %d", c.name, c.code, w.Code)
+		}
+	}
+	// Only the small body made it to the server, the others are on the client
+	if stats := testPool.Servers[0].ResponseStats(); stats.Requests != 1 || stats.ErrorRate != 0 {
+		t.Errorf("Expected a single successful request recorded against the server but got %d with an error rate of %v", stats.Requests, stats.ErrorRate)
+	}
+}
+
+// TestHealthCheckTimeout tests that a target server whose health endpoint never responds is marked
+// degraded once HealthCheckTimeout is up.
+func TestHealthCheckTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	defaultTimeout := HealthCheckTimeout
+	HealthCheckTimeout = 50 * time.Millisecond
+	defer func() { HealthCheckTimeout = defaultTimeout }()
+
+	server, err := NewTargetServer(hanging.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetStatus(StatusHealthy)
+
+	start := time.Now()
+	if err := server.RefreshHealthStatus(); err == nil {
+		t.Error("Expected the health check to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the health check to give up after the timeout, but it took %s", elapsed)
+	}
+	if server.IsHealthy() {
+		t.Error("Expected the server to be degraded after its health check timed out")
+	}
+}
+
+// TestHealthExpectation tests that a target server whose health response doesn't meet the expectation
+// is degraded, in both health check modes.
+func TestHealthExpectation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State": "healthy", "checks": {"db": "down", "replicas": 2}}`)
+	}))
+	defer backend.Close()
+	defer func() { HealthCheckMode = HealthModeJSON }()
+
+	var cases = []struct {
+		expect  HealthExpectation
+		healthy bool
+	}{
+		{HealthExpectation{}, true},
+		{HealthExpectation{BodyContains: `"db": "down"`}, true},
+		{HealthExpectation{BodyContains: "all good"}, false},
+		{HealthExpectation{JSONField: "checks.replicas", JSONValue: "2"}, true},
+		{HealthExpectation{JSONField: "checks.db", JSONValue: "ok"}, false},
+		{HealthExpectation{JSONField: "checks.cache", JSONValue: "ok"}, false},
+	}
+	for _, mode := range []string{HealthModeJSON, HealthModeStatus} {
+		HealthCheckMode = mode
+		for _, c := range cases {
+			server, err := NewTargetServer(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := c.expect
+			server.UpdateSettings(func(settings *ServerSettings) { settings.HealthExpect = &expect })
+
+			status, err := server.GetNewHealthStatus()
+			if (status == StatusHealthy) != c.healthy {
+				t.Errorf("%s mode, %+v: expected healthy to be %t but got %s (%v)", mode, c.expect, c.healthy, status, err)
+			}
+			if !c.healthy && !errors.Is(err, ErrHealthExpectationFailed) {
+				t.Errorf("%s mode, %+v: expected ErrHealthExpectationFailed but got %v", mode, c.expect, err)
+			}
+		}
+	}
+}
+
+// TestStatusHealthMode tests that in the status mode, a server is healthy if its health endpoint responds
+// with any 2xx, whatever the body says, and degraded if it responds with a 5xx or can't be reached.
+func TestStatusHealthMode(t *testing.T) {
+	HealthCheckMode = HealthModeStatus
+	defer func() { HealthCheckMode = HealthModeJSON }()
+
+	var cases = []struct {
+		code    int
+		body    string
+		healthy bool
+	}{
+		{http.StatusOK, `{"State":"healthy"}`, true},
+		{http.StatusOK, `{"State":"degraded"}`, true},
+		{http.StatusOK, "not json", true},
+		{http.StatusNoContent, "", true},
+		{http.StatusInternalServerError, `{"State":"healthy"}`, false},
+		{http.StatusServiceUnavailable, "", false},
+	}
+	for _, c := range cases {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.code)
+			fmt.Fprint(w, c.body)
+		}))
+		server, err := NewTargetServer(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := server.GetNewHealthStatus()
+		if (status == StatusHealthy) != c.healthy {
+			t.Errorf("%d %q: expected healthy to be %t but got %s (%v)", c.code, c.body, c.healthy, status, err)
+		}
+		backend.Close()
+	}
+
+	// A server that refuses connections is degraded too
+	backend := httptest.NewServer(http.NotFoundHandler())
+	server, err := NewTargetServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+	if status, err := server.GetNewHealthStatus(); status != StatusDegraded || err == nil {
+		t.Errorf("Expected a server that refuses connections to be degraded with an error but got %s (%v)", status, err)
+	}
+}
+
+// TestTCPHealthMode tests that in the tcp health check mode a server is healthy as long as it accepts
+// connections, whatever its health endpoint says, and degraded once it doesn't.
+func TestTCPHealthMode(t *testing.T) {
+	HealthCheckMode = HealthModeTCP
+	defer func() { HealthCheckMode = HealthModeJSON }()
+	if err := ValidateHealthCheckMode(HealthModeTCP); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newFakeBackend(nil)
+	backend.SetHealthy(false)
+	server, err := NewTargetServer(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := server.GetNewHealthStatus(); status != StatusHealthy {
+		t.Errorf("Expected a server that accepts connections to be healthy but got %s (%v)", status, err)
+	}
+	if backend.healthChecks.Load() != 0 {
+		t.Error("Expected no request to the health endpoint in the tcp mode")
+	}
+
+	backend.Close()
+	if status, _ := server.GetNewHealthStatus(); status != StatusDegraded {
+		t.Errorf("Expected a server that refuses connections to be degraded but got %s", status)
+	}
+}
+
+// TestGRPCHealthModeGated tests that the grpc health check mode is only accepted in the builds that have
+// it, with the grpchealth build tag.
+func TestGRPCHealthModeGated(t *testing.T) {
+	err := ValidateHealthCheckMode(HealthModeGRPC)
+	if grpcHealthStatus == nil && err != ErrGRPCHealthNotBuiltIn {
+		t.Errorf("Expected ErrGRPCHealthNotBuiltIn without the grpchealth build tag but got %v", err)
+	}
+	if grpcHealthStatus != nil && err != nil {
+		t.Errorf("Expected the grpc mode to be valid with the grpchealth build tag but got %v", err)
+	}
+}
+
+// TestHealthThresholds tests that a target server only changes its health after enough health checks in
+// a row agree, and that a check that disagrees starts the count over.
+func TestHealthThresholds(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 1)
+	server := testPool.Servers[0]
+	server.UpdateSettings(func(settings *ServerSettings) {
+		settings.HealthyThreshold, settings.UnhealthyThreshold = 2, 3
+	})
+
+	check := func(healthy bool, expected HealthStatus) {
+		t.Helper()
+		backends[0].SetHealthy(healthy)
+		server.RefreshHealthStatus()
+		if h := server.Status(); h != expected {
+			t.Fatalf("Expected the server to be %s but it is %s", expected, h)
+		}
+	}
+
+	// The first check of the pool marked the server healthy, since it started out with the defaults
+	check(false, StatusHealthy)
+	check(false, StatusHealthy)
+	check(true, StatusHealthy)
+	check(false, StatusHealthy)
+	check(false, StatusHealthy)
+	check(false, StatusDegraded)
+
+	check(true, StatusDegraded)
+	check(false, StatusDegraded)
+	check(true, StatusDegraded)
+	check(true, StatusHealthy)
+}
+
+// TestHealthHeaders tests that the health headers of the pool and the backend are sent with the health
+// checks, including a Host override.
+func TestHealthHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("X-Check") != "backend" || r.Host != "app.internal" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"State": "healthy"}`))
+	}))
+	defer backend.Close()
+
+	backends := withHealthHeaders([]BackendConfig{{
+		Address:       backend.URL,
+		HealthHeaders: map[string]string{"X-Check": "backend"},
+	}}, map[string]string{"Authorization": "Bearer secret", "Host": "app.internal", "X-Check": "pool"})
+
+	server, err := NewTargetServerFromConfig(backends[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := server.GetNewHealthStatus()
+	if err != nil || status != StatusHealthy {
+		t.Errorf("Expected the server to be healthy with the health headers, got %s (%v)", status, err)
+	}
+}
+
+// TestHealthDecorator tests that the health decorator can override the result of a health check.
+func TestHealthDecorator(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State": "healthy"}`)
+	}))
+	defer healthy.Close()
+
+	server, err := NewTargetServer(healthy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	HealthDecorator = func(s *TargetServer, status HealthStatus, err error) HealthStatus {
+		if s != server || status != StatusHealthy || err != nil {
+			t.Errorf("Unexpected health check result passed to the decorator: %s, %v", status, err)
+		}
+		return StatusDegraded
+	}
+	defer func() { HealthDecorator = nil }()
+
+	if err := server.RefreshHealthStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if server.IsHealthy() {
+		t.Error("Expected the server to be degraded by the decorator")
+	}
+}
+
+// newEchoUpgradeBackend starts a target server that accepts connection upgrades and echoes back
+// whatever is sent through the upgraded connection, and returns a load balancer with it as its only server.
+func newEchoUpgradeBackend(t *testing.T) (*httptest.Server, *LoadBalancer) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+
+	testPool, err := NewServerPool(ServerAddresses{echo.URL})
+	if err != nil {
+		echo.Close()
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	return echo, &LoadBalancer{Pool: testPool}
+}
+
+// upgradeEcho sends a connection upgrade request to the load balancer at addr, and returns the upgraded
+// connection along with a reader for it.
+func upgradeEcho(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "GET /echo HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		t.Fatalf("Expected a 101 status code but got %d", resp.StatusCode)
+	}
+	return conn, reader
+}
+
+// TestUpgradeTunnel tests that an upgraded connection is tunneled to the target server both ways.
+func TestUpgradeTunnel(t *testing.T) {
+	echo, balancer := newEchoUpgradeBackend(t)
+	defer echo.Close()
+
+	lb := httptest.NewServer(balancer.Handler())
+	defer lb.Close()
+
+	conn, reader := upgradeEcho(t, lb.Listener.Addr().String())
+	defer conn.Close()
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("Expected the tunnel to echo %q but got %q", "ping\n", line)
+	}
+}
+
+// TestUpgradeTunnelReadTimeout tests that the read timeout of the listener server, which is meant for
+// reading the request, doesn't cut off an upgraded connection that outlives it.
+func TestUpgradeTunnelReadTimeout(t *testing.T) {
+	echo, balancer := newEchoUpgradeBackend(t)
+	defer echo.Close()
+
+	ListenerReadTimeout = 100 * time.Millisecond
+	defer func() {
+		ListenerReadTimeout = 10 * time.Second
+	}()
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	conn, reader := upgradeEcho(t, lb.Listener.Addr().String())
+	defer conn.Close()
+
+	time.Sleep(3 * ListenerReadTimeout)
+	fmt.Fprint(conn, "ping\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected the tunnel to still be open after the read timeout, but got: %s", err)
+	}
+	if line != "ping\n" {
+		t.Errorf("Expected the tunnel to echo %q but got %q", "ping\n", line)
+	}
+}
+
+// TestListenerWriteTimeout tests that a response that takes longer than the write timeout is cut off.
+func TestListenerWriteTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "too late")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	balancer := &LoadBalancer{Pool: testPool}
+	ListenerWriteTimeout = 50 * time.Millisecond
+	defer func() {
+		ListenerWriteTimeout = 0
+	}()
+
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	resp, err := http.Get(lb.URL)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Errorf("Expected the response to be cut off by the write timeout, but got %d: %s", resp.StatusCode, body)
+	}
+}
+
+// TestMaxHeaderBytes tests that a request whose headers are larger than the limit is rejected with a 431
+// before it reaches the target servers.
+func TestMaxHeaderBytes(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 1)
+	balancer := &LoadBalancer{Pool: testPool}
+	defaultMax := ListenerMaxHeaderBytes
+	ListenerMaxHeaderBytes = 1024
+	defer func() {
+		ListenerMaxHeaderBytes = defaultMax
+	}()
+
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	var cases = []struct {
+		size     int
+		expected int
+	}{
+		{100, http.StatusOK},
+		// The server allows a few KB over the limit for the request line and its own bookkeeping
+		{16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, c := range cases {
+		hits := backends[0].hits.Load()
+		req, _ := http.NewRequest("GET", lb.URL, nil)
+		req.Header.Set("X-Big", strings.Repeat("a", c.size))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Errorf("Expected a %d for a %d byte header but got %d", c.expected, c.size, resp.StatusCode)
+		}
+		if c.expected != http.StatusOK && backends[0].hits.Load() != hits {
+			t.Errorf("Expected the request with a %d byte header not to reach the target server", c.size)
+		}
+	}
+}
+
+// TestServerSentEvents tests that an event stream reaches the client event by event, while the target
+// server is still producing it.
+func TestServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: last\n\n")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	balancer := &LoadBalancer{Pool: testPool}
+
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	// The stream only ends once the test is over, so the response is read in the background
+	defer close(release)
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(lb.URL)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: first\n" {
+			t.Errorf("Expected the first event but got %q", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the first event to be flushed to the client before the stream ends")
+	}
+}
+
+// TestGzip tests that compressible responses are gzipped for the clients that accept it, and that small,
+// binary and already encoded responses are passed on as they are.
+func TestGzip(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 100)
+	backend := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, body)
+		case "/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "br")
+			fmt.Fprint(w, body)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			fmt.Fprint(w, body)
+		}
+	}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	GzipResponses = true
+	defer func() {
+		GzipResponses = false
+	}()
+
+	var cases = []struct {
+		path           string
+		acceptEncoding string
+		gzipped        bool
+	}{
+		{"/", "gzip, deflate", true},
+		{"/", "br", false},
+		{"/", "gzip;q=0", false},
+		{"/small", "gzip", false},
+		{"/image", "gzip", false},
+		{"/encoded", "gzip", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://localhost"+c.path, nil)
+		req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, req)
+
+		encoding := w.Header().Get("Content-Encoding")
+		if !c.gzipped {
+			if encoding == "gzip" {
+				t.Errorf("Expected %s with Accept-Encoding %q not to be gzipped", c.path, c.acceptEncoding)
+			}
+			continue
+		}
+		if encoding != "gzip" || w.Header().Get("Content-Length") != "" {
+			t.Fatalf("Expected %s to be gzipped without a Content-Length but got %q and %q", c.path, encoding, w.Header().Get("Content-Length"))
+		}
+		gz, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Errorf("Expected the gzipped body to decompress to the original body, but got %d bytes", len(got))
+		}
+	}
+}
+
+// TestGRPCProxy tests that a gRPC style call goes over HTTP/2 end to end, with its trailers passed on,
+// and that its 500 responses are not retried.
+func TestGRPCProxy(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	var backendProtocols http.Protocols
+	backendProtocols.SetUnencryptedHTTP2(true)
+	backend.Config.Protocols = &backendProtocols
+	backend.Start()
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL, backend.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	defaultTransport := backendTransport
+	balancer := &LoadBalancer{Pool: testPool}
+	EnableH2C, BackendH2C = true, true
+	initBackendTransport()
+	defer func() {
+		backendTransport = defaultTransport
+		EnableH2C, BackendH2C = false, false
+	}()
+
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	resp, err := client.Post(lb.URL+"/helloworld.Greeter/SayHello", "application/grpc", strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "message" {
+		t.Fatalf("Expected the gRPC response to be proxied but got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done" {
+		t.Errorf("Expected the trailers to be passed on but got %v", resp.Trailer)
+	}
+
+	calls = 0
+	req, _ := http.NewRequest("PUT", lb.URL+"/fail", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || calls != 1 {
+		t.Errorf("Expected the 500 from the gRPC server to be passed on as is, but got %d after %d calls", resp.StatusCode, calls)
+	}
+}
+
+// TestH2C tests that requests from HTTP/2 clients are proxied when h2c is enabled.
+func TestH2C(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		fmt.Fprint(w, "hello")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	balancer := &LoadBalancer{Pool: testPool}
+	EnableH2C = true
+	defer func() {
+		EnableH2C = false
+	}()
+
+	lb := httptest.NewUnstartedServer(nil)
+	lb.Config = newListenerServer(0, balancer.Handler())
+	lb.Start()
+	defer lb.Close()
+
+	// Only allow HTTP/2 on the client, so that the request fails if h2c isn't served
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: &protocols}}
+
+	resp, err := client.Get(lb.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected an HTTP/2 response but got %s", resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("Expected a 200 with the body %q but got %d with %q", "hello", resp.StatusCode, body)
+	}
+}
+
+// TestClientRateLimiter tests that each client is held to its own rate, and that idle clients are
+// cleaned up.
+func TestClientRateLimiter(t *testing.T) {
+	limiter := NewClientRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("10.0.0.1", now) {
+			t.Fatalf("Expected request %d within the burst to be allowed", i)
+		}
+	}
+	if limiter.Allow("10.0.0.1", now) {
+		t.Error("Expected a request over the burst to be rejected")
+	}
+	if !limiter.Allow("10.0.0.2", now) {
+		t.Error("Expected a request from a different client to be allowed")
+	}
+	if !limiter.Allow("10.0.0.1", now.Add(500*time.Millisecond)) {
+		t.Error("Expected a request to be allowed once a token has been added")
+	}
+
+	limiter.Cleanup(now.Add(time.Second))
+	if len(limiter.clients) != 0 {
+		t.Errorf("Expected all the idle clients to be cleaned up, but %d are left", len(limiter.clients))
+	}
+}
+
+// TestMaxInflightFlood floods the handler with requests to a slow target server, and tests that the
+// number of requests proxied at the same time never goes over the limit, in both overflow modes.
+func TestMaxInflightFlood(t *testing.T) {
+	var mu sync.Mutex
+	var current, peak int
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current++
+		if current > peak {
+			peak = current
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+	}))
+	defer slow.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{slow.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+	MaxInflightRequests = 4
+	initInflightLimiter()
+	defer func() {
+		MaxInflightRequests = 0
+		OverflowMode = OverflowReject
+		OverflowQueueTimeout = 100 * time.Millisecond
+		initInflightLimiter()
+	}()
+
+	var cases = []struct {
+		mode          string
+		expectRejects bool
+	}{
+		{OverflowReject, true},
+		{OverflowQueue, false},
+	}
+	for _, c := range cases {
+		OverflowMode = c.mode
+		OverflowQueueTimeout = 5 * time.Second
+		peak = 0
+
+		var wg sync.WaitGroup
+		var rejected int
+		for i := 0; i < 40; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/slow", nil))
+				if w.Code == http.StatusServiceUnavailable {
+					mu.Lock()
+					rejected++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if peak > MaxInflightRequests {
+			t.Errorf("%s: expected at most %d requests in flight but saw %d", c.mode, MaxInflightRequests, peak)
+		}
+		if c.expectRejects && rejected == 0 {
+			t.Errorf("%s: expected some requests to be rejected", c.mode)
+		}
+		if !c.expectRejects && rejected > 0 {
+			t.Errorf("%s: expected all the requests to wait for a slot, but %d were rejected", c.mode, rejected)
+		}
+	}
+}
+
+// TestMaxInflightClientGone tests that a client that goes away frees its in-flight slot right away, and
+// cancels its request to the target server, even though the target server is still busy with it.
+func TestMaxInflightClientGone(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	backend := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/block" {
+			return
+		}
+		started <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	lb := &LoadBalancer{Pool: testPool}
+	MaxInflightRequests = 1
+	OverflowMode = OverflowQueue
+	OverflowQueueTimeout = time.Second
+	initInflightLimiter()
+	defer func() {
+		MaxInflightRequests = 0
+		OverflowMode = OverflowReject
+		OverflowQueueTimeout = 100 * time.Millisecond
+		initInflightLimiter()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/block", nil).WithContext(ctx))
+		done <- w.Code
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to the target server to be cancelled along with the client request")
+	}
+	select {
+	case code := <-done:
+		if code != StatusClientClosedRequest {
+			t.Errorf("Expected the cancelled request to be logged with a %d but got %d", StatusClientClosedRequest, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the cancelled request to be done while the target server is still busy")
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the slot of the cancelled request to be free for another one but got %d", w.Code)
+	}
+}
+
+// TestRouter tests that requests go to the pool of the route with the longest matching path prefix,
+// and that requests matching no route get a 404 when there is no default pool.
+func TestRouter(t *testing.T) {
+	defaultPool := newTestPool(t, 1)
+	r := Router{Default: defaultPool, hosts: map[string]*ServerPool{}}
+	api, apiV2 := newTestPool(t, 1), newTestPool(t, 1)
+	r.routes = []route{{"/api/v2", apiV2}, {"/api", api}}
+
+	var cases = []struct {
+		path string
+		pool *ServerPool
+	}{
+		{"/api", api},
+		{"/api/users", api},
+		{"/api/v2/users", apiV2},
+		{"/apis", defaultPool},
+		{"/", defaultPool},
+	}
+	for _, c := range cases {
+		if p := r.Match(httptest.NewRequest("GET", "http://localhost"+c.path, nil)); p != c.pool {
+			t.Errorf("Expected %s to be routed to a different pool", c.path)
+		}
+	}
+
+	// Without a default pool, unmatched requests get a 404
+	lb := &LoadBalancer{Pool: &ServerPool{}, Router: &Router{routes: r.routes}}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/static/logo.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 status code for an unrouted request but got %d", w.Code)
+	}
+}
+
+// TestRouterHosts tests that requests for a virtual host go to its pool whatever the path, matching the
+// host name without regard to case or port.
+func TestRouterHosts(t *testing.T) {
+	defaultPool, example, api := newTestPool(t, 1), newTestPool(t, 1), newTestPool(t, 1)
+	r := Router{
+		Default: defaultPool,
+		hosts:   map[string]*ServerPool{"example.com": example},
+		routes:  []route{{"/api", api}},
+	}
+
+	var cases = []struct {
+		host string
+		path string
+		pool *ServerPool
+	}{
+		{"example.com", "/", example},
+		{"Example.COM:8888", "/api", example},
+		{"other.com", "/api", api},
+		{"other.com", "/", defaultPool},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://localhost"+c.path, nil)
+		req.Host = c.host
+		if p := r.Match(req); p != c.pool {
+			t.Errorf("Expected %s%s to be routed to a different pool", c.host, c.path)
+		}
+	}
+}
+
+// TestLoadBalancerInstances tests that load balancers created with NewLoadBalancer can be served as
+// handlers side by side, each with its own pool, transport, and drain and maintenance modes.
+func TestLoadBalancerInstances(t *testing.T) {
+	var backends [2]*fakeBackend
+	var lbs [2]*LoadBalancer
+	var transports [2]countingTransport
+	for i := range lbs {
+		backends[i] = newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "backend %d", i)
+		}))
+		defer backends[i].Close()
+
+		lb, err := NewLoadBalancer(LoadBalancerOptions{
+			Backends:  backendConfigsFromAddresses(ServerAddresses{backends[i].URL}),
+			Transport: &transports[i],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lb.Stop()
+		lb.Pool.RunHealthCheck()
+		lbs[i] = lb
+	}
+
+	for i, lb := range lbs {
+		server := httptest.NewServer(lb)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if expected := fmt.Sprintf("backend %d", i); string(b) != expected {
+			t.Errorf("Expected load balancer %d to forward to %q but got %q", i, expected, b)
+		}
+		if got := transports[i].count; got != 1 {
+			t.Errorf("Expected load balancer %d to use its own transport once but it was used %d times", i, got)
+		}
+	}
+
+	// Draining the first one and putting it in maintenance mode leaves the second one as it was
+	for _, path := range []string{"/_drain", "/maintenance?on=true"} {
+		w := httptest.NewRecorder()
+		lbs[0].AdminHandler().ServeHTTP(w, httptest.NewRequest("POST", "http://localhost"+path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 from %s but got %d", path, w.Code)
+		}
+	}
+	for i, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		for _, path := range []string{ReadinessEndpoint, "/"} {
+			w := httptest.NewRecorder()
+			lbs[i].Handler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+path, nil))
+			if w.Code != expected {
+				t.Errorf("Expected load balancer %d to respond to %s with a %d but got %d", i, path, expected, w.Code)
+			}
+		}
+	}
+}
+
+// TestResponseHeaderRules tests that the header rules of the pool are applied to proxied responses.
+func TestResponseHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend/1.0")
+		w.Header().Set("X-Frame-Options", "ALLOWALL")
+		w.Header().Set("X-Kept", "yes")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	testPool.ResponseHeaders = &HeaderRules{
+		Add:    map[string]string{"X-Frame-Options": "DENY"},
+		Remove: []string{"Server"},
+	}
+	lb := &LoadBalancer{Pool: testPool}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+
+	if v := w.Header().Get("Server"); v != "" {
+		t.Errorf("Expected the Server header to be removed but got %q", v)
+	}
+	if v := w.Header().Values("X-Frame-Options"); len(v) != 1 || v[0] != "DENY" {
+		t.Errorf("Expected the X-Frame-Options header to be overridden with DENY but got %q", v)
+	}
+	if v := w.Header().Get("X-Kept"); v != "yes" {
+		t.Errorf("Expected the other headers to be kept but X-Kept is %q", v)
+	}
+}
+
+// TestHopByHopHeaders tests that the hop-by-hop headers are stripped from both the request to the
+// target server and the response to the client, including the ones listed in the Connection header.
+func TestHopByHopHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Kept", "yes")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	r.Header.Set("Connection", "X-Client-Hop")
+	r.Header.Set("X-Client-Hop", "1")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Te", "trailers, deflate")
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, r)
+
+	for _, name := range []string{"X-Client-Hop", "Keep-Alive", "Proxy-Connection"} {
+		if v := received.Get(name); v != "" {
+			t.Errorf("Expected the %s header to be stripped from the request but got %q", name, v)
+		}
+	}
+	if v := received.Get("Te"); v != "trailers" {
+		t.Errorf("Expected the Te header to be reduced to trailers but got %q", v)
+	}
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Proxy-Authenticate"} {
+		if v := w.Header().Get(name); v != "" {
+			t.Errorf("Expected the %s header to be stripped from the response but got %q", name, v)
+		}
+	}
+	if v := w.Header().Get("X-Kept"); v != "yes" {
+		t.Errorf("Expected the other headers to be kept but X-Kept is %q", v)
+	}
+}
+
+// TestRetryPolicy tests that only requests with idempotent methods are retried after a 500, unless
+// retrying non-idempotent methods is enabled.
+func TestRetryPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	defer func() {
+		RetryNonIdempotent = false
+	}()
+
+	var cases = []struct {
+		method             string
+		retryNonIdempotent bool
+		attempts           int
+	}{
+		{"GET", false, 2},
+		{"POST", false, 1},
+		{"PATCH", false, 1},
+		{"POST", true, 2},
+	}
+	for _, c := range cases {
+		testPool, err := NewServerPool(ServerAddresses{failing.URL, failing.URL + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		testPool.HealthyAll()
+		lb := &LoadBalancer{Pool: testPool}
+		RetryNonIdempotent = c.retryNonIdempotent
+		attempts = 0
+
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest(c.method, "http://localhost/", strings.NewReader("body")))
+		if attempts != c.attempts {
+			t.Errorf("%s (retry non-idempotent: %t): expected %d attempts but got %d", c.method, c.retryNonIdempotent, c.attempts, attempts)
+		}
+	}
+}
+
+// TestRetryOn tests that the statuses in -retry-on are retried with another server, and that the other
+// ones are passed on to the client as they are.
+func TestRetryOn(t *testing.T) {
+	var status atomic.Int32
+	var attempts atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer failing.Close()
+
+	defaultRetryOn := RetryOn
+	defer func() {
+		RetryOn = defaultRetryOn
+	}()
+	if got := RetryOn.String(); got != "500,502-504" {
+		t.Errorf("Expected the default statuses to be 500,502-504 but got %s", got)
+	}
+	for _, v := range []string{"abc", "600", "504-502", "5xx"} {
+		if err := RetryOn.Set(v); err == nil {
+			t.Errorf("Expected an error for -retry-on %s", v)
+		}
+	}
+
+	var cases = []struct {
+		retryOn  string
+		status   int
+		attempts int32
+	}{
+		{"500,502-504", http.StatusBadGateway, 2},
+		{"500,502-504", http.StatusGatewayTimeout, 2},
+		{"500,502-504", http.StatusNotImplemented, 1},
+		{"500", http.StatusBadGateway, 1},
+		{"429, 500", http.StatusTooManyRequests, 2},
+	}
+	for _, c := range cases {
+		if err := RetryOn.Set(c.retryOn); err != nil {
+			t.Fatal(err)
+		}
+		testPool, err := NewServerPool(ServerAddresses{failing.URL, failing.URL + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		testPool.HealthyAll()
+		lb := &LoadBalancer{Pool: testPool}
+		status.Store(int32(c.status))
+		attempts.Store(0)
+
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if got := attempts.Load(); got != c.attempts {
+			t.Errorf("-retry-on %s: expected %d attempts for a %d but got %d", c.retryOn, c.attempts, c.status, got)
+		}
+		if c.attempts == 1 && w.Code != c.status {
+			t.Errorf("-retry-on %s: expected the %d to be passed on but got %d", c.retryOn, c.status, w.Code)
+		}
+	}
+}
+
+// TestMaxRetries tests that a request that every server fails on is only retried up to MaxRetries
+// times, with the response of the last attempt sent to the client.
+func TestMaxRetries(t *testing.T) {
+	var attempts atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	defer func(max int) { MaxRetries = max }(MaxRetries)
+
+	var cases = []struct {
+		maxRetries int
+		attempts   int32
+	}{
+		{2, 3},
+		{0, 1},
+		{10, 5},
+	}
+	for _, c := range cases {
+		MaxRetries = c.maxRetries
+		var addrs ServerAddresses
+		for i := 0; i < 5; i++ {
+			addrs = append(addrs, fmt.Sprintf("%s/%d", failing.URL, i))
+		}
+		testPool, err := NewServerPool(addrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		testPool.HealthyAll()
+		lb := &LoadBalancer{Pool: testPool}
+		attempts.Store(0)
+
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if got := attempts.Load(); got != c.attempts {
+			t.Errorf("-max-retries %d: expected %d attempts but got %d", c.maxRetries, c.attempts, got)
+		}
+		if c.attempts < 5 && w.Code != http.StatusInternalServerError {
+			t.Errorf("-max-retries %d: expected the 500 of the last attempt to be passed on but got %d", c.maxRetries, w.Code)
+		}
+	}
+}
+
+// TestMaxRetriesAtCap tests that a pick of a server that got to its MaxConns after it was picked doesn't
+// use up one of the retries of the request, as nothing was sent to it.
+func TestMaxRetriesAtCap(t *testing.T) {
+	failing := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	capped, ok := newFakeBackend(nil), newFakeBackend(nil)
+	defer capped.Close()
+	defer ok.Close()
+	defer func(max int) { MaxRetries = max }(MaxRetries)
+	MaxRetries = 1
+
+	testPool, err := NewServerPoolFromBackends([]BackendConfig{{Address: capped.URL, MaxConns: 1}, {Address: failing.URL}, {Address: ok.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	testPool.AddLoad(testPool.Servers[0], 1)
+	lb := &LoadBalancer{Pool: testPool}
+
+	// Pick the servers in order, including the one at its cap
+	var picks atomic.Int32
+	defer func(algo Algorithm) { selectionAlgorithm = algo }(selectionAlgorithm)
+	selectionAlgorithm = func(_ *ServerPool, servers []*TargetServer, _ *http.Request) (int, error) {
+		return int(picks.Add(1)-1) % len(servers), nil
+	}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the 500 to be retried with the last server but got %d", w.Code)
+	}
+	if capped.hits.Load() != 0 || failing.hits.Load() != 1 || ok.hits.Load() != 1 {
+		t.Errorf("Expected one request to each server under its cap but got %d, %d and %d", capped.hits.Load(), failing.hits.Load(), ok.hits.Load())
+	}
+}
+
+// TestAccessLog tests that the access log line of a request in the text format has the method, the path,
+// the target server that served it, its status, the number of retries and the latency.
+func TestAccessLog(t *testing.T) {
+	failing := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	ok := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ok.Close()
+	testPool, err := NewServerPool(ServerAddresses{failing.URL, ok.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	lb := &LoadBalancer{Pool: testPool}
+
+	// Pick the failing server first, so that the request is retried once
+	var picks atomic.Int32
+	defer func(algo Algorithm) { selectionAlgorithm = algo }(selectionAlgorithm)
+	selectionAlgorithm = func(_ *ServerPool, servers []*TargetServer, _ *http.Request) (int, error) {
+		return int(picks.Add(1)-1) % len(servers), nil
+	}
+
+	logs := captureLogs(t, func() {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "http://localhost/retried?q=1", nil))
+	})
+
+	var line string
+	for _, l := range strings.Split(logs, "\n") {
+		if strings.Contains(l, "PUT /retried ") {
+			line = l
+		}
+	}
+	if line == "" {
+		t.Fatalf("Expected an access log line for the request but got %q", logs)
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Fields(line) {
+		if k, v, found := strings.Cut(f, "="); found {
+			fields[k] = v
+		}
+	}
+	if fields["backend"] != ok.URL || fields["status"] != "201" || fields["retries"] != "1" {
+		t.Errorf("Expected the backend, status and retries of the last attempt in the access log but got %q", line)
+	}
+	if d, err := time.ParseDuration(fields["latency"]); err != nil || d <= 0 {
+		t.Errorf("Expected the latency in the access log but got %q", line)
+	}
+}
+
+// TestJSONLogFormat tests that access logs are written as JSON objects with their fields when the log
+// format is json.
+func TestJSONLogFormat(t *testing.T) {
+	var buf strings.Builder
+	logOutput = &buf
+	LogFormat = LogFormatJSON
+	defer func() {
+		logOutput = os.Stdout
+		LogFormat = LogFormatText
+	}()
+
+	entry := newAccessLogEntry(httptest.NewRequest("GET", "http://localhost/hello", nil))
+	entry.Backend = "http://localhost:9000"
+	entry.finish(http.StatusOK)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(buf.String()), &line); err != nil {
+		t.Fatalf("Expected a JSON log line but got %q: %s", buf.String(), err)
+	}
+	if line["level"] != "info" || line["msg"] != "GET /hello" || line["backend"] != "http://localhost:9000" {
+		t.Errorf("Unexpected level, msg or backend in the log line: %v", line)
+	}
+	if line["status"] != float64(http.StatusOK) {
+		t.Errorf("Expected a status of 200 in the log line but got %v", line["status"])
+	}
+	if _, ok := line["latency_ms"].(float64); !ok {
+		t.Errorf("Expected a latency_ms number in the log line but got %v", line["latency_ms"])
+	}
+}
+
+// TestTracing tests that a proxied request gets a root span with child spans for the selection and the
+// attempt, and that the trace context is propagated to the target server.
+func TestTracing(t *testing.T) {
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defaultTracer, defaultPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		tracer = defaultTracer
+		otel.SetTextMapPropagator(defaultPropagator)
+	}()
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+
+	var names = make(map[string]bool)
+	var traceID string
+	for _, span := range exporter.GetSpans() {
+		names[span.Name] = true
+		if span.Name == "loadbalancer.request" {
+			traceID = span.SpanContext.TraceID().String()
+		}
+	}
+	for _, name := range []string{"loadbalancer.request", "loadbalancer.select", "loadbalancer.attempt"} {
+		if !names[name] {
+			t.Errorf("Expected a %s span but got %v", name, names)
+		}
+	}
+	if traceID == "" || !strings.Contains(traceparent, traceID) {
+		t.Errorf("Expected the target server to get a traceparent for trace %s but got %q", traceID, traceparent)
+	}
+}
+
+// TestForwardedHeaders tests that the forwarding headers are added to a redirected request.
+func TestForwardedHeaders(t *testing.T) {
+	server, err := NewTargetServer("http://localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://example.com/path", nil)
+	r.RemoteAddr = "10.0.0.2:5555"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	redirectRequestToServer(r, server)
+
+	var expected = map[string]string{
+		"X-Forwarded-For":   "10.0.0.1, 10.0.0.2",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "http",
+	}
+	for k, v := range expected {
+		if got := r.Header.Get(k); got != v {
+			t.Errorf("Expected header %s to be %q but got %q", k, v, got)
+		}
+	}
+}
+
+// TestRequestID tests that a request ID is generated for the requests that don't have one, and that it
+// reaches the target server and comes back to the client, while the ID of a client is kept as is.
+func TestRequestID(t *testing.T) {
+	var received atomic.Value
+	backend := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Store(r.Header.Get("X-Request-ID"))
+		// Echoing the ID back shouldn't duplicate it in the response
+		w.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+	}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	id := w.Header().Values("X-Request-ID")
+	if len(id) != 1 || len(id[0]) != 32 {
+		t.Fatalf("Expected a generated request ID of 32 characters in the response but got %q", id)
+	}
+	if got := received.Load(); got != id[0] {
+		t.Errorf("Expected the target server to get the request ID %s but got %q", id[0], got)
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set("X-Request-ID", "client-id-1")
+	w = httptest.NewRecorder()
+	lb.ServeHTTP(w, req)
+	if got := w.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != "client-id-1" {
+		t.Errorf("Expected the request ID of the client to be echoed back but got %q", got)
+	}
+	if got := received.Load(); got != "client-id-1" {
+		t.Errorf("Expected the target server to get the request ID of the client but got %q", got)
+	}
+}
+
+// TestRewritePath tests that the base path of the server address, StripPrefix and AddPrefix are
+// combined into the forwarded path, regardless of leading and trailing slashes.
+func TestRewritePath(t *testing.T) {
+	var cases = []struct {
+		address, strip, add, path, expected string
+	}{
+		{"http://localhost:9000", "", "", "/users", "/users"},
+		{"http://localhost:9000/api", "", "", "/users", "/api/users"},
+		{"http://localhost:9000/api/", "", "", "/users", "/api/users"},
+		{"http://localhost:9000", "/service", "", "/service/users", "/users"},
+		{"http://localhost:9000", "/service/", "", "/service/users/", "/users/"},
+		{"http://localhost:9000", "/service", "", "/service", "/"},
+		{"http://localhost:9000", "/service", "", "/services/users", "/services/users"},
+		{"http://localhost:9000", "", "/v1", "/users", "/v1/users"},
+		{"http://localhost:9000", "", "/v1/", "/users", "/v1/users"},
+		{"http://localhost:9000", "", "/", "/users", "/users"},
+		{"http://localhost:9000/api", "/service", "/v1", "/service/users", "/api/v1/users"},
+		{"http://localhost:9000/api", "/service", "/v1", "/service", "/api/v1/"},
+	}
+	for _, c := range cases {
+		server, err := NewTargetServerFromConfig(BackendConfig{Address: c.address, StripPrefix: c.strip, AddPrefix: c.add})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "http://example.com"+c.path, nil)
+		redirectRequestToServer(r, server)
+		if r.URL.Path != c.expected {
+			t.Errorf("%s (strip %q, add %q): expected %s to be forwarded as %s but got %s",
+				c.address, c.strip, c.add, c.path, c.expected, r.URL.Path)
+		}
+	}
+}
+
+// TestRewriteLocation tests that the redirects to the target server are rewritten to the load balancer,
+// with their path mapped back to the one of the client, while redirects to other hosts are left alone.
+func TestRewriteLocation(t *testing.T) {
+	var cases = []struct {
+		address, strip, location, expected string
+	}{
+		{"http://backend:9000", "", "http://backend:9000/login", "http://lb.example.com/login"},
+		{"http://backend:9000", "", "http://BACKEND:9000/login?next=%2F", "http://lb.example.com/login?next=%2F"},
+		{"http://backend", "", "http://backend:80/login", "http://lb.example.com/login"},
+		{"http://backend:9000", "", "http://backend:9001/login", "http://backend:9001/login"},
+		{"http://backend:9000", "", "https://accounts.example.org/login", "https://accounts.example.org/login"},
+		{"http://backend:9000/api", "/service", "http://backend:9000/api/login", "http://lb.example.com/service/login"},
+		{"http://backend:9000/api", "/service", "/api/login", "/service/login"},
+		{"http://backend:9000/api", "", "/elsewhere", "/elsewhere"},
+		{"http://backend:9000", "", "login", "login"},
+	}
+	for _, c := range cases {
+		server, err := NewTargetServerFromConfig(BackendConfig{Address: c.address, StripPrefix: c.strip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{"Location": {c.location}}
+		rewriteLocation(h, http.StatusFound, httptest.NewRequest("GET", "http://lb.example.com/", nil), server)
+		if got := h.Get("Location"); got != c.expected {
+			t.Errorf("%s (strip %q): expected %s to be rewritten to %s but got %s", c.address, c.strip, c.location, c.expected, got)
+		}
+	}
+
+	// Through the load balancer, only with -rewrite-location
+	var backend *fakeBackend
+	backend = newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, backend.URL+"/login", http.StatusFound)
+	}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+	for _, rewrite := range []bool{false, true} {
+		RewriteLocation = rewrite
+		expected := backend.URL + "/login"
+		if rewrite {
+			expected = "http://lb.example.com/login"
+		}
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://lb.example.com/account", nil))
+		if got := w.Header().Get("Location"); w.Code != http.StatusFound || got != expected {
+			t.Errorf("Rewrite %t: expected a 302 to %s but got %d to %s", rewrite, expected, w.Code, got)
+		}
+	}
+	RewriteLocation = false
+}
+
+// TestDebugHeaders tests that the responses are tagged with the target server that served them and the
+// number of retries only when the debug headers are turned on.
+func TestDebugHeaders(t *testing.T) {
+	failing := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	working := newFakeBackend(nil)
+	defer working.Close()
+
+	defer func() {
+		DebugHeaders = false
+	}()
+
+	for _, debug := range []bool{false, true} {
+		DebugHeaders = debug
+		testPool, err := NewServerPool(ServerAddresses{failing.URL, working.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.Stop()
+		lb := &LoadBalancer{Pool: testPool}
+
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 once retried but got %d", w.Code)
+		}
+		backend, retries := w.Header().Get("X-LB-Backend"), w.Header().Get("X-LB-Retries")
+		if !debug && (backend != "" || retries != "") {
+			t.Errorf("Expected no debug headers when they are off but got %q and %q", backend, retries)
+		}
+		if debug && (backend != working.URL || retries != "1") {
+			t.Errorf("Expected the response to be tagged with %s after 1 retry but got %q and %q", working.URL, backend, retries)
+		}
+	}
+}
+
+// TestShadowTraffic tests that requests are mirrored to the shadow target server along with their body,
+// without the client waiting for the shadow response.
+func TestShadowTraffic(t *testing.T) {
+	primary := newFakeBackend(nil)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(b)
+	}))
+	defer shadow.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{primary.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	lb := &LoadBalancer{Pool: testPool}
+	ShadowAddress = shadow.URL
+	defer func() {
+		ShadowAddress = ""
+		initShadow()
+	}()
+	if err := initShadow(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/orders", strings.NewReader("order=1")))
+	if w.Code != http.StatusOK || w.Body.String() != "OK" {
+		t.Errorf("Expected the primary response but got %d: %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("Expected the client not to wait for the shadow target server but it took %s", elapsed)
+	}
+
+	select {
+	case got := <-mirrored:
+		if got != "POST /orders order=1" {
+			t.Errorf("Expected the shadow target server to get a copy of the request but got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be mirrored to the shadow target server")
+	}
+}
+
+// TestCanary tests that the canary pool gets its percentage of the requests, that the percentage can be
+// changed through the admin API, and that the requests stay on the main pool while the canary is down.
+func TestCanary(t *testing.T) {
+	mainBackends, mainPool := newFakeBackendPool(t, 1)
+	canaryBackends, canaryAddrs := startFakeBackends(1)
+	defer canaryBackends[0].Close()
+	c, err := NewCanary(backendConfigsFromAddresses(canaryAddrs), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Pool.Stop()
+	c.Pool.RunHealthCheck()
+	lb := &LoadBalancer{Pool: mainPool, Canary: c}
+
+	handler, admin := lb.Handler(), lb.AdminHandler()
+	send := func(n int) (toMain, toCanary int64) {
+		mainHits, canaryHits := mainBackends[0].hits.Load(), canaryBackends[0].hits.Load()
+		for i := 0; i < n; i++ {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected a 200 but got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		return mainBackends[0].hits.Load() - mainHits, canaryBackends[0].hits.Load() - canaryHits
+	}
+	setPercent := func(v string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/canary?percent="+v, nil))
+		return w.Code
+	}
+
+	if _, toCanary := send(50); toCanary != 0 {
+		t.Errorf("Expected no requests to the canary at 0%% but got %d", toCanary)
+	}
+
+	if code := setPercent("100"); code != http.StatusOK {
+		t.Fatalf("Expected a 200 when setting the percentage but got %d", code)
+	}
+	if toMain, _ := send(50); toMain != 0 {
+		t.Errorf("Expected all the requests to go to the canary at 100%% but %d went to the main pool", toMain)
+	}
+
+	if code := setPercent("50"); code != http.StatusOK {
+		t.Fatalf("Expected a 200 when setting the percentage but got %d", code)
+	}
+	if _, toCanary := send(400); toCanary < 120 || toCanary > 280 {
+		t.Errorf("Expected about half the requests to go to the canary at 50%% but got %d of 400", toCanary)
+	}
+
+	for _, v := range []string{"-1", "101", "abc"} {
+		if code := setPercent(v); code != http.StatusBadRequest {
+			t.Errorf("Expected a 400 when setting the percentage to %s but got %d", v, code)
+		}
+	}
+	if got := c.Percent(); got != 50 {
+		t.Errorf("Expected the percentage to stay at 50 but got %g", got)
+	}
+
+	setPercent("100")
+	canaryBackends[0].SetHealthy(false)
+	c.Pool.RunHealthCheck()
+	if _, toCanary := send(20); toCanary != 0 {
+		t.Errorf("Expected no requests to the canary while it is down but got %d", toCanary)
+	}
+}
+
+// TestViaAndUserAgent tests that the Via header and the default User-Agent are only set when enabled,
+// and never replace what the client sent.
+func TestViaAndUserAgent(t *testing.T) {
+	server, err := NewTargetServer("http://localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		AddViaHeader = false
+		DefaultUserAgent = ""
+	}()
+
+	r := httptest.NewRequest("GET", "http://example.com/path", nil)
+	redirectRequestToServer(r, server)
+	if ua, ok := r.Header["User-Agent"]; !ok || ua[0] != "" || r.Header.Get("Via") != "" {
+		t.Errorf("Expected an empty User-Agent and no Via header by default, but got %v", r.Header)
+	}
+
+	AddViaHeader = true
+	DefaultUserAgent = "lb-client/1.0"
+	r = httptest.NewRequest("GET", "http://example.com/path", nil)
+	r.Header.Set("Via", "1.0 edge")
+	redirectRequestToServer(r, server)
+	if via := r.Header.Get("Via"); via != "1.0 edge, 1.1 teejays-lb" {
+		t.Errorf("Expected the load balancer to be appended to the Via header but got %q", via)
+	}
+	if ua := r.Header.Get("User-Agent"); ua != DefaultUserAgent {
+		t.Errorf("Expected the default User-Agent %q but got %q", DefaultUserAgent, ua)
+	}
+
+	r = httptest.NewRequest("GET", "http://example.com/path", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	redirectRequestToServer(r, server)
+	if ua := r.Header.Get("User-Agent"); ua != "curl/8.0" {
+		t.Errorf("Expected the User-Agent of the client to be kept but got %q", ua)
+	}
+}
+
+// TestNagiosCheck tests that the Nagios state reflects how many of the servers are healthy.
+func TestNagiosCheck(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+
+	if _, state := nagiosCheck(testPool.Stats()); state != NagiosOK {
+		t.Errorf("Expected state OK but got %s", nagiosStateNames[state])
+	}
+
+	testPool.Servers[0].Degrade()
+	if _, state := nagiosCheck(testPool.Stats()); state != NagiosWarning {
+		t.Errorf("Expected state WARNING but got %s", nagiosStateNames[state])
+	}
+
+	testPool.DegradeAll()
+	if _, state := nagiosCheck(testPool.Stats()); state != NagiosCritical {
+		t.Errorf("Expected state CRITICAL but got %s", nagiosStateNames[state])
+	}
+}
+
+// TestNagiosCheckCommand tests that the check subcommand gets the state from the Nagios endpoint of the
+// admin server, which its default URL points to.
+func TestNagiosCheckCommand(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+	lb := &LoadBalancer{Pool: testPool}
+	admin := httptest.NewServer(lb.AdminHandler())
+	defer admin.Close()
+
+	w := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", nagiosCheckURLDefault, nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "LB OK ") {
+		t.Errorf("Expected the default check URL to reach the Nagios endpoint but got %d: %s", w.Code, w.Body.String())
+	}
+
+	url := admin.URL + "/nagios"
+	if state := runCheckCommand([]string{"-url", url}); state != NagiosOK {
+		t.Errorf("Expected state OK but got %s", nagiosStateNames[state])
+	}
+	testPool.Servers[0].Degrade()
+	if state := runCheckCommand([]string{"-url", url}); state != NagiosWarning {
+		t.Errorf("Expected state WARNING but got %s", nagiosStateNames[state])
+	}
+	testPool.DegradeAll()
+	if state := runCheckCommand([]string{"-url", url}); state != NagiosCritical {
+		t.Errorf("Expected state CRITICAL but got %s", nagiosStateNames[state])
+	}
+}
+
+// TestNagiosCheckCommandAuth tests that the check subcommand sends the credentials it is given to an
+// admin API behind basic auth.
+func TestNagiosCheckCommandAuth(t *testing.T) {
+	AdminUser, AdminPassword = "admin", "s3cret"
+	defer func() {
+		AdminUser, AdminPassword = "", ""
+	}()
+	lb := &LoadBalancer{Pool: newTestPool(t, 1)}
+	admin := httptest.NewServer(lb.AdminHandler())
+	defer admin.Close()
+
+	var cases = []struct {
+		args     []string
+		expected int
+	}{
+		{nil, NagiosUnknown},
+		{[]string{"-user", "admin", "-pass", "wrong"}, NagiosUnknown},
+		{[]string{"-user", "admin", "-pass", "s3cret"}, NagiosOK},
+	}
+	for _, c := range cases {
+		args := append([]string{"-url", admin.URL + "/nagios"}, c.args...)
+		if state := runCheckCommand(args); state != c.expected {
+			t.Errorf("Expected state %s with %v but got %s", nagiosStateNames[c.expected], c.args, nagiosStateNames[state])
+		}
+	}
+}
+
+// TestPoolStats tests that Stats counts the servers by health, and returns a copy of their state.
+func TestPoolStats(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1, 1)
+	testPool.Servers[1].Degrade()
+	testPool.Servers[2].SetStatus(StatusUnknown)
+	testPool.Servers[3].SetDraining(true)
+	testPool.AddLoad(testPool.Servers[0], 3)
+
+	stats := testPool.Stats()
+	if stats.Total != 4 || stats.Healthy != 2 || stats.Degraded != 1 || stats.Unknown != 1 || stats.Selectable != 1 {
+		t.Errorf("Unexpected counts in the pool stats: %+v", stats)
+	}
+	if stats.Servers[0].Load != 3 || stats.Servers[0].Address != testPool.Servers[0].Address {
+		t.Errorf("Expected the first server to have a load of 3, got %+v", stats.Servers[0])
+	}
+
+	stats.Servers[0].Load = 100
+	if testPool.Servers[0].Load != 3 {
+		t.Error("Expected the pool to be unaffected by changes to its stats")
+	}
+}
+
+// countingTransport counts the requests it sends through the default transport.
+type countingTransport struct {
+	sync.Mutex
+	count int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.Lock()
+	c.count++
+	c.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// TestBackendTransport tests that the keep-alive settings are applied to the shared backend transport,
+// and that a pool with a transport of its own uses it instead.
+func TestBackendTransport(t *testing.T) {
+	defaultTransport := backendTransport
+	defer func() { backendTransport = defaultTransport }()
+
+	initBackendTransport()
+	base, ok := backendTransport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected the backend transport to be a *http.Transport but got %T", backendTransport)
+	}
+	if base.MaxIdleConns != BackendMaxIdleConns || base.MaxIdleConnsPerHost != BackendMaxIdleConnsPerHost || base.IdleConnTimeout != BackendIdleConnTimeout {
+		t.Errorf("Expected the keep-alive settings to be applied to the backend transport")
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	transport := &countingTransport{}
+	testPool.Transport = transport
+	lb := &LoadBalancer{Pool: testPool}
+
+	lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+	if transport.count != 1 {
+		t.Errorf("Expected the request to go through the transport of the pool, but it sent %d requests", transport.count)
+	}
+}
+
+// TestBackendNoKeepAlive tests that every request gets a new connection to the target server when
+// keep-alive is disabled.
+func TestBackendNoKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	var conns = make(map[string]bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+	}))
+	defer backend.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	defaultTransport := backendTransport
+	lb := &LoadBalancer{Pool: testPool}
+	defer func() {
+		backendTransport = defaultTransport
+		BackendNoKeepAlive = false
+	}()
+
+	for _, noKeepAlive := range []bool{false, true} {
+		BackendNoKeepAlive = noKeepAlive
+		initBackendTransport()
+		conns = make(map[string]bool)
+		for i := 0; i < 3; i++ {
+			lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/", nil))
+		}
+		expected := 1
+		if noKeepAlive {
+			expected = 3
+		}
+		if len(conns) != expected {
+			t.Errorf("No keep-alive %t: expected %d connections for 3 requests but got %d", noKeepAlive, expected, len(conns))
+		}
+	}
+}
+
+// TestOutlierEjection tests that a server is ejected once its error rate goes over the threshold, for
+// longer every time up to the cap, regardless of its health.
+func TestOutlierEjection(t *testing.T) {
+	defer func() { OutlierErrorRate, OutlierMinRequests, OutlierEjectionTime = 0, 10, 30*time.Second }()
+	OutlierErrorRate, OutlierMinRequests, OutlierEjectionTime = 0.5, 4, 2*time.Minute
+
+	server, err := NewTargetServer("http://localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetStatus(StatusHealthy)
+
+	now := time.Now()
+	fail := func(at time.Time, n int) (ejected bool) {
+		for i := 0; i < n; i++ {
+			ejected = server.observeOutcome(at, http.StatusBadGateway) || ejected
+		}
+		return ejected
+	}
+
+	server.observeOutcome(now, http.StatusOK)
+	server.observeOutcome(now, http.StatusOK)
+	if fail(now, 1) {
+		t.Error("Expected no ejection under the minimum number of requests")
+	}
+	if !fail(now, 1) || !server.IsEjected(now) || !server.IsHealthy() {
+		t.Fatal("Expected the healthy server to be ejected at an error rate of 0.5")
+	}
+	if server.IsEjected(now.Add(OutlierEjectionTime)) {
+		t.Error("Expected the first ejection to last OutlierEjectionTime")
+	}
+
+	// Ejections in a row last longer every time, up to the cap
+	at, previous := now, OutlierEjectionTime
+	for i, expected := range []time.Duration{2 * OutlierEjectionTime, OutlierMaxEjectionTime} {
+		at = at.Add(previous + time.Minute)
+		previous = expected
+		if !fail(at, 4) {
+			t.Fatalf("Expected ejection %d", i+2)
+		}
+		if !server.IsEjected(at.Add(expected-time.Second)) || server.IsEjected(at.Add(expected)) {
+			t.Errorf("Expected ejection %d to last %s", i+2, expected)
+		}
+	}
+}
+
+// TestSlowEjection tests that a server is ejected after enough slow responses in a row, that a fast
+// response in between starts the count over, and that the server is back after the ejection time.
+func TestSlowEjection(t *testing.T) {
+	defer func() { SlowThreshold, SlowConsecutive = 0, 5 }()
+	SlowThreshold, SlowConsecutive = 100*time.Millisecond, 3
+
+	server, err := NewTargetServer("http://localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetStatus(StatusHealthy)
+
+	now := time.Now()
+	slow := func(n int) (ejected bool) {
+		for i := 0; i < n; i++ {
+			ejected = server.observeLatency(now, time.Second) || ejected
+		}
+		return ejected
+	}
+
+	if slow(2) {
+		t.Error("Expected no ejection under the number of slow responses in a row")
+	}
+	server.observeLatency(now, 10*time.Millisecond)
+	if slow(2) {
+		t.Error("Expected a fast response to start the count of slow responses over")
+	}
+	if !slow(1) || !server.IsEjected(now) || server.IsSelectable() {
+		t.Fatal("Expected the server to be ejected, and not picked, after 3 slow responses in a row")
+	}
+	if slow(3) {
+		t.Error("Expected the slow responses in flight during an ejection not to eject the server again")
+	}
+	if server.IsEjected(now.Add(SlowEjectionTime)) {
+		t.Error("Expected the server to be back after the ejection time")
+	}
+}
+
+// TestRetryAfter tests that a server that responds with a 503 and a Retry-After header is left alone
+// for that long, and that the request is retried with another server.
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var cases = map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+		"86400":                         RetryAfterMax,
+		"99999999999":                   RetryAfterMax,
+		"0":                             0,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"soon":                          0,
+	}
+	for v, expected := range cases {
+		if d, _ := parseRetryAfter(v, now); d != expected {
+			t.Errorf("Retry-After %q: expected %s but got %s", v, expected, d)
+		}
+	}
+
+	var mu sync.Mutex
+	var busyHits int
+	busy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			w.Write([]byte(`{"State": "healthy"}`))
+			return
+		}
+		mu.Lock()
+		busyHits++
+		mu.Unlock()
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer busy.Close()
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idle.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{busy.URL, idle.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected the request to be retried with the idle server, but got %d", w.Code)
+		}
+	}
+	if busyHits != 1 || !testPool.Servers[0].IsBackingOff(time.Now()) {
+		t.Errorf("Expected the busy server to be left alone after its first 503, but it got %d requests", busyHits)
+	}
+}
+
+// TestConnectionRefusedRetry tests that a server that is marked healthy but refuses connections is
+// degraded, and that the request is retried with another server.
+func TestConnectionRefusedRetry(t *testing.T) {
+	down := newFakeBackend(nil)
+	up := newFakeBackend(nil)
+	defer up.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{down.URL, up.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.RunHealthCheck()
+	down.Close()
+	lb := &LoadBalancer{Pool: testPool}
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected the request to be retried with the server that is up, but got %d", w.Code)
+		}
+	}
+	if testPool.Servers[0].IsHealthy() {
+		t.Error("Expected the server that refuses connections to be degraded")
+	}
+	if up.hits.Load() != 2 {
+		t.Errorf("Expected the server that is up to get both requests but it got %d", up.hits.Load())
+	}
+
+	// A request that can't be retried still gets an error
+	testPool.HealthyAll()
+	testPool.Servers[1].Degrade()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/", strings.NewReader("order=1")))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a 502 for a POST to the server that refuses connections but got %d", w.Code)
+	}
+}
+
+// TestClientCanceled tests that a request that the client cancels midway is logged as a 499, and is
+// neither retried nor held against the health of the target server.
+func TestClientCanceled(t *testing.T) {
+	started := make(chan struct{}, 1)
+	slow := newFakeBackend(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	other := newFakeBackend(nil)
+	defer other.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{slow.URL, other.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.RunHealthCheck()
+	testPool.Servers[1].Degrade()
+	lb := &LoadBalancer{Pool: testPool}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil).WithContext(ctx))
+
+	if w.Code != StatusClientClosedRequest {
+		t.Errorf("Expected a %d status code but got %d", StatusClientClosedRequest, w.Code)
+	}
+	if !testPool.Servers[0].IsHealthy() {
+		t.Error("Expected the target server to stay healthy when the client cancels")
+	}
+	if stats := testPool.Servers[0].ResponseStats(); stats.Requests != 0 {
+		t.Errorf("Expected the canceled request not to be recorded against the target server but got %+v", stats)
+	}
+	if slow.hits.Load() != 1 {
+		t.Errorf("Expected the canceled request not to be retried but it was sent %d times", slow.hits.Load())
+	}
+}
+
+// TestH2StreamLimiter tests that requests to an HTTP/2 server, over TLS or h2c, are spread over
+// additional connections once the streams on a connection are saturated, and that the requests to an
+// HTTP/1.1 server are left alone.
+func TestH2StreamLimiter(t *testing.T) {
+	var h2c http.Protocols
+	h2c.SetUnencryptedHTTP2(true)
+
+	var cases = []struct {
+		name       string
+		http2      bool
+		h2c        bool
+		maxStreams int
+	}{
+		{"h2", true, false, 1},
+		{"h2c", false, true, 1},
+		{"http/1.1", false, false, 3},
+	}
+	for _, c := range cases {
+		var mu sync.Mutex
+		var conns = make(map[string]bool)
+		var unblock = make(chan struct{})
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/probe" {
+				return
+			}
+			mu.Lock()
+			conns[r.RemoteAddr] = true
+			mu.Unlock()
+			<-unblock
+		}))
+		var base *http.Transport
+		if c.h2c {
+			srv.Config.Protocols = &h2c
+			srv.Start()
+			base = http.DefaultTransport.(*http.Transport).Clone()
+			base.Protocols = &h2c
+		} else {
+			srv.EnableHTTP2 = c.http2
+			srv.StartTLS()
+			base = srv.Client().Transport.(*http.Transport).Clone()
+		}
+		limiter := newH2StreamLimiter(base, c.maxStreams)
+
+		// The first response tells the limiter which protocol the server speaks
+		probe := httptest.NewRequest("GET", srv.URL+"/probe", nil)
+		probe.RequestURI = ""
+		resp, err := limiter.RoundTrip(probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", srv.URL, nil)
+				req.RequestURI = ""
+				resp, err := limiter.RoundTrip(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			}()
+		}
+
+		// Wait for all the requests to reach the server
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			n := len(conns)
+			mu.Unlock()
+			if n == 3 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		close(unblock)
+		wg.Wait()
+		srv.Close()
+
+		if len(conns) != 3 {
+			t.Errorf("%s: expected requests over 3 connections but got %d", c.name, len(conns))
+		}
+		lanes := len(limiter.lanes[srv.Listener.Addr().String()])
+		if c.http2 || c.h2c {
+			if lanes != 1 {
+				t.Errorf("%s: expected the extra connections to be closed, leaving 1 lane, but got %d", c.name, lanes)
+			}
+		} else if lanes != 0 {
+			t.Errorf("%s: expected the requests to an HTTP/1.1 server to skip the lanes but got %d", c.name, lanes)
+		}
+	}
+}
+
+// TestLoadConfig tests that both YAML and JSON config files can be loaded, and that invalid configs
+// are rejected with an error naming the offending field.
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	yamlPath := write("lb.yaml", `
+port: 8080
+health_interval: 5s
+backends:
+  - address: http://localhost:9000
+    weight: 3
+  - address: http://localhost:9001
+    weight: 0
+    health_path: /status
+    health_interval: 30s
+`)
+	jsonPath := write("lb.json", `{
+		"port": 8080,
+		"health_interval": "5s",
+		"backends": [
+			{"address": "http://localhost:9000", "weight": 3},
+			{"address": "http://localhost:9001", "weight": 0, "health_path": "/status", "health_interval": "30s"}
+		]
+	}`)
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if cfg.Port != 8080 || time.Duration(cfg.HealthInterval) != 5*time.Second || len(cfg.Backends) != 2 {
+			t.Errorf("%s: config not loaded as expected: %+v", path, cfg)
+		}
+
+		server, err := NewTargetServerFromConfig(cfg.Backends[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Settings().Weight != 0 || server.Settings().HealthEndpoint != "status" || server.Settings().HealthCheckInterval != 30*time.Second {
+			t.Errorf("%s: expected weight 0, health endpoint status and health interval 30s but got %d, %s and %s",
+				path, server.Settings().Weight, server.Settings().HealthEndpoint, server.Settings().HealthCheckInterval)
+		}
+	}
+
+	var invalid = map[string]string{
+		"backends[1].weight":                   "backends:\n  - address: http://localhost:9000\n  - address: http://localhost:9001\n    weight: -1\n",
+		"backends[0].address":                  "backends:\n  - weight: 2\n",
+		"port":                                 "port: 70000\n",
+		"backends[0].strip_prefix":             "backends:\n  - address: http://localhost:9000\n    strip_prefix: service\n",
+		"backends[0].unhealthy_threshold":      "backends:\n  - address: http://localhost:9000\n    unhealthy_threshold: -2\n",
+		"backends[0].health_interval":          "backends:\n  - address: http://localhost:9000\n    health_interval: -5s\n",
+		"backends[0].health_expect.json_field": "backends:\n  - address: http://localhost:9000\n    health_expect:\n      json_value: ok\n",
+		"backends[0].tier":                     "backends:\n  - address: http://localhost:9000\n    tier: spare\n",
+		"backends[0].max_conns":                "backends:\n  - address: http://localhost:9000\n    max_conns: -1\n",
+	}
+	for field, content := range invalid {
+		_, err := LoadConfig(write("invalid.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected an error naming %s but got %v", field, err)
+		}
+	}
+}
+
+// TestMaintenanceWindow tests that servers are taken out of rotation during their maintenance window,
+// including windows that go over midnight.
+func TestMaintenanceWindow(t *testing.T) {
+	testPool := newTestPool(t, 1, 1)
+	windows := []*MaintenanceWindow{{Start: "02:00", End: "03:00"}, {Start: "23:30", End: "00:30"}}
+	for i, s := range testPool.Servers {
+		if err := windows[i].parse(); err != nil {
+			t.Fatal(err)
+		}
+		s.UpdateSettings(func(settings *ServerSettings) { settings.Maintenance = windows[i] })
+	}
+
+	var cases = []struct {
+		clock    string
+		expected []bool
+	}{
+		{"01:59", []bool{false, false}},
+		{"02:00", []bool{true, false}},
+		{"02:59", []bool{true, false}},
+		{"03:00", []bool{false, false}},
+		{"23:45", []bool{false, true}},
+		{"00:15", []bool{false, true}},
+		{"00:30", []bool{false, false}},
+	}
+	for _, c := range cases {
+		now, err := time.ParseInLocation("15:04", c.clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testPool.UpdateMaintenance(now)
+		for i, s := range testPool.Servers {
+			if s.IsInMaintenance() != c.expected[i] {
+				t.Errorf("At %s, expected server %d to have maintenance %t", c.clock, i, c.expected[i])
+			}
+			if s.IsSelectable() == c.expected[i] {
+				t.Errorf("At %s, expected server %d to have selectable %t", c.clock, i, !c.expected[i])
+			}
+		}
+	}
+}
+
+// TestMaintenanceMode tests that all requests get the maintenance page while maintenance mode is on,
+// and go through again once it is turned off.
+func TestMaintenanceMode(t *testing.T) {
+	MaintenancePageFile = filepath.Join(t.TempDir(), "maintenance.html")
+	if err := ioutil.WriteFile(MaintenancePageFile, []byte("<h1>Back soon</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaultPage, defaultContentType := maintenancePage, maintenanceContentType
+	defer func() {
+		MaintenancePageFile = ""
+		maintenancePage, maintenanceContentType = defaultPage, defaultContentType
+	}()
+	if err := initMaintenanceMode(); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := &LoadBalancer{Pool: sharedPool}
+	handler, admin := lb.Handler(), lb.AdminHandler()
+	toggle := func(on string) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/maintenance?on="+on, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected a 200 when turning maintenance mode %s but got %d", on, w.Code)
+		}
+	}
+
+	toggle("true")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("Expected the maintenance page with a 503 but got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected an HTML content type but got %s", ct)
+	}
+
+	toggle("false")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+	if w.Code == http.StatusServiceUnavailable && w.Body.String() == "<h1>Back soon</h1>" {
+		t.Error("Expected requests to go through once maintenance mode is off")
+	}
+}
+
+// TestErrorPage tests that the error page is served to clients that accept its content type when no
+// server is healthy, and that other clients keep getting the plain text error.
+func TestErrorPage(t *testing.T) {
+	ErrorPageFile = filepath.Join(t.TempDir(), "error.html")
+	if err := ioutil.WriteFile(ErrorPageFile, []byte("<h1>Oops</h1>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ErrorPageFile = ""
+		errorPage, errorPageContentType = nil, ""
+	}()
+	if err := initErrorPage(); err != nil {
+		t.Fatal(err)
+	}
+
+	testPool := newTestPool(t, 1, 1)
+	testPool.DegradeAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	var cases = []struct {
+		accept      string
+		contentType string
+	}{
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html"},
+		{"text/*", "text/html"},
+		{"*/*", "text/plain"},
+		{"application/json", "text/plain"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.Header.Set("Accept", c.accept)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Accept %s: expected a 503 but got %d", c.accept, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, c.contentType) {
+			t.Errorf("Accept %s: expected the content type %s but got %s", c.accept, c.contentType, ct)
+		}
+	}
+}
+
+// TestReconcile tests that reconciling the pool with a new list of servers adds and removes servers,
+// while the servers that stay keep their state.
+func TestReconcile(t *testing.T) {
+	testPool := newTestPool(t, 1, 1, 1)
+	kept := testPool.Servers[1]
+	kept.Load = 7
+
+	weight := 5
+	added, removed, err := testPool.Reconcile([]BackendConfig{
+		{Address: kept.Address, Weight: &weight},
+		{Address: "http://localhost:9950"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(added) != 1 || added[0] != "http://localhost:9950" {
+		t.Errorf("Expected http://localhost:9950 to be added but got %v", added)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 servers to be removed but got %v", removed)
+	}
+	if len(testPool.Servers) != 2 || testPool.Servers[0] != kept {
+		t.Fatalf("Expected the kept server to be the same instance at index 0")
+	}
+	if !kept.IsHealthy() || kept.Load != 7 || kept.Settings().Weight != 5 {
+		t.Errorf("Expected the kept server to keep its state and get its new weight, but got %+v", kept)
+	}
+	if testPool.Servers[1].IsHealthy() {
+		t.Errorf("Expected the added server to not be healthy until it is checked")
+	}
+
+	// An invalid list should leave the pool untouched
+	_, _, err = testPool.Reconcile([]BackendConfig{{Address: "http://localhost:9951"}, {Address: "http://localhost:9951"}})
+	if err != ErrDuplicateServerAddress || len(testPool.Servers) != 2 {
+		t.Errorf("Expected %v and no change in the pool, but got %v", ErrDuplicateServerAddress, err)
+	}
+}
+
+// TestDNSBackends tests that a backend with Resolve set becomes a server for each of the addresses its
+// host name resolves to, and that the servers follow the addresses when they change, but stay as they
+// are when the name fails to resolve.
+func TestDNSBackends(t *testing.T) {
+	var lock sync.Mutex
+	var ips []string
+	var lookupErr error
+	setIPs := func(addrs []string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		ips, lookupErr = addrs, err
+	}
+	defaultLookupHost, defaultInterval := lookupHost, DNSRefreshInterval
+	defer func() {
+		lookupHost, DNSRefreshInterval = defaultLookupHost, defaultInterval
+	}()
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if host != "service.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return ips, lookupErr
+	}
+	DNSRefreshInterval = 20 * time.Millisecond
+
+	port := freePort(t)
+	address := func(ip string) string { return fmt.Sprintf("http://%s:%d/base", ip, port) }
+	addresses := func(p *ServerPool) []string {
+		var addrs []string
+		for _, s := range p.ServerList() {
+			addrs = append(addrs, s.Address)
+		}
+		return addrs
+	}
+	waitFor := func(p *ServerPool, expected ...string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for fmt.Sprint(addresses(p)) != fmt.Sprint(expected) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the servers %v but got %v", expected, addresses(p))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	setIPs([]string{"127.0.0.1", "127.0.0.2"}, nil)
+	weight := 3
+	testPool, err := NewServerPoolFromBackends([]BackendConfig{
+		{Address: fmt.Sprintf("http://service.test:%d/base", port), Resolve: true, Weight: &weight},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testPool.Stop()
+	waitFor(testPool, address("127.0.0.1"), address("127.0.0.2"))
+	if testPool.Servers[1].Settings().Weight != 3 {
+		t.Errorf("Expected the resolved servers to keep the settings of the backend but got weight %d", testPool.Servers[1].Settings().Weight)
+	}
+
+	setIPs([]string{"127.0.0.2", "127.0.0.3"}, nil)
+	waitFor(testPool, address("127.0.0.2"), address("127.0.0.3"))
+
+	setIPs(nil, errors.New("server misbehaving"))
+	time.Sleep(5 * DNSRefreshInterval)
+	waitFor(testPool, address("127.0.0.2"), address("127.0.0.3"))
+
+	// A name that doesn't resolve at all can't make a pool
+	_, err = NewServerPoolFromBackends([]BackendConfig{{Address: "http://unknown.test", Resolve: true}})
+	if err == nil {
+		t.Error("Expected an error for a backend that doesn't resolve")
+	}
+}
+
+// TestDNSBackendsTLS tests that an https server resolved to an IP address still gets its host name for
+// SNI and the verification of its certificate.
+func TestDNSBackendsTLS(t *testing.T) {
+	serverNames := make(chan string, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverNames <- hello.ServerName
+		return nil, nil
+	}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	defaultLookupHost := lookupHost
+	defer func() { lookupHost = defaultLookupHost }()
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"127.0.0.1"}, nil
+	}
+
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+	resolved, err := resolveBackends(context.Background(), []BackendConfig{
+		{Address: fmt.Sprintf("https://example.com:%d", port), Resolve: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewTargetServerFromConfig(resolved[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := fmt.Sprintf("https://127.0.0.1:%d", port); server.Address != expected {
+		t.Fatalf("Expected the server to have the address %s but got %s", expected, server.Address)
+	}
+	// Trust the certificate of the test server, which is for example.com
+	server.transport.(*http.Transport).TLSClientConfig.RootCAs = backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	resp, err := server.httpClient(backendTransport).Get(server.Address)
+	if err != nil {
+		t.Fatalf("Expected the request to the resolved https server to succeed but got: %s", err)
+	}
+	resp.Body.Close()
+	if name := <-serverNames; name != "example.com" {
+		t.Errorf("Expected the host name example.com to be sent for SNI but got %q", name)
+	}
+}
+
+// TestUnixSocketBackend tests that a target server listening on a Unix socket is health checked and
+// gets the requests over the socket.
+func TestUnixSocketBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix sockets are not available: %s", err)
+	}
+	backend := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/"+HealthEndpoint {
+				w.Write([]byte(`{"State": "healthy"}`))
+				return
+			}
+			fmt.Fprintf(w, "unix %s", r.URL.Path)
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	if _, err := NewTargetServer("unix://"); err != ErrEmptySocketPath {
+		t.Errorf("Expected an error for a unix address without a socket path but got %v", err)
+	}
+
+	testPool, err := NewServerPool(ServerAddresses{"unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.RunHealthCheck()
+	if server := testPool.Servers[0]; !server.IsHealthy() || server.SocketPath != path {
+		t.Fatalf("Expected the server on the socket %s to be healthy", path)
+	}
+
+	lb := &LoadBalancer{Pool: testPool}
+	w := httptest.NewRecorder()
+	lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/hello", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "unix /hello" {
+		t.Errorf("Expected the request to be served over the socket but got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestSRVBackends tests that an srv:// backend becomes a server for each of the targets of its SRV record
+// with the lowest priority, weighted like the records, and that a record without targets is an error.
+func TestSRVBackends(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "a.example.com.", Port: 8080, Priority: 10, Weight: 5},
+		{Target: "b.example.com.", Port: 8081, Priority: 10, Weight: 0},
+		{Target: "backup.example.com.", Port: 8080, Priority: 20, Weight: 1},
+	}
+	defaultLookupSRV := lookupSRV
+	defer func() { lookupSRV = defaultLookupSRV }()
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		switch name {
+		case "_http._tcp.service.test":
+			return name, records, nil
+		case "_http._tcp.down.test":
+			return name, []*net.SRV{{Target: "."}}, nil
+		}
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	backends, err := resolveBackends(context.Background(), []BackendConfig{
+		{Address: "srv://_http._tcp.service.test/base", HealthPath: "/status"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []struct {
+		address string
+		weight  int
+	}{
+		{"http://a.example.com:8080/base", 5},
+		{"http://b.example.com:8081/base", 1},
+	}
+	if len(backends) != len(expected) {
+		t.Fatalf("Expected %d backends but got %+v", len(expected), backends)
+	}
+	for i, e := range expected {
+		b := backends[i]
+		if b.Address != e.address || b.Weight == nil || *b.Weight != e.weight || b.HealthPath != "/status" {
+			t.Errorf("Expected backend %d to be %s with weight %d and the settings of the record, but got %+v", i, e.address, e.weight, b)
+		}
+	}
+
+	for _, address := range []string{"srv://_http._tcp.down.test", "srv://_http._tcp.unknown.test"} {
+		if _, err := resolveBackends(context.Background(), []BackendConfig{{Address: address}}); err == nil {
+			t.Errorf("Expected an error for %s", address)
+		}
+	}
+}
+
+// fakeDiscoverer is a Discoverer whose backends and updates are controlled by the tests.
+type fakeDiscoverer struct {
+	sync.Mutex
+	backends []BackendConfig
+	updates  chan struct{}
+}
+
+func (d *fakeDiscoverer) Discover(ctx context.Context) ([]BackendConfig, error) {
+	d.Lock()
+	defer d.Unlock()
+	return d.backends, nil
+}
+
+func (d *fakeDiscoverer) Updates(ctx context.Context) <-chan struct{} {
+	return d.updates
+}
+
+// update changes the backends of the discoverer and signals it to the pool.
+func (d *fakeDiscoverer) update(addrs ...string) {
+	d.Lock()
+	d.backends = backendConfigsFromAddresses(addrs)
+	d.Unlock()
+	d.updates <- struct{}{}
+}
+
+// TestDiscoverer tests that a pool follows the updates of its discoverer, until it is reconciled with a
+// static list of backends which then replaces the discoverer.
+func TestDiscoverer(t *testing.T) {
+	d := &fakeDiscoverer{backends: backendConfigsFromAddresses([]string{"http://localhost:9960"}), updates: make(chan struct{})}
+	testPool, err := NewServerPoolFromDiscoverer(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testPool.Stop()
+	testPool.HealthyAll()
+	kept := testPool.Servers[0]
+
+	// The update is only received once the previous one has been applied, so a second one waits for the first
+	d.update("http://localhost:9960", "http://localhost:9961")
+	d.update("http://localhost:9960", "http://localhost:9961")
+	servers := testPool.ServerList()
+	if len(servers) != 2 || servers[0] != kept || servers[1].Address != "http://localhost:9961" {
+		t.Fatalf("Expected the pool to follow the discoverer, keeping its server, but got %+v", servers)
+	}
+
+	if _, _, err := testPool.Reconcile(backendConfigsFromAddresses([]string{"http://localhost:9962"})); err != nil {
+		t.Fatal(err)
+	}
+	// The replaced discoverer is no longer watched, and an update it was about to deliver is dropped
+	d.Lock()
+	d.backends = backendConfigsFromAddresses([]string{"http://localhost:9963"})
+	d.Unlock()
+	select {
+	case d.updates <- struct{}{}:
+	case <-time.After(100 * time.Millisecond):
+	}
+	time.Sleep(50 * time.Millisecond)
+	if servers := testPool.ServerList(); len(servers) != 1 || servers[0].Address != "http://localhost:9962" {
+		t.Errorf("Expected the pool to have the reconciled servers but got %+v", servers)
+	}
+}
+
+// TestConsulDiscovery tests that a pool built from Consul gets a server for each of the healthy instances
+// of the service, and follows them as they change, keeping its servers while Consul has none.
+func TestConsulDiscovery(t *testing.T) {
+	var lock sync.Mutex
+	var instances string
+	setInstances := func(s string) {
+		lock.Lock()
+		defer lock.Unlock()
+		instances = s
+	}
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/v1/health/service/web" || q.Get("passing") != "true" || q.Get("tag") != "v2" || r.Header.Get("X-Consul-Token") != "secret" {
+			http.Error(w, "unexpected query "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprint(w, instances)
+	}))
+	defer consul.Close()
+
+	port := freePort(t)
+	instance := func(nodeAddress, serviceAddress string, weight int) string {
+		return fmt.Sprintf(`{"Node":{"Address":%q},"Service":{"ID":"web-1","Address":%q,"Port":%d,"Weights":{"Passing":%d}}}`,
+			nodeAddress, serviceAddress, port, weight)
+	}
+	address := func(ip string) string { return fmt.Sprintf("http://%s:%d", ip, port) }
+
+	setInstances("[" + instance("127.0.0.1", "", 3) + "," + instance("10.0.0.9", "127.0.0.2", 1) + "]")
+	d := &ConsulDiscoverer{Address: consul.URL, Service: "web", Tag: "v2", Token: "secret", Interval: 20 * time.Millisecond}
+	testPool, err := NewServerPoolFromDiscoverer(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testPool.Stop()
+
+	servers := testPool.ServerList()
+	if len(servers) != 2 || servers[0].Address != address("127.0.0.1") || servers[1].Address != address("127.0.0.2") {
+		t.Fatalf("Expected a server for each of the instances but got %+v", servers)
+	}
+	if servers[0].Settings().Weight != 3 {
+		t.Errorf("Expected the server to get the weight of its instance but got %d", servers[0].Settings().Weight)
+	}
+
+	setInstances("[" + instance("127.0.0.3", "", 1) + "]")
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		servers = testPool.ServerList()
+		if len(servers) == 1 && servers[0].Address == address("127.0.0.3") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the servers to follow the instances in Consul but got %+v", servers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	setInstances("[]")
+	time.Sleep(5 * d.Interval)
+	if servers = testPool.ServerList(); len(servers) != 1 {
+		t.Errorf("Expected the servers to be kept while Consul has no instances but got %+v", servers)
+	}
+}
+
+// TestEmptyPool tests that every algorithm returns a 503 instead of panicking once all the servers have
+// been removed from the pool, and that RoundRobin copes with a list that shrank under its index.
+func TestEmptyPool(t *testing.T) {
+	defaultAlgorithm := selectionAlgorithm
+	defer func() { selectionAlgorithm = defaultAlgorithm }()
+
+	for name, algo := range Algorithms {
+		testPool := newTestPool(t, 1, 1)
+		testPool.CurrentIndex = 1
+		if _, _, err := testPool.Reconcile(nil); err != nil {
+			t.Fatal(err)
+		}
+		lb := &LoadBalancer{Pool: testPool}
+		selectionAlgorithm = algo
+
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected a 503 from an empty pool but got %d", name, w.Code)
+		}
+	}
+
+	testPool := newTestPool(t, 1, 1, 1)
+	testPool.CurrentIndex = 2
+	testPool.Servers = testPool.Servers[:1]
+	if index, err := RoundRobin(testPool, testPool.ServerList()); err != nil || index != 0 {
+		t.Errorf("Expected RoundRobin to start over at index 0 but got %d (%v)", index, err)
+	}
+}
+
+// TestHealthHistory tests that only actual health transitions are recorded, and that the history
+// only holds on to the most recent ones.
+func TestHealthHistory(t *testing.T) {
+	server, err := NewTargetServer("http://localhost:9999")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaving the unknown status is a transition, but setting the same status again is not
+	server.SetStatus(StatusDegraded)
+	server.SetStatus(StatusDegraded)
+	if n := len(server.HealthHistory()); n != 1 {
+		t.Errorf("Expected 1 health transition but got %d", n)
+	}
+
+	// Flip the status more times than the history can hold
+	for i := 0; i < healthHistorySize+3; i++ {
+		if server.IsHealthy() {
+			server.Degrade()
+		} else {
+			server.SetStatus(StatusHealthy)
+		}
+	}
+
+	history := server.HealthHistory()
+	if len(history) != healthHistorySize {
+		t.Fatalf("Expected %d health transitions but got %d", healthHistorySize, len(history))
+	}
+	for i := 1; i < len(history); i++ {
+		if history[i].From != history[i-1].To {
+			t.Errorf("Expected transition %d to start from %s but it started from %s", i, history[i-1].To, history[i].From)
+		}
+	}
+	if last := history[len(history)-1]; last.To != server.Health {
+		t.Errorf("Expected the last transition to be to %s but it was to %s", server.Health, last.To)
+	}
+}
+
+// TestFairQueue tests that the fair queue admits waiting requests fairly across clients, rather than
+// in the order they arrived.
+func TestFairQueue(t *testing.T) {
+	q := NewFairQueue(1, time.Second, ClientWeights{})
+
+	// Take the only slot so that everyone else has to wait
+	if err := q.Acquire(context.Background(), "busy"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Client "a" floods the queue before client "b" sends a single request
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(key string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := q.Acquire(context.Background(), key); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+			q.Release()
+		}()
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := 0; i < 3; i++ {
+		enqueue("a")
+	}
+	enqueue("b")
+
+	q.Release()
+	wg.Wait()
+
+	// "b" should not have to wait behind all of the requests from "a"
+	if len(order) != 4 || order[1] != "b" {
+		t.Errorf("Expected client b to be admitted second, but the order was %v", order)
+	}
+}
+
+// TestFairQueueTimeout tests that a request waiting in the fair queue past the timeout is rejected.
+func TestFairQueueTimeout(t *testing.T) {
+	q := NewFairQueue(1, time.Millisecond*50, ClientWeights{})
+	if err := q.Acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Acquire(context.Background(), "b"); err != ErrFairQueueTimeout {
+		t.Errorf("Expected %v but got %v", ErrFairQueueTimeout, err)
+	}
+	q.Release()
+
+	// Once released, the queue should be free again
+	if err := q.Acquire(context.Background(), "b"); err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkServer(b *testing.B) {
+	lb := &LoadBalancer{Pool: sharedPool}
+	for n := 0; n < b.N; n++ {
+		r := httptest.NewRequest("GET", fmt.Sprintf("http://localhost:%d", listenerPortDeault), nil)
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, r)
+	}
+}
+
+// captureLogs runs f with clog logging every level, and returns what was logged meanwhile. The logs are
+// written to the standard output, which is swapped for a pipe while f runs.
+func captureLogs(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- string(b)
+	}()
+
+	stdout, level := os.Stdout, clog.LogLevel
+	os.Stdout, clog.LogLevel = w, clog.LogLevelDebug
+	f()
+	os.Stdout, clog.LogLevel = stdout, level
+	w.Close()
+	return <-out
+}
+
+// fakeBackend is an in-process target server for the tests. Its /_health endpoint reports whatever
+// state the test sets with SetHealthy, and every other path is served by its handler.
+type fakeBackend struct {
+	*httptest.Server
+	healthy atomic.Bool
+	// hits is the number of requests served by the handler, and healthChecks the number of requests to
+	// the health endpoint.
+	hits         atomic.Int64
+	healthChecks atomic.Int64
+}
+
+// newFakeBackend starts a healthy fakeBackend that serves handler, or a plain 200 if handler is nil.
+// It should be closed once the test is done.
+func newFakeBackend(handler http.Handler) *fakeBackend {
+	if handler == nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, "OK")
+		})
+	}
+	b := &fakeBackend{}
+	b.healthy.Store(true)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/"+HealthEndpoint {
+			b.healthChecks.Add(1)
+			state := "degraded"
+			if b.healthy.Load() {
+				state = "healthy"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"State":%q}`, state)
+			return
+		}
+		b.hits.Add(1)
+		handler.ServeHTTP(w, req)
+	}))
+	return b
+}
+
+// SetHealthy sets the state reported by the /_health endpoint of the backend. The pool picks it up on
+// its next health check.
+func (b *fakeBackend) SetHealthy(healthy bool) {
+	b.healthy.Store(healthy)
+}
+
+// startFakeBackends starts n healthy fakeBackends that respond with a plain 200, and returns them along
+// with their addresses.
+func startFakeBackends(n int) ([]*fakeBackend, ServerAddresses) {
+	var backends []*fakeBackend
+	var addrs ServerAddresses
+	for i := 0; i < n; i++ {
+		b := newFakeBackend(nil)
+		backends = append(backends, b)
+		addrs = append(addrs, b.URL)
+	}
+	return backends, addrs
+}
+
+// newFakeBackendPool starts n fakeBackends and a pool in front of them, without the periodic health
+// checks. Tests flip the health of the backends and call RunHealthCheck to have the pool notice.
+func newFakeBackendPool(t *testing.T, n int) ([]*fakeBackend, *ServerPool) {
+	backends, addrs := startFakeBackends(n)
+	t.Cleanup(func() {
+		for _, b := range backends {
+			b.Close()
+		}
+	})
+	testPool, err := NewServerPool(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.RunHealthCheck()
+	return backends, testPool
+}
+
+// TestFakeBackendHealth tests that the pool follows the health reported by the fake backends.
+func TestFakeBackendHealth(t *testing.T) {
+	backends, testPool := newFakeBackendPool(t, 3)
+	for i, s := range testPool.Servers {
+		if !s.IsHealthy() {
+			t.Errorf("Expected server %d to be healthy", i)
+		}
+	}
+
+	backends[1].SetHealthy(false)
+	testPool.RunHealthCheck()
+	for i, s := range testPool.Servers {
+		if s.IsHealthy() == (i == 1) {
+			t.Errorf("Expected server %d to be healthy: %t, but it is %t", i, i != 1, s.IsHealthy())
+		}
+	}
+
+	backends[1].SetHealthy(true)
+	testPool.RunHealthCheck()
+	if !testPool.Servers[1].IsHealthy() {
+		t.Error("Expected server 1 to be healthy again")
+	}
+}
+
+func TestWindowedStats(t *testing.T) {
+	ws := NewWindowedStats(time.Minute)
+	now := time.Now()
+
+	// A request that is older than the window should not be counted
+	ws.Record(now.Add(-2*time.Minute), http.StatusOK, time.Second)
+	for i := 0; i < 90; i++ {
+		ws.Record(now.Add(-time.Duration(i%30)*time.Second), http.StatusOK, 10*time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		ws.Record(now, http.StatusBadGateway, 500*time.Millisecond)
+	}
+
+	snapshot := ws.Snapshot(now)
+	if snapshot.Requests != 100 {
+		t.Errorf("expected 100 requests in the window, got %d", snapshot.Requests)
+	}
+	if snapshot.ErrorRate != 0.1 {
+		t.Errorf("expected an error rate of 0.1, got %f", snapshot.ErrorRate)
+	}
+	if p50 := snapshot.Latency.P50; p50 < 8 || p50 > 12.5 {
+		t.Errorf("expected a p50 latency of about 10ms, got %fms", p50)
+	}
+	if p99 := snapshot.Latency.P99; p99 < 400 || p99 > 625 {
+		t.Errorf("expected a p99 latency of about 500ms, got %fms", p99)
+	}
+}
+
+// TestAdminStatsPerPool tests that the admin API reports the statistics of the requests for each of the
+// pools.
+func TestAdminStatsPerPool(t *testing.T) {
+	_, defaultPool := newFakeBackendPool(t, 1)
+	_, apiPool := newFakeBackendPool(t, 1)
+	defaultPool.HealthyAll()
+	apiPool.HealthyAll()
+	lb := &LoadBalancer{Pool: defaultPool, Router: &Router{Default: defaultPool, routes: []route{{"/api", apiPool}}}}
+
+	for _, path := range []string{"/", "/api/users", "/api/orders"} {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost"+path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	lb.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/stats", nil))
+	var stats map[string]StatsSnapshot
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]uint64{"default": 1, "route /api": 2}
+	if len(stats) != len(expected) {
+		t.Errorf("Expected the stats of %d pools but got %v", len(expected), stats)
+	}
+	for name, requests := range expected {
+		if got := stats[name]; got.Requests != requests || got.TotalServers != 1 {
+			t.Errorf("Expected %d requests to the %s pool of 1 server but got %+v", requests, name, got)
+		}
+	}
+}
+
+func TestBackendLatency(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	testPool, err := NewServerPool(ServerAddresses{slow.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPool.Stop()
+	testPool.HealthyAll()
+	lb := &LoadBalancer{Pool: testPool}
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		lb.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	info := newServerInfo(testPool.Servers[0])
+	if p50 := info.Latency.P50; p50 < 16 || p50 > 200 {
+		t.Errorf("expected a p50 latency of about 20ms for the backend, got %fms", p50)
+	}
 }
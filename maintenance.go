@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// MaintenanceCheckInterval is how often the maintenance windows of the servers are evaluated.
+var MaintenanceCheckInterval time.Duration = 30 * time.Second
+
+// MaintenanceWindow is a daily recurring period of time during which a target server is drained
+// automatically. Start and End are times of the day in the HH:MM format, in local time. A window that
+// ends before it starts goes over midnight e.g. 23:00 to 01:00.
+type MaintenanceWindow struct {
+	Start string `json:"start" yaml:"start"`
+	End   string `json:"end" yaml:"end"`
+
+	// start and end are the parsed Start and End, as offsets from midnight
+	start, end time.Duration
+}
+
+// parse parses the Start and End times of the window. It needs to be called before Contains.
+func (w *MaintenanceWindow) parse() error {
+	var err error
+	w.start, err = parseTimeOfDay(w.Start)
+	if err != nil {
+		return &ConfigError{"start", err.Error()}
+	}
+	w.end, err = parseTimeOfDay(w.End)
+	if err != nil {
+		return &ConfigError{"end", err.Error()}
+	}
+	if w.start == w.end {
+		return &ConfigError{"end", "must be different from start"}
+	}
+	return nil
+}
+
+// Contains returns true if t falls in the maintenance window.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// parseTimeOfDay parses a HH:MM string into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of the day in the HH:MM format", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// RunMaintenanceScheduler is blocking and should be run as a separate goroutine. Until ctx is done, it
+// periodically puts the servers that have a maintenance window in or out of maintenance, depending on
+// whether the current time falls in their window.
+func (pool *ServerPool) RunMaintenanceScheduler(ctx context.Context, interval time.Duration) {
+	for {
+		pool.UpdateMaintenance(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// UpdateMaintenance puts each of the servers that have a maintenance window in or out of maintenance,
+// based on whether now falls in the window.
+func (pool *ServerPool) UpdateMaintenance(now time.Time) {
+	for _, s := range pool.ServerList() {
+		if window := s.Settings().Maintenance; window != nil {
+			s.SetInMaintenance(window.Contains(now))
+		}
+	}
+}
+
+// SetInMaintenance puts the target server s in or out of maintenance. A server in maintenance is
+// drained: it is not picked for new requests, but its health is still checked. Being in maintenance
+// is tracked separately from draining, so that the scheduler never undoes a manual drain.
+func (s *TargetServer) SetInMaintenance(in bool) {
+	if s.inMaintenance.Swap(in) == in {
+		return
+	}
+	if in {
+		clog.Noticef("A server is entering its maintenance window: %s", s.Address)
+	} else {
+		clog.Noticef("A server is leaving its maintenance window: %s", s.Address)
+	}
+}
+
+// IsInMaintenance returns true if the target server s is in its maintenance window.
+func (s *TargetServer) IsInMaintenance() bool {
+	return s.inMaintenance.Load()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// MaintenancePageFile is the path of the file served to all the clients while the load balancer is in
+// maintenance mode. A plain text message is served when it is empty.
+var MaintenancePageFile string
+
+// MaintenanceStatus is the status code of the responses while the load balancer is in maintenance mode.
+var MaintenanceStatus = http.StatusServiceUnavailable
+
+// maintenancePage is the body of the responses in maintenance mode, and maintenanceContentType is its
+// content type.
+var (
+	maintenancePage        = []byte("Service is down for maintenance\n")
+	maintenanceContentType = "text/plain; charset=utf-8"
+)
+
+// initMaintenanceMode reads MaintenancePageFile, if it is set. It should be called once the flags have
+// been parsed.
+func initMaintenanceMode() error {
+	if MaintenanceStatus < 100 || MaintenanceStatus > 599 {
+		return fmt.Errorf("%d is not a valid status code for -maintenance-status", MaintenanceStatus)
+	}
+	if MaintenancePageFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(MaintenancePageFile)
+	if err != nil {
+		return fmt.Errorf("Failed to read the maintenance page: %s", err)
+	}
+	maintenancePage = b
+	maintenanceContentType = mime.TypeByExtension(filepath.Ext(MaintenancePageFile))
+	if maintenanceContentType == "" {
+		maintenanceContentType = http.DetectContentType(b)
+	}
+	return nil
+}
+
+// serveMaintenancePage responds to the request with the maintenance page, if the load balancer is in
+// maintenance mode. It returns false otherwise, without writing anything.
+func (lb *LoadBalancer) serveMaintenancePage(w http.ResponseWriter) bool {
+	if !lb.maintenance.Load() {
+		return false
+	}
+	w.Header().Set("Content-Type", maintenanceContentType)
+	w.WriteHeader(MaintenanceStatus)
+	w.Write(maintenancePage)
+	return true
+}
+
+// adminMaintenanceHandler turns the maintenance mode of the load balancer on or off, based on the on
+// query parameter.
+func (lb *LoadBalancer) adminMaintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	v := req.URL.Query().Get("on")
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		http.Error(w, "Invalid value for on: "+v, http.StatusBadRequest)
+		return
+	}
+
+	if lb.maintenance.Swap(on) != on {
+		logEvent(levelNotice, "Maintenance mode changed", logField{"on", on})
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"maintenance": on})
+}
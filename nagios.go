@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Nagios plugin states, which double as the exit codes of the check subcommand.
+const (
+	NagiosOK       int = 0
+	NagiosWarning  int = 1
+	NagiosCritical int = 2
+	NagiosUnknown  int = 3
+)
+
+// nagiosStateNames maps Nagios plugin states to the names used in the plugin output.
+var nagiosStateNames = map[int]string{
+	NagiosOK:       "OK",
+	NagiosWarning:  "WARNING",
+	NagiosCritical: "CRITICAL",
+	NagiosUnknown:  "UNKNOWN",
+}
+
+// nagiosCheckURLDefault is the URL of the Nagios endpoint queried by the check subcommand when
+// one is not explicitly specified. The endpoint is served by the admin server.
+var nagiosCheckURLDefault = "http://" + AdminAddress + "/nagios"
+
+// nagiosCheck formats the health of the servers in stats in the Nagios plugin format. It returns the
+// plugin output along with the state: CRITICAL if no server is healthy, WARNING if some servers are
+// degraded, and OK if all of them are healthy.
+func nagiosCheck(stats PoolStats) (string, int) {
+	var degraded []string
+	for _, s := range stats.Servers {
+		if s.Health != StatusHealthy {
+			degraded = append(degraded, s.Address)
+		}
+	}
+	total, healthy := stats.Total, stats.Healthy
+
+	state := NagiosOK
+	switch {
+	case healthy == 0:
+		state = NagiosCritical
+	case len(degraded) > 0:
+		state = NagiosWarning
+	}
+
+	msg := fmt.Sprintf("%d/%d backends healthy", healthy, total)
+	if len(degraded) > 0 {
+		msg += fmt.Sprintf(", degraded: %s", strings.Join(degraded, ", "))
+	}
+	perfdata := fmt.Sprintf("healthy=%d;;;0;%d degraded=%d;;;0;%d", healthy, total, len(degraded), total)
+
+	return fmt.Sprintf("LB %s - %s | %s", nagiosStateNames[state], msg, perfdata), state
+}
+
+// adminNagiosHandler serves the health of the servers in all the pools in the Nagios plugin format. The
+// status code is 503 when the state is CRITICAL, so that plain HTTP checks can make use of it too.
+func (lb *LoadBalancer) adminNagiosHandler(w http.ResponseWriter, req *http.Request) {
+	output, state := nagiosCheck(lb.Stats())
+
+	code := http.StatusOK
+	if state == NagiosCritical {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, output)
+}
+
+// runCheckCommand implements the check subcommand, which queries the Nagios endpoint of a running
+// load balancer and behaves like a Nagios plugin: it prints the plugin output and returns the exit
+// code for the state.
+func runCheckCommand(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	url := fs.String("url", nagiosCheckURLDefault, "URL of the Nagios endpoint of the load balancer.")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout for querying the load balancer.")
+	user := fs.String("user", "", "User name for the basic auth on the admin API of the load balancer.")
+	password := fs.String("pass", "", "Password for the basic auth on the admin API of the load balancer.")
+	fs.Parse(args)
+
+	req, err := http.NewRequest(http.MethodGet, *url, nil)
+	if err != nil {
+		fmt.Printf("LB UNKNOWN - %s\n", err)
+		return NagiosUnknown
+	}
+	if *user != "" || *password != "" {
+		req.SetBasicAuth(*user, *password)
+	}
+	client := http.Client{Timeout: *timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("LB UNKNOWN - %s\n", err)
+		return NagiosUnknown
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Printf("LB UNKNOWN - %s\n", err)
+		return NagiosUnknown
+	}
+	output := strings.TrimSpace(string(b))
+
+	// The state is the second word of the output
+	for state, name := range nagiosStateNames {
+		if strings.HasPrefix(output, "LB "+name+" ") {
+			fmt.Println(output)
+			return state
+		}
+	}
+	fmt.Printf("LB UNKNOWN - unexpected response from %s: %s\n", *url, output)
+	return NagiosUnknown
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outlier detection ejects a target server whose error rate over a rolling window gets too high, even
+// if it passes its health checks. An ejected server is not picked for new requests until its ejection
+// time is up. The ejection time grows with every ejection in a row, up to OutlierMaxEjectionTime.
+var (
+	// OutlierErrorRate is the fraction of the requests to a server over OutlierWindow that need to fail
+	// for it to be ejected. A request fails if the server can't be reached or responds with a 5xx. A
+	// value of 0 disables outlier detection.
+	OutlierErrorRate float64
+	// OutlierWindow is the length of the rolling window over which the error rate is computed.
+	OutlierWindow = 10 * time.Second
+	// OutlierMinRequests is the least number of requests over the window for a server to be ejected,
+	// so that a couple of failures on a quiet server don't eject it.
+	OutlierMinRequests = 10
+	// OutlierEjectionTime is how long a server is ejected for the first time. Every following ejection
+	// in a row lasts this much longer than the one before.
+	OutlierEjectionTime = 30 * time.Second
+	// OutlierMaxEjectionTime caps the ejection time. A server that goes this long after an ejection
+	// without being ejected again starts over from OutlierEjectionTime.
+	OutlierMaxEjectionTime = 5 * time.Minute
+)
+
+// Slow server ejection ejects a target server that keeps responding, but too slowly, as the error rate
+// and the health checks don't catch it. A server whose responses take longer than SlowThreshold for
+// SlowConsecutive requests in a row is ejected for SlowEjectionTime, after which it gets requests again.
+var (
+	// SlowThreshold is the time for the response headers to come back over which a response is slow. A
+	// value of 0 disables slow server ejection.
+	SlowThreshold time.Duration
+	// SlowConsecutive is the number of slow responses in a row that get a server ejected.
+	SlowConsecutive = 5
+	// SlowEjectionTime is how long a slow server is ejected for.
+	SlowEjectionTime = 30 * time.Second
+)
+
+// outlierDetector tracks the outcome of the requests to a target server, in one second buckets held in
+// a ring, and ejects the server when too many of them fail. The zero value is ready to use.
+type outlierDetector struct {
+	sync.Mutex
+	buckets []outlierBucket
+	// ejections is the number of ejections in a row, and lastEjectionEnd is when the last one ended.
+	ejections       int
+	lastEjectionEnd time.Time
+	// slowStreak is the number of slow responses in a row.
+	slowStreak int
+
+	// ejectedUntil is the end of the current ejection in Unix nanoseconds, or 0. It is atomic, as it is
+	// read for every selection.
+	ejectedUntil atomic.Int64
+}
+
+// outlierBucket holds the outcome of the requests that finished in one second.
+type outlierBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+// observeOutcome records a request to the target server s that finished at now with the status code,
+// and ejects s if its error rate is over the threshold. It returns true if s got ejected.
+func (s *TargetServer) observeOutcome(now time.Time, status int) bool {
+	if OutlierErrorRate <= 0 {
+		return false
+	}
+
+	d := &s.outliers
+	d.Lock()
+	defer d.Unlock()
+
+	// The buckets are set up lazily, so that OutlierWindow can be changed after the server is created
+	seconds := int((OutlierWindow + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	if len(d.buckets) != seconds {
+		d.buckets = make([]outlierBucket, seconds)
+	}
+
+	sec := now.Unix()
+	b := &d.buckets[sec%int64(len(d.buckets))]
+	if b.second != sec {
+		*b = outlierBucket{second: sec}
+	}
+	b.requests++
+	if status >= http.StatusInternalServerError {
+		b.failures++
+	}
+
+	if s.IsEjected(now) {
+		return false
+	}
+	var requests, failures int
+	for _, b := range d.buckets {
+		if b.second > sec-int64(len(d.buckets)) && b.second <= sec {
+			requests += b.requests
+			failures += b.failures
+		}
+	}
+	if requests < OutlierMinRequests || float64(failures)/float64(requests) < OutlierErrorRate {
+		return false
+	}
+
+	// Eject the server, for longer if it has just been ejected
+	if !d.lastEjectionEnd.IsZero() && now.Sub(d.lastEjectionEnd) > OutlierMaxEjectionTime {
+		d.ejections = 0
+	}
+	d.ejections++
+	ejection := time.Duration(d.ejections) * OutlierEjectionTime
+	if ejection > OutlierMaxEjectionTime {
+		ejection = OutlierMaxEjectionTime
+	}
+	d.lastEjectionEnd = now.Add(ejection)
+	d.ejectedUntil.Store(d.lastEjectionEnd.UnixNano())
+	for i := range d.buckets {
+		d.buckets[i] = outlierBucket{}
+	}
+
+	logEvent(levelWarning, "A server is being ejected for its error rate",
+		logField{"backend", s.Address},
+		logField{"error_rate", float64(failures) / float64(requests)},
+		logField{"ejection", ejection},
+	)
+	return true
+}
+
+// observeLatency records a response from the target server s that finished at now after latency, and
+// ejects s if it is the SlowConsecutive slow response in a row. It returns true if s got ejected.
+func (s *TargetServer) observeLatency(now time.Time, latency time.Duration) bool {
+	if SlowThreshold <= 0 {
+		return false
+	}
+
+	d := &s.outliers
+	d.Lock()
+	defer d.Unlock()
+
+	if latency <= SlowThreshold {
+		d.slowStreak = 0
+		return false
+	}
+	d.slowStreak++
+	// The requests that were already in flight when s got ejected don't count towards the next ejection
+	if s.IsEjected(now) || d.slowStreak < SlowConsecutive {
+		return false
+	}
+
+	d.slowStreak = 0
+	until := now.Add(SlowEjectionTime).UnixNano()
+	if until > d.ejectedUntil.Load() {
+		d.ejectedUntil.Store(until)
+	}
+	logEvent(levelWarning, "A server is being ejected for responding slowly",
+		logField{"backend", s.Address},
+		logField{"latency", latency},
+		logField{"ejection", SlowEjectionTime},
+	)
+	return true
+}
+
+// IsEjected returns true if the target server s is ejected by outlier detection at now.
+func (s *TargetServer) IsEjected(now time.Time) bool {
+	until := s.outliers.ejectedUntil.Load()
+	return until != 0 && now.UnixNano() < until
+}
@@ -0,0 +1,24 @@
+package main
+
+import "time"
+
+// FailurePenalty is how long a target server is passed over after a request to it fails, even if it is
+// still marked healthy, so that the requests that come in before its next health check don't keep
+// hitting a server that is having a blip. The penalized servers are still picked if all the others are
+// penalized too. The penalty is off when it is 0.
+var FailurePenalty = 1 * time.Second
+
+// Penalize puts the target server s in the penalty box for FailurePenalty from now, after a request to
+// it failed.
+func (s *TargetServer) Penalize(now time.Time) {
+	if FailurePenalty <= 0 {
+		return
+	}
+	s.penaltyUntil.Store(now.Add(FailurePenalty).UnixNano())
+}
+
+// IsPenalized returns true if the target server s is in the penalty box at now.
+func (s *TargetServer) IsPenalized(now time.Time) bool {
+	until := s.penaltyUntil.Load()
+	return until != 0 && now.UnixNano() < until
+}
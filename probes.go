@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Paths of the load balancer's own health endpoints, meant for orchestrator probes. They are served
+// ahead of everything else, so probes don't take up in-flight slots, and don't show up in the access
+// logs or the request statistics.
+const (
+	// LivenessEndpoint reports that the load balancer process is up and serving.
+	LivenessEndpoint = "/_lb_health"
+	// ReadinessEndpoint reports whether the load balancer has a target server it can forward requests to.
+	ReadinessEndpoint = "/ready"
+)
+
+// withProbeRoutes returns a handler that serves the self health endpoints of lb, and passes all the
+// other requests on to next.
+func (lb *LoadBalancer) withProbeRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case LivenessEndpoint:
+			lb.livenessHandler(w, req)
+		case ReadinessEndpoint:
+			lb.readinessHandler(w, req)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// LivenessResponse is the JSON body of the liveness probe.
+type LivenessResponse struct {
+	// Status is "ok", or "draining" while the load balancer is draining.
+	Status string `json:"status"`
+	// Healthy, Degraded and Unknown count the target servers of all the pools by health, with the
+	// servers that haven't been checked yet counted as unknown rather than degraded.
+	Healthy  int `json:"healthy"`
+	Degraded int `json:"degraded"`
+	Unknown  int `json:"unknown"`
+	// Version, Commit and BuildDate tell which build of the load balancer is running.
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// livenessHandler responds with a 200, as the load balancer is alive if it can respond at all, unless
+// the load balancer is draining. The body is a LivenessResponse.
+func (lb *LoadBalancer) livenessHandler(w http.ResponseWriter, req *http.Request) {
+	stats := lb.Stats()
+	resp := LivenessResponse{
+		Status:    "ok",
+		Healthy:   stats.Healthy,
+		Degraded:  stats.Degraded,
+		Unknown:   stats.Unknown,
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+	}
+	if lb.draining.Load() {
+		resp.Status = "draining"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readinessHandler responds with a 200 if at least one of the target servers in any of the pools can be
+// picked for new requests, and a 503 otherwise or if the load balancer is draining.
+func (lb *LoadBalancer) readinessHandler(w http.ResponseWriter, req *http.Request) {
+	selectable := lb.Stats().Selectable
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if lb.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready: draining")
+		return
+	}
+	if selectable == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready: no target server available")
+		return
+	}
+	fmt.Fprintf(w, "ready: %d target servers available\n", selectable)
+}
+
+// adminLBDrainHandler puts the load balancer itself in draining mode, in which its probe endpoints fail
+// but the requests are still proxied, so that it can be taken out of rotation before it is shut down.
+// Passing draining=false takes it out of draining mode.
+func (lb *LoadBalancer) adminLBDrainHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	draining := true
+	if v := req.URL.Query().Get("draining"); v != "" {
+		var err error
+		draining, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid value for draining: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if lb.draining.Swap(draining) != draining {
+		logEvent(levelNotice, "Load balancer draining mode changed", logField{"draining", draining})
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": draining})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+// ProxyProtocol makes the listener servers expect a PROXY protocol header, v1 or v2, at the start of
+// every connection, as sent by L4 proxies like cloud network load balancers. The client address in the
+// header then becomes the remote address of the requests, which the X-Forwarded-For header, the access
+// logs and the rate limits use. Connections that don't start with a valid header are closed.
+var ProxyProtocol bool
+
+// ProxyProtocolTimeout is how long a connection has to send its PROXY protocol header.
+var ProxyProtocolTimeout time.Duration = 5 * time.Second
+
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener wraps a net.Listener so that its connections read their PROXY protocol header.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn is a connection that starts with a PROXY protocol header. The header is read on the
+// first call to Read or RemoteAddr rather than in Accept, so that a slow client doesn't hold up the
+// other connections.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader reads the PROXY protocol header of the connection, once.
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(ProxyProtocolTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			clog.Warningf("Closing the connection from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or the address of the peer if
+// the header doesn't have one, e.g. for the health checks of the proxy in front of us.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header, of either version, from r. It returns the source
+// address in the header, or nil if the header doesn't carry one.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+	if bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("%w: the connection doesn't start with one", ErrInvalidProxyHeader)
+}
+
+// readProxyHeaderV1 reads a human readable header e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes long, which is well within the buffer of r
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not terminated", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, hdr[12]>>4)
+	}
+	command, family := hdr[12]&0x0f, hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxyHeader, err)
+	}
+
+	// LOCAL connections come from the proxy itself, and the addresses of the other families are not
+	// IP addresses, so they keep the address of the peer
+	const commandProxy, familyTCP4, familyTCP6 = 0x1, 0x11, 0x21
+	if command != commandProxy {
+		return nil, nil
+	}
+	switch family {
+	case familyTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: v2 address is too short", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case familyTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: v2 address is too short", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
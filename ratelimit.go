@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is the number of requests per second that a single client IP can make. A value of 0 means
+// there is no limit.
+var RateLimit float64
+
+// RateBurst is the number of requests a client IP can make at once, before being held to RateLimit. A
+// value of 0 means the burst is the same as the rate, rounded up.
+var RateBurst int
+
+// RateLimitIdleTimeout is how long a client IP has to go without making requests before its limiter is
+// dropped. A client that comes back after that starts with a full bucket, which it would have anyway.
+var RateLimitIdleTimeout time.Duration = 3 * time.Minute
+
+// rateLimiter is the global per client IP rate limiter. It is nil when there is no rate limit.
+var rateLimiter *ClientRateLimiter
+
+var ErrRateLimited = errors.New("Too many requests from this client, slow down")
+
+// initRateLimiter sets up the global rate limiter based on RateLimit and RateBurst. It should be called
+// once the flags have been parsed.
+func initRateLimiter() {
+	rateLimiter = nil
+	if RateLimit > 0 {
+		rateLimiter = NewClientRateLimiter(RateLimit, RateBurst)
+		go rateLimiter.RunCleanup(context.Background(), RateLimitIdleTimeout)
+	}
+}
+
+// ClientRateLimiter holds a token bucket rate limiter for each client, keyed by the client IP.
+type ClientRateLimiter struct {
+	sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*clientLimiter
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewClientRateLimiter creates a ClientRateLimiter that allows each client perSecond requests per
+// second, with bursts of up to burst requests.
+func NewClientRateLimiter(perSecond float64, burst int) *ClientRateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	return &ClientRateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		clients: make(map[string]*clientLimiter),
+	}
+}
+
+// Allow returns true if the client with key can make a request at now.
+func (l *ClientRateLimiter) Allow(key string, now time.Time) bool {
+	l.Lock()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	l.Unlock()
+
+	return c.limiter.AllowN(now, 1)
+}
+
+// Cleanup drops the limiters of the clients that haven't made a request since before.
+func (l *ClientRateLimiter) Cleanup(before time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for key, c := range l.clients {
+		if c.lastSeen.Before(before) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// RunCleanup is blocking and should be run as a separate goroutine. Until ctx is done, it periodically
+// drops the limiters of the clients that have been idle for longer than idle, so that the limiters
+// don't pile up.
+func (l *ClientRateLimiter) RunCleanup(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.Cleanup(now.Add(-idle))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RewriteLocation rewrites the Location header of the responses of the target servers that point at the
+// target server itself, so that the clients follow the redirects through the load balancer rather than
+// to a target server they may not be able to reach, or back to a URL that redirects them again. Their
+// path is mapped back from the path the target server sees to the one the client asked for. Absolute
+// redirects to any other host are left as they are.
+var RewriteLocation bool
+
+// rewriteLocation rewrites the Location header h of the response of target, with the status code, to the
+// client request req. Redirects that send the client back to the URL it requested are logged, as the
+// client would loop on them.
+func rewriteLocation(h http.Header, status int, req *http.Request, target *TargetServer) {
+	loc := h.Get("Location")
+	if loc == "" {
+		return
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return
+	}
+
+	external := &url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	if req.TLS != nil {
+		external.Scheme = "https"
+	}
+	if u.Host != "" {
+		if !sameHost(u, target.URL) {
+			return
+		}
+		u.Scheme, u.Host = external.Scheme, external.Host
+	}
+	if strings.HasPrefix(u.Path, "/") {
+		u.Path = target.clientPath(u.Path)
+		u.RawPath = ""
+	}
+	if rewritten := u.String(); rewritten != loc {
+		h.Set("Location", rewritten)
+	}
+
+	if status >= 300 && status < 400 {
+		next := external.ResolveReference(u)
+		if next.Host == external.Host && next.Path == external.Path && next.RawQuery == external.RawQuery {
+			logEvent(levelWarning, "A target server redirects the client back to the URL it requested",
+				logField{"backend", target.Address},
+				logField{"location", loc},
+			)
+		}
+	}
+}
+
+// clientPath maps the path of a request forwarded to the target server s back to the path of the client
+// request, undoing the path of the server address, its AddPrefix and its StripPrefix. Paths that the
+// requests to s can't have been forwarded to are left as they are.
+func (s *TargetServer) clientPath(path string) string {
+	settings := s.Settings()
+	prefix := singleJoiningSlash(s.URL.Path, strings.TrimSuffix(settings.AddPrefix, "/"))
+	if !hasPathPrefix(path, prefix) {
+		return path
+	}
+	path = strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	if path == "" {
+		path = "/"
+	}
+	if settings.StripPrefix != "" {
+		path = singleJoiningSlash(strings.TrimSuffix(settings.StripPrefix, "/"), path)
+	}
+	return path
+}
+
+// sameHost returns true if the URLs a and b are on the same host and port, with the default port of
+// their scheme when they don't have one.
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && urlPort(a) == urlPort(b)
+}
+
+// urlPort returns the port of u, or the default port of its scheme.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/teejays/clog"
+)
+
+// watchConfigReloads is blocking and should be run as a separate goroutine. It reloads the config file
+// at path into pool every time the process receives a SIGHUP. extra holds the servers passed on the
+// command line, which are kept along with the ones in the config file.
+func watchConfigReloads(path string, extra []BackendConfig, pool *ServerPool) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		err := reloadConfig(path, extra, pool)
+		if err != nil {
+			clog.Errorf("Failed to reload the config file, keeping the current servers: %s", err)
+		}
+	}
+}
+
+// reloadConfig reads the config file at path again, and reconciles the pool with the servers listed in
+// it along with the extra servers. Servers that are in both the pool and the config keep their state.
+func reloadConfig(path string, extra []BackendConfig, pool *ServerPool) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	backends := withHealthHeaders(append(cfg.Backends, extra...), cfg.HealthHeaders)
+	added, removed, err := pool.Reconcile(backends)
+	if err != nil {
+		return err
+	}
+	if len(backends) == 0 {
+		clog.Warning("The reloaded config has no servers, all requests will fail until some are added")
+	}
+
+	clog.Infof("Config file reloaded: %d servers, %d added %v, %d removed %v",
+		len(backends), len(added), added, len(removed), removed)
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is the header that carries the ID of every request, to correlate the logs of the load
+// balancer with the ones of the target servers. The ID of the client is kept if it sent one, and a random
+// one is generated otherwise. It is sent to the target server, echoed back to the client and logged in
+// the access log. Request IDs are off when it is empty.
+var RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID we take from a client. Longer ones are replaced, so that
+// they can't bloat the logs.
+const maxRequestIDLength = 128
+
+// ensureRequestID returns the request ID of req, after generating one and setting it on req if it
+// doesn't have a usable one. As the header is set on req itself, it goes along with every copy of the
+// request sent to the target servers.
+func ensureRequestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if !isValidRequestID(id) {
+		id = newRequestID()
+		req.Header.Set(RequestIDHeader, id)
+	}
+	return id
+}
+
+// isValidRequestID returns true if id is a non empty request ID of printable ASCII characters, up to
+// maxRequestIDLength long.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// removeEchoedRequestID removes the request ID from the response headers h of a target server, as the
+// response to the client already has it.
+func removeEchoedRequestID(h http.Header) {
+	if RequestIDHeader != "" {
+		h.Del(RequestIDHeader)
+	}
+}
+
+// newRequestID returns a random request ID of 32 hex characters.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
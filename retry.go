@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RetryOn are the response statuses of a target server that mean it is failing, so that it is degraded
+// and the request is retried with a different server. Responses with other statuses are sent to the
+// client as they are.
+var RetryOn = StatusCodes{
+	{http.StatusInternalServerError, http.StatusInternalServerError},
+	{http.StatusBadGateway, http.StatusGatewayTimeout},
+}
+
+// MaxRetries is the most times a request is retried with a different server, so that a single request
+// that every server fails on can't go through all the servers of a large pool. The last attempt gets
+// its response sent to the client whatever it is.
+var MaxRetries = 2
+
+// StatusCodes is a list of ranges of HTTP status codes, set from a comma separated list of codes and
+// ranges e.g. 500,502-504.
+type StatusCodes [][2]int
+
+// Contains returns true if code is in one of the ranges.
+func (sc StatusCodes) Contains(code int) bool {
+	for _, r := range sc {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (sc StatusCodes) String() string {
+	parts := make([]string, len(sc))
+	for i, r := range sc {
+		parts[i] = strconv.Itoa(r[0])
+		if r[1] != r[0] {
+			parts[i] += "-" + strconv.Itoa(r[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set replaces the ranges with the ones in s. An empty s clears them.
+func (sc *StatusCodes) Set(s string) error {
+	var codes StatusCodes
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			hi = lo
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		to, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || from < 100 || to > 599 || from > to {
+			return fmt.Errorf("status codes should be codes from 100 to 599 or ranges of them e.g. 502-504: %s", part)
+		}
+		codes = append(codes, [2]int{from, to})
+	}
+	*sc = codes
+	return nil
+}
+
+// RetryNonIdempotent allows retrying requests with non-idempotent methods like POST and PATCH with a
+// different target server, at the risk of the request being processed twice.
+var RetryNonIdempotent bool
+
+// idempotentMethods are the methods that can be retried safely, as making the same request more than
+// once has the same effect as making it once (RFC 7231, section 4.2.2).
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// canRetryMethod returns true if the retry policy allows retrying requests with method.
+func canRetryMethod(method string) bool {
+	return RetryNonIdempotent || idempotentMethods[method]
+}
+
+// isRetryable returns true if req can be retried with a different target server: both its method and
+// its body allow it.
+func isRetryable(req *http.Request) bool {
+	return canRetryMethod(req.Method) && isReplayable(req)
+}
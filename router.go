@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RouteConfig is the configuration of a route, which sends the requests whose path starts with
+// PathPrefix to a pool of its own.
+type RouteConfig struct {
+	// PathPrefix is matched against the request path one segment at a time, so /api matches /api and
+	// /api/users but not /apis.
+	PathPrefix string `json:"path_prefix" yaml:"path_prefix"`
+	// Backends lists the target servers of the pool of the route.
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+	// ResponseHeaders are the changes made to the headers of the responses from the pool of the route.
+	ResponseHeaders *HeaderRules `json:"response_headers" yaml:"response_headers"`
+	// HealthHeaders are sent with the health checks of the servers in the pool of the route.
+	HealthHeaders map[string]string `json:"health_headers" yaml:"health_headers"`
+}
+
+// VirtualHostConfig is the configuration of a virtual host, which sends all the requests for a host
+// name to a pool of its own.
+type VirtualHostConfig struct {
+	// Backends lists the target servers of the pool of the virtual host.
+	Backends []BackendConfig `json:"backends" yaml:"backends"`
+	// ResponseHeaders are the changes made to the headers of the responses from the pool of the virtual
+	// host.
+	ResponseHeaders *HeaderRules `json:"response_headers" yaml:"response_headers"`
+	// HealthHeaders are sent with the health checks of the servers in the pool of the virtual host.
+	HealthHeaders map[string]string `json:"health_headers" yaml:"health_headers"`
+}
+
+// Router picks the pool for a request based on its host and path. A virtual host matching the Host
+// header wins first. Otherwise, the route with the longest matching path prefix wins, and requests that
+// match no route go to the default pool.
+type Router struct {
+	// hosts maps the lower case host names, without a port, to their pools
+	hosts map[string]*ServerPool
+	// routes is sorted by the length of the prefix, longest first
+	routes []route
+	// Default is the pool for requests that match no route. Such requests get a 404 if it is nil.
+	Default *ServerPool
+}
+
+type route struct {
+	prefix string
+	pool   *ServerPool
+}
+
+var ErrNoRoute = errors.New("No route found for the request")
+
+// NewRouter creates a Router with a new pool for each of the virtual hosts and routes, and defaultPool
+// for the requests that match none of them. If any of the pools fails to be created, the ones already
+// created are stopped.
+func NewRouter(routes []RouteConfig, hosts map[string]VirtualHostConfig, defaultPool *ServerPool) (*Router, error) {
+	r := Router{Default: defaultPool, hosts: make(map[string]*ServerPool)}
+	for host, hc := range hosts {
+		p, err := NewServerPoolFromBackends(withHealthHeaders(hc.Backends, hc.HealthHeaders))
+		if err != nil {
+			r.Stop()
+			return nil, err
+		}
+		p.ResponseHeaders = hc.ResponseHeaders
+		r.hosts[normalizeHost(host)] = p
+	}
+	for _, rc := range routes {
+		p, err := NewServerPoolFromBackends(withHealthHeaders(rc.Backends, rc.HealthHeaders))
+		if err != nil {
+			r.Stop()
+			return nil, err
+		}
+		p.ResponseHeaders = rc.ResponseHeaders
+		r.routes = append(r.routes, route{prefix: rc.PathPrefix, pool: p})
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+	return &r, nil
+}
+
+// Stop stops the health checks of the pools of the virtual hosts and routes. The default pool is left
+// running, as it isn't owned by the router.
+func (r *Router) Stop() {
+	for _, p := range r.pools() {
+		p.Stop()
+	}
+}
+
+// pools returns the pools of the virtual hosts and routes, without the default pool.
+func (r *Router) pools() []*ServerPool {
+	var pools []*ServerPool
+	for _, p := range r.hosts {
+		pools = append(pools, p)
+	}
+	for _, rt := range r.routes {
+		pools = append(pools, rt.pool)
+	}
+	return pools
+}
+
+// namedPools returns the pools of the virtual hosts and routes by name: "host " followed by the host
+// name for the virtual hosts, and "route " followed by the path prefix for the routes.
+func (r *Router) namedPools() map[string]*ServerPool {
+	pools := make(map[string]*ServerPool)
+	for host, p := range r.hosts {
+		pools["host "+host] = p
+	}
+	for _, rt := range r.routes {
+		pools["route "+rt.prefix] = rt.pool
+	}
+	return pools
+}
+
+// Match returns the pool for req, or nil if no route matches it and there is no default pool.
+func (r *Router) Match(req *http.Request) *ServerPool {
+	if p, ok := r.hosts[normalizeHost(req.Host)]; ok {
+		return p
+	}
+	for _, rt := range r.routes {
+		if hasPathPrefix(req.URL.Path, rt.prefix) {
+			return rt.pool
+		}
+	}
+	return r.Default
+}
+
+// hasPathPrefix returns true if path starts with the path segments of prefix.
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// normalizeHost lower cases host and strips the port from it, if it has one.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The health score of a target server is a number from 0 to 100 that tells how well the server is doing,
+// beyond the binary healthy or degraded status. It is a weighted sum of three parts, each from 0 to 1:
+//   - the active health checks: 1 when the server is healthy, minus the share of UnhealthyThreshold it
+//     has already failed in a row, 0.5 when its health is not known yet or it is warming up, and 0
+//     when it is degraded,
+//   - the error rate of its responses over StatsWindow,
+//   - its p95 latency over StatsWindow, compared to ScoreLatencyTarget.
+//
+// A server that hasn't served any request in the window gets full marks for the last two.
+const (
+	scoreWeightHealth  = 0.5
+	scoreWeightErrors  = 0.3
+	scoreWeightLatency = 0.2
+)
+
+// ScoreLatencyTarget is the p95 latency at which the latency part of the health score is halved. It
+// goes towards 0 as the latency grows past it.
+var ScoreLatencyTarget time.Duration = 250 * time.Millisecond
+
+// HealthScore returns the health score of the target server s, from 0 to 100.
+func (s *TargetServer) HealthScore() int {
+	s.healthLock.RLock()
+	var health float64
+	switch s.Health {
+	case StatusHealthy:
+		health = 1
+		if threshold := s.Settings().UnhealthyThreshold; threshold > 1 {
+			health -= float64(s.healthChecksFailed) / float64(threshold)
+		}
+	case StatusUnknown, StatusWarming:
+		health = 0.5
+	}
+	s.healthLock.RUnlock()
+
+	errors, latency := 1.0, 1.0
+	if stats := s.ResponseStats(); stats.Requests > 0 {
+		errors = 1 - stats.ErrorRate
+		target := durationToMillis(ScoreLatencyTarget)
+		latency = target / (target + stats.Latency.P95)
+	}
+
+	score := scoreWeightHealth*health + scoreWeightErrors*errors + scoreWeightLatency*latency
+	return int(math.Round(100 * score))
+}
+
+// ScoreBased picks a selectable server from the pool at random, with a chance proportional to its health
+// score, so that the servers that are struggling get fewer requests before they fail their health checks.
+func ScoreBased(pool *ServerPool, servers []*TargetServer) (int, error) {
+	scores := make([]int, len(servers))
+	var total int
+	selectable := selectableInTier(servers)
+	for i, s := range servers {
+		if selectable(s) {
+			scores[i] = s.HealthScore()
+			total += scores[i]
+		}
+	}
+	if total == 0 {
+		return -1, ErrNoHealthyServer
+	}
+
+	r := randIntn(total)
+	pick := r
+	for i, score := range scores {
+		if r < score {
+			if LogSelectionDecisions {
+				logSelection("ScoreBased", servers, i, fmt.Sprintf("random pick %d out of a total score of %d", pick, total), func(s *TargetServer) string {
+					return fmt.Sprintf("score=%d", s.HealthScore())
+				})
+			}
+			return i, nil
+		}
+		r -= score
+	}
+	return -1, ErrNoHealthyServer
+}
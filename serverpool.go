@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teejays/clog"
@@ -13,43 +16,104 @@ import (
 // ServerPool is the primary data structure of this application. It holds an array of all the
 // target servers, and allows picking of healthy target servers using round robin.
 type ServerPool struct {
-	Servers           []*TargetServer
-	NumHealthy        int
-	CurrentIndex      int
-	PauseHealthCheck  bool
-	CancelHealthCheck context.CancelFunc
+	Servers          []*TargetServer
+	NumHealthy       int
+	CurrentIndex     int
+	PauseHealthCheck bool
 	sync.Mutex
+
+	// stop stops the background processes of the pool, and stopped is done once they have all returned.
+	stop    context.CancelFunc
+	stopped sync.WaitGroup
+
+	// ResponseHeaders are the changes made to the headers of the responses from the servers in the
+	// pool. They are set when the pool is created, and can be nil.
+	ResponseHeaders *HeaderRules
+
+	// Transport is used for the requests to the servers in the pool. The shared backend transport is
+	// used when it is nil.
+	Transport http.RoundTripper
+
+	// discoverer finds the backends of the pool. discovererChanged is closed when it is replaced, so
+	// that the discovery process moves on to the new one. Both are guarded by the pool lock.
+	discoverer        Discoverer
+	discovererChanged chan struct{}
+
+	// requests aggregates the requests forwarded to the pool over StatsWindow. It is created on first use
+	// by requestStats.
+	requests     *WindowedStats
+	requestsOnce sync.Once
 }
 
 // HealthCheckInterval defines the interval between two subsequent health checks of all servers
 var HealthCheckInterval time.Duration = time.Millisecond * 200
 
+// HealthCheckConcurrency is the maximum number of servers whose health is checked at the same time.
+var HealthCheckConcurrency int = 16
+
+// HealthCheckMaxBackoff is the longest a degraded server has to wait between two health checks.
+var HealthCheckMaxBackoff time.Duration = time.Minute * 5
+
+// WaitHealthy makes a new pool check the health of all its servers before it is returned, so that the
+// servers that are already up can be picked right away. Without it, all the servers have an unknown
+// health until the health check process gets to them.
+var WaitHealthy bool = true
+
+// StartupTimeout is how long the load balancer waits at startup for at least one target server to be
+// healthy, before giving up and exiting. A value of 0 means it doesn't wait.
+var StartupTimeout time.Duration
+
 var (
+	ErrStartupTimeout         = errors.New("No target server became healthy before the startup timeout")
 	ErrNoServerAddressForPool = errors.New("Empty server address list provided for pool")
 	ErrDuplicateServerAddress = errors.New("More than one server found with the same address")
 	ErrNoHealthyServer        = errors.New("No healthy servers found")
+	ErrServerNotFound         = errors.New("No server found with the given address")
 )
 
 // NewServerPool creates a new ServerPool with it's servers array built from the addresses passed
 // in the parameters. It also starts a goroutine to periodically check the health status of it's servers
 func NewServerPool(addrs ServerAddresses) (*ServerPool, error) {
+	return NewServerPoolFromBackends(backendConfigsFromAddresses(addrs))
+}
+
+// NewServerPoolFromBackends is like NewServerPool, but builds the servers from backend configs so that
+// each of them can have its own settings. The host names of the backends that need it are resolved,
+// and kept up to date.
+func NewServerPoolFromBackends(backends []BackendConfig) (*ServerPool, error) {
 	// Validate that we have addresses availalble
-	if len(addrs) < 1 {
+	if len(backends) < 1 {
+		return nil, ErrNoServerAddressForPool
+	}
+	return NewServerPoolFromDiscoverer(discovererFor(backends))
+}
+
+// NewServerPoolFromDiscoverer creates a new ServerPool with the backends that d discovers, and keeps its
+// servers in line with them until the pool is stopped. If WaitHealthy is set, it checks the health of
+// all the servers once before returning.
+func NewServerPoolFromDiscoverer(d Discoverer) (*ServerPool, error) {
+	backends, err := d.Discover(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if len(backends) < 1 {
 		return nil, ErrNoServerAddressForPool
 	}
 
 	// Populate the pool with newly created TargetServer instances
 	var pool ServerPool
-	pool.Servers = make([]*TargetServer, len(addrs))
+	pool.discoverer = d
+	pool.discovererChanged = make(chan struct{})
+	pool.Servers = make([]*TargetServer, len(backends))
 
 	var seen = make(map[string]bool)
-	for i, s := range addrs {
-		if seen[s] {
+	for i, b := range backends {
+		if seen[b.Address] {
 			return nil, ErrDuplicateServerAddress
 		}
-		seen[s] = true
+		seen[b.Address] = true
 
-		server, err := NewTargetServer(s)
+		server, err := NewTargetServerFromConfig(b)
 		if err != nil {
 			return nil, err
 		}
@@ -57,88 +121,449 @@ func NewServerPool(addrs ServerAddresses) (*ServerPool, error) {
 
 	}
 
+	if WaitHealthy {
+		pool.RunHealthCheck()
+	}
+
 	// goroutine to start the health check process for the pool servers
 	ctx, cancel := context.WithCancel(context.Background())
-	pool.CancelHealthCheck = cancel
-	go (&pool).RunHealthCheckProcess(ctx, HealthCheckInterval)
+	pool.stop = cancel
+	pool.stopped.Add(3)
+	go func() {
+		defer pool.stopped.Done()
+		(&pool).RunHealthCheckProcess(ctx, HealthCheckInterval)
+	}()
+	go func() {
+		defer pool.stopped.Done()
+		(&pool).RunMaintenanceScheduler(ctx, MaintenanceCheckInterval)
+	}()
+	go func() {
+		defer pool.stopped.Done()
+		(&pool).RunDiscovery(ctx)
+	}()
 
 	return &pool, nil
 }
 
+// Stop stops the health check process, the maintenance scheduler and the discovery process of the
+// pool, and waits for them to return. It is safe to call more than once, and on a pool that wasn't
+// created by NewServerPool.
+func (pool *ServerPool) Stop() {
+	if pool.stop != nil {
+		pool.stop()
+	}
+	pool.stopped.Wait()
+}
+
 // RunHealthCheck is blocking and should be run as a separate goroutine in most case.
-// It's starts an infinite loop that periodically checks the health status of all the servers.
+// It's starts a loop that checks the health status of the servers that are due for a check
+// on every tick of interval, until ctx is done. Degraded servers are checked less often, as
+// they back off exponentially. The checks fire on a fixed schedule however long they take, and
+// a tick that comes while the previous checks are still running is skipped.
 func (pool *ServerPool) RunHealthCheckProcess(ctx context.Context, interval time.Duration) {
+	tick := pool.healthCheckTick(interval)
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
 
-	// Start an infinite loop
+	// Wait for the checks that are running before returning, so that nothing is left behind once the
+	// pool is stopped
+	var running sync.WaitGroup
+	var busy atomic.Bool
+	defer running.Wait()
+
+	// Start an infinite loop, until the pool is stopped
 	for {
+		if !pool.PauseHealthCheck && busy.CompareAndSwap(false, true) {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer busy.Store(false)
+				pool.runDueHealthChecks(time.Now(), interval)
+			}()
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			if !pool.PauseHealthCheck {
-				pool.RunHealthCheck()
-			}
+		case <-ticker.C:
+		}
+
+		// The servers of the pool may have changed, e.g. when the config file is reloaded
+		if t := pool.healthCheckTick(interval); t != tick {
+			tick = t
+			ticker.Reset(tick)
 		}
+	}
+}
 
-		time.Sleep(HealthCheckInterval)
+// healthCheckTick returns how often the health check process should look for the servers that are due
+// for a check, which is the shortest of interval and the health check intervals of the servers.
+func (pool *ServerPool) healthCheckTick(interval time.Duration) time.Duration {
+	tick := interval
+	for _, s := range pool.ServerList() {
+		if own := s.Settings().HealthCheckInterval; own > 0 && own < tick {
+			tick = own
+		}
 	}
+	return tick
 }
 
 // RunHealthCheck runs a single iteration of going through all the servers and
 // updating their health statuses.
 func (pool *ServerPool) RunHealthCheck() {
-	for _, server := range pool.Servers {
-		err := server.RefreshHealthStatus()
-		if err != nil {
-			clog.Errorf("There was an error updating the health for server: %s\n%s", server.Address, err)
+	refreshServersHealth(pool.ServerList(), HealthCheckInterval)
+}
+
+// RunDueHealthChecks updates the health status of only those servers whose next health check
+// time has arrived.
+func (pool *ServerPool) RunDueHealthChecks(now time.Time) {
+	pool.runDueHealthChecks(now, HealthCheckInterval)
+}
+
+// runDueHealthChecks is like RunDueHealthChecks, but the healthy servers are next checked after
+// interval rather than HealthCheckInterval.
+func (pool *ServerPool) runDueHealthChecks(now time.Time, interval time.Duration) {
+	var due []*TargetServer
+	for _, server := range pool.ServerList() {
+		if server.IsHealthCheckDue(now) {
+			due = append(due, server)
 		}
 	}
+	refreshServersHealth(due, interval)
 }
 
-// GetServer uses the provided algo to pick and return a healthy target server from the pool.
-func (pool *ServerPool) GetTargetServer(algo func(*ServerPool) (int, error)) (*TargetServer, error) {
-	index, err := algo(pool)
-	if err != nil {
-		return nil, err
+// refreshServersHealth refreshes the health status of the servers in parallel, with at most
+// HealthCheckConcurrency checks running at a time, so that one slow server doesn't hold up the
+// others. It returns once all the servers have been checked. Errors are logged for each server. The
+// healthy servers are next checked after interval.
+func refreshServersHealth(servers []*TargetServer, interval time.Duration) {
+	var wg sync.WaitGroup
+	var workers = make(chan struct{}, HealthCheckConcurrency)
+	for _, server := range servers {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(server *TargetServer) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			err := server.refreshHealthStatus(interval)
+			if err != nil {
+				clog.Errorf("There was an error updating the health for server: %s\n%s", server.Address, err)
+			}
+		}(server)
 	}
+	wg.Wait()
+}
+
+// WaitForHealthy blocks until at least one of the servers in the pool is healthy, checking every
+// interval. It logs the servers that are not healthy yet on every attempt. It returns ErrStartupTimeout
+// if ctx is done first.
+func (pool *ServerPool) WaitForHealthy(ctx context.Context, interval time.Duration) error {
+	return waitForHealthy(ctx, interval, pool.ServerList)
+}
 
-	clog.Debugf("RoundRobin server selected: %d", index)
+// waitForHealthy implements WaitForHealthy for the servers returned by list, which is called again on
+// every attempt so that servers added in the meantime are taken into account.
+func waitForHealthy(ctx context.Context, interval time.Duration, list func() []*TargetServer) error {
+	for attempt := 1; ; attempt++ {
+		var lagging []string
+		for _, s := range list() {
+			if s.IsHealthy() {
+				return nil
+			}
+			lagging = append(lagging, fmt.Sprintf("%s (%s)", s.Address, s.Status()))
+		}
+		clog.Infof("Waiting for a healthy server, attempt %d. Not healthy yet: %s", attempt, strings.Join(lagging, ", "))
 
-	return pool.Servers[index], nil
+		select {
+		case <-ctx.Done():
+			return ErrStartupTimeout
+		case <-time.After(interval):
+		}
+	}
 }
 
-// RoundRobin is the default (and only) algorithm for picking a healthy server from the pool.
-// It goes through the server in a loop and picks the next healthy server from the list.
-func RoundRobin(pool *ServerPool) (int, error) {
-	var cnt, index int
-	for {
-		// If we have looked at all the servers and haven't found any healthy,
-		// we should just error out with no healthy servers.
-		if cnt >= len(pool.Servers) {
-			break
+// GetServer uses the provided algo to pick and return a healthy target server from the pool. If the
+// pick is a server in its slow start window, it may be passed on and algo asked again, so that the
+// server only gets its fraction of the requests. The last pick is kept after asking once per server.
+func (pool *ServerPool) GetTargetServer(algo func(*ServerPool, []*TargetServer) (int, error)) (*TargetServer, error) {
+	now := time.Now()
+	for attempt := 0; ; attempt++ {
+		// The algorithm picks from a snapshot of the servers, so that the index it returns still points
+		// to the same server if the servers are reloaded in the meantime
+		servers := pool.ServerList()
+		index, err := algo(pool, servers)
+		if err != nil {
+			return nil, err
+		}
+		if attempt < len(servers) && skipForSlowStart(servers[index], now) {
+			continue
 		}
 
-		// Start from the index of the last used server and
-		if pool.Servers[pool.CurrentIndex].IsHealthy() {
-			index = pool.CurrentIndex
-			pool.IncrementCurrentIndex()
+		clog.Debugf("Server selected: %d", index)
+		return servers[index], nil
+	}
+}
+
+// RoundRobin is the default algorithm for picking a healthy server from the pool.
+// It goes through the server in a loop and picks the next healthy server from the list. The
+// whole selection happens under the pool lock, so that concurrent requests never read the same
+// index or skip one.
+func RoundRobin(pool *ServerPool, servers []*TargetServer) (int, error) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	// The last servers may have been removed, or the list may have shrunk since the last pick
+	if len(servers) == 0 {
+		clog.Warn("No servers in the pool")
+		return -1, ErrNoHealthyServer
+	}
+	if pool.CurrentIndex >= len(servers) {
+		pool.CurrentIndex = 0
+	}
+	selectable := selectableInTier(servers)
+
+	// If we have looked at all the servers and haven't found any healthy,
+	// we should just error out with no healthy servers.
+	for cnt := 0; cnt < len(servers); cnt++ {
+		// Start from the index of the last used server
+		index := pool.CurrentIndex
+		pool.incrementCurrentIndex(len(servers))
+		if selectable(servers[index]) {
+			if LogSelectionDecisions {
+				logSelection("RoundRobin", servers, index, fmt.Sprintf("it is the next selectable server, after skipping %d", cnt), nil)
+			}
 			return index, nil
 		}
-
-		pool.IncrementCurrentIndex()
-		cnt++
 	}
 	clog.Warn("No healthy servers found")
 	return -1, ErrNoHealthyServer
 }
 
+// AddLoad changes the number of requests in flight to the target server s by delta. It takes the pool
+// lock, as that's what the algorithms hold while comparing the load of the servers.
+func (pool *ServerPool) AddLoad(s *TargetServer, delta int) {
+	pool.Lock()
+	defer pool.Unlock()
+	s.Load += delta
+	s.conns.Store(int64(s.Load))
+}
+
+// acquireLoad counts a new request towards the load of the target server s, like AddLoad, unless s
+// already has MaxConns requests in flight. It returns false if s is at its cap.
+func (pool *ServerPool) acquireLoad(s *TargetServer) bool {
+	pool.Lock()
+	defer pool.Unlock()
+	if maxConns := s.Settings().MaxConns; maxConns > 0 && s.Load >= maxConns {
+		return false
+	}
+	s.Load++
+	s.conns.Store(int64(s.Load))
+	return true
+}
+
+// responseTimeWeight is the weight of the latest response in the moving average of the response time
+// of a server. The higher it is, the faster the average follows changes in the latency of the server.
+const responseTimeWeight = 0.3
+
+// failedResponseTime is the least a failed request counts for in the moving average of the response
+// time of a server, so that a server that refuses connections or errors out quickly doesn't look fast.
+const failedResponseTime = 10 * time.Second
+
+// ObserveFailure adds a failed request to the target server s, that took d, to its moving average of
+// the response time.
+func (pool *ServerPool) ObserveFailure(s *TargetServer, d time.Duration) {
+	pool.ObserveResponseTime(s, max(d, failedResponseTime))
+}
+
+// ObserveResponseTime adds the time the target server s took to respond to its moving average, under
+// the pool lock.
+func (pool *ServerPool) ObserveResponseTime(s *TargetServer, d time.Duration) {
+	pool.Lock()
+	defer pool.Unlock()
+	if s.responseTime == 0 {
+		s.responseTime = d
+		return
+	}
+	s.responseTime = time.Duration(responseTimeWeight*float64(d) + (1-responseTimeWeight)*float64(s.responseTime))
+}
+
+// PoolStats is a point in time snapshot of the state of a pool, as returned by Stats. It is a copy, so
+// it can be held on to and changed without affecting the pool.
+type PoolStats struct {
+	Total      int `json:"total"`
+	Healthy    int `json:"healthy"`
+	Degraded   int `json:"degraded"`
+	Unknown    int `json:"unknown"`
+	Warming    int `json:"warming"`
+	Selectable int `json:"selectable"`
+
+	Servers []ServerStats `json:"servers"`
+}
+
+// ServerStats is the state of a target server in PoolStats.
+type ServerStats struct {
+	Address    string       `json:"address"`
+	Health     HealthStatus `json:"health"`
+	Selectable bool         `json:"selectable"`
+	Load       int          `json:"load"`
+}
+
+// Stats returns a snapshot of the health and load of all the servers in the pool, taken under the pool
+// lock.
+func (pool *ServerPool) Stats() PoolStats {
+	pool.Lock()
+	defer pool.Unlock()
+
+	stats := PoolStats{Total: len(pool.Servers), Servers: make([]ServerStats, len(pool.Servers))}
+	for i, s := range pool.Servers {
+		health := s.Status()
+		switch health {
+		case StatusHealthy:
+			stats.Healthy++
+		case StatusDegraded:
+			stats.Degraded++
+		case StatusWarming:
+			stats.Warming++
+		default:
+			stats.Unknown++
+		}
+		if s.IsSelectable() {
+			stats.Selectable++
+		}
+		stats.Servers[i] = ServerStats{
+			Address:    s.Address,
+			Health:     health,
+			Selectable: s.IsSelectable(),
+			Load:       s.Load,
+		}
+	}
+	return stats
+}
+
+// transport returns the transport for the requests to the servers in the pool.
+func (pool *ServerPool) transport() http.RoundTripper {
+	if pool.Transport != nil {
+		return pool.Transport
+	}
+	return backendTransport
+}
+
+// transportFor returns the transport for the requests to the server s of the pool: the transport of s
+// itself if it has one, like the servers on a Unix socket and the resolved https servers do, and the
+// transport of the pool otherwise.
+func (pool *ServerPool) transportFor(s *TargetServer) http.RoundTripper {
+	if s.transport != nil {
+		return s.transport
+	}
+	return pool.transport()
+}
+
+// ServerList returns the current list of servers in the pool. The pool never modifies a list once
+// it has been handed out, so it is safe to go through it without holding the pool lock.
+func (pool *ServerPool) ServerList() []*TargetServer {
+	pool.Lock()
+	defer pool.Unlock()
+	return pool.Servers
+}
+
+// Reconcile updates the servers in the pool to match backends, which is the new desired list of
+// servers, and keeps them in line with it from then on, in place of the backends the pool was created
+// with. Servers that are no longer in the list are removed, and new ones are added. The servers that stay
+// keep their state, including their health and load, with only their settings updated. Nothing is
+// changed if any of the backends is invalid or fails to resolve. It returns the addresses of the added
+// and removed servers.
+func (pool *ServerPool) Reconcile(backends []BackendConfig) (added, removed []string, err error) {
+	d := discovererFor(backends)
+	discovered, err := d.Discover(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	added, removed, err = pool.reconcile(discovered)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool.setDiscoverer(d)
+	return added, removed, nil
+}
+
+// reconcile is like Reconcile, but for a list of backends that has already been discovered, and leaves
+// the discoverer of the pool as it is.
+func (pool *ServerPool) reconcile(backends []BackendConfig) (added, removed []string, err error) {
+	// Create a server for each of the backends first, so that we don't make any change if one fails
+	var seen = make(map[string]bool)
+	var configured = make([]*TargetServer, len(backends))
+	for i, b := range backends {
+		if seen[b.Address] {
+			return nil, nil, ErrDuplicateServerAddress
+		}
+		seen[b.Address] = true
+
+		configured[i], err = NewTargetServerFromConfig(b)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pool.Lock()
+	defer pool.Unlock()
+
+	var existing = make(map[string]*TargetServer, len(pool.Servers))
+	for _, s := range pool.Servers {
+		existing[s.Address] = s
+	}
+
+	// Build a new list rather than changing the current one, as it may be in use
+	var servers = make([]*TargetServer, len(configured))
+	for i, c := range configured {
+		s, ok := existing[c.Address]
+		if !ok {
+			servers[i] = c
+			added = append(added, c.Address)
+			continue
+		}
+		s.applySettings(c)
+		servers[i] = s
+		delete(existing, c.Address)
+	}
+	for _, s := range pool.Servers {
+		if _, ok := existing[s.Address]; ok {
+			removed = append(removed, s.Address)
+		}
+	}
+
+	pool.Servers = servers
+	if pool.CurrentIndex >= len(servers) {
+		pool.CurrentIndex = 0
+	}
+	return added, removed, nil
+}
+
+// FindServer returns the server in the pool with the address addr.
+func (pool *ServerPool) FindServer(addr string) (*TargetServer, error) {
+	for _, s := range pool.ServerList() {
+		if s.Address == addr {
+			return s, nil
+		}
+	}
+	return nil, ErrServerNotFound
+}
+
 // IncrementCurrentIndex atomically increments the current index pointer for the pool. Current index
 // pointer is important as it provides a reference for what target server did we use last and where
 // should we start searching for again.
 func (pool *ServerPool) IncrementCurrentIndex() {
 	pool.Lock()
 	defer pool.Unlock()
-	if pool.CurrentIndex+1 >= len(pool.Servers) {
+	pool.incrementCurrentIndex(len(pool.Servers))
+}
+
+// incrementCurrentIndex is the same as IncrementCurrentIndex, but expects the caller to hold the
+// pool lock. It wraps around at n, the number of servers in the snapshot the algorithm picks from.
+func (pool *ServerPool) incrementCurrentIndex(n int) {
+	// This also resets the index when the pool is empty, instead of going past the end of it
+	if pool.CurrentIndex+1 >= n {
 		pool.CurrentIndex = 0
 	} else {
 		pool.CurrentIndex++
@@ -148,13 +573,13 @@ func (pool *ServerPool) IncrementCurrentIndex() {
 // Functions to help mock change the state of the pool
 
 func (pool *ServerPool) DegradeAll() {
-	for _, t := range pool.Servers {
+	for _, t := range pool.ServerList() {
 		t.Degrade()
 	}
 }
 
 func (pool *ServerPool) HealthyAll() {
-	for _, t := range pool.Servers {
+	for _, t := range pool.ServerList() {
 		t.SetStatus(StatusHealthy)
 	}
 }
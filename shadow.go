@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Shadow traffic mirrors a sample of the requests to a shadow target server, e.g. a new version of a
+// backend under test. The client is always served by the pool as usual: the shadow request is only
+// sent once the client has its response, in the background, and its response is logged and dropped.
+var (
+	// ShadowAddress is the address of the shadow target server. Shadow traffic is off when it is empty.
+	ShadowAddress string
+	// ShadowRate is the fraction of the requests that are mirrored to the shadow target server.
+	ShadowRate float64 = 1
+	// ShadowTimeout is the longest a shadow request can take.
+	ShadowTimeout time.Duration = 10 * time.Second
+	// ShadowMaxInflight is the most shadow requests in flight at the same time. Requests that come
+	// while it is reached are not mirrored, so that a slow shadow target server doesn't pile them up.
+	ShadowMaxInflight = 100
+)
+
+var ErrInvalidShadowRate = errors.New("shadow rate should be between 0 and 1")
+
+// shadowTarget is the shadow target server, or nil when shadow traffic is off.
+var shadowTarget *TargetServer
+
+// shadowSlots holds a token for every shadow request in flight.
+var shadowSlots chan struct{}
+
+// initShadow sets up the shadow target server from ShadowAddress. It should be called once the flags
+// have been parsed.
+func initShadow() error {
+	if ShadowRate < 0 || ShadowRate > 1 {
+		return ErrInvalidShadowRate
+	}
+	if ShadowAddress == "" {
+		shadowTarget = nil
+		return nil
+	}
+	target, err := NewTargetServer(ShadowAddress)
+	if err != nil {
+		return err
+	}
+	shadowTarget = target
+	shadowSlots = make(chan struct{}, ShadowMaxInflight)
+	return nil
+}
+
+// shouldShadow returns true if a request should be mirrored to the shadow target server, based on
+// ShadowRate.
+func shouldShadow() bool {
+	return shadowTarget != nil && ShadowRate > 0 && randFloat64() < ShadowRate
+}
+
+// shadowRequest sends a copy of req to the shadow target server in the background, if there is a free
+// slot for it. The body of req needs to be buffered, unless it has none. It must be called once the
+// client has been served, and never affects the client.
+func shadowRequest(req *http.Request) {
+	target, slots := shadowTarget, shadowSlots
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if hasBody && req.GetBody == nil {
+		// The body was too large to be buffered, and has been sent to the pool
+		return
+	}
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		logEvent(levelWarning, "Too many shadow requests in flight, not mirroring the request",
+			logField{"backend", target.Address})
+		return
+	}
+
+	// The shadow request outlives the client request, so it gets a context of its own
+	ctx, cancel := context.WithTimeout(context.Background(), ShadowTimeout)
+	outReq := req.Clone(ctx)
+	outReq.Body = http.NoBody
+	if hasBody {
+		outReq.Body, _ = req.GetBody()
+	}
+	redirectRequestToServer(outReq, target)
+	path := req.URL.Path
+
+	go func() {
+		defer func() { <-slots }()
+		defer cancel()
+
+		start := time.Now()
+		resp, err := backendTransport.RoundTrip(outReq)
+		if err != nil {
+			logEvent(levelWarning, "Shadow request failed",
+				logField{"backend", target.Address},
+				logField{"path", path},
+				logField{"error", err.Error()},
+				logField{"latency", time.Since(start)},
+			)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		logEvent(levelInfo, "Shadow request",
+			logField{"backend", target.Address},
+			logField{"path", path},
+			logField{"status", resp.StatusCode},
+			logField{"latency", time.Since(start)},
+		)
+	}()
+}
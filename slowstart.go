@@ -0,0 +1,35 @@
+package main
+
+import "time"
+
+// SlowStartWindow is how long a server that recovers from being degraded takes to ramp up to its full
+// share of requests. Its share grows linearly over the window. A value of 0 disables slow start.
+var SlowStartWindow time.Duration = 30 * time.Second
+
+// SlowStartFactor returns the fraction of its normal share of requests that the target server s should
+// get at now: 1 once it is out of its slow start window, and growing linearly from 0 within it.
+func (s *TargetServer) SlowStartFactor(now time.Time) float64 {
+	s.healthLock.RLock()
+	recoveredAt := s.recoveredAt
+	s.healthLock.RUnlock()
+
+	if SlowStartWindow <= 0 || recoveredAt.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(recoveredAt)
+	if elapsed >= SlowStartWindow {
+		return 1
+	}
+	if elapsed < 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(SlowStartWindow)
+}
+
+// skipForSlowStart returns true if a pick of the target server s should be passed on to the next one
+// because s is still ramping up. The chance of skipping drops linearly over the slow start window, so
+// that s gets the right fraction of its normal share whatever the algorithm.
+func skipForSlowStart(s *TargetServer, now time.Time) bool {
+	factor := s.SlowStartFactor(now)
+	return factor < 1 && randFloat64() >= factor
+}
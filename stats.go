@@ -0,0 +1,240 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// StatsWindow is the length of the rolling window over which the pool statistics are aggregated.
+var StatsWindow time.Duration = time.Minute
+
+// Latency histogram buckets grow exponentially from histogramMin, so that the relative error of the
+// percentiles stays about the same from sub-millisecond to minute long latencies.
+const (
+	histogramMin     = 100 * time.Microsecond
+	histogramGrowth  = 1.25
+	histogramBuckets = 64
+)
+
+// LatencyHistogram is a lightweight bucketed histogram of latencies, from which percentiles can be
+// estimated. The zero value is an empty histogram, ready to use. It is not safe for concurrent use.
+type LatencyHistogram struct {
+	counts [histogramBuckets]uint64
+	total  uint64
+}
+
+// bucketIndex returns the index of the bucket that holds d.
+func bucketIndex(d time.Duration) int {
+	if d < histogramMin {
+		return 0
+	}
+	i := int(math.Log(float64(d)/float64(histogramMin))/math.Log(histogramGrowth)) + 1
+	if i >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return i
+}
+
+// bucketBounds returns the range of latencies held by the bucket at index i.
+func bucketBounds(i int) (time.Duration, time.Duration) {
+	if i == 0 {
+		return 0, histogramMin
+	}
+	lower := float64(histogramMin) * math.Pow(histogramGrowth, float64(i-1))
+	return time.Duration(lower), time.Duration(lower * histogramGrowth)
+}
+
+// Observe adds the latency d to the histogram.
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	h.counts[bucketIndex(d)]++
+	h.total++
+}
+
+// Merge adds all the latencies in o to the histogram.
+func (h *LatencyHistogram) Merge(o *LatencyHistogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+}
+
+// Count returns the number of latencies in the histogram.
+func (h *LatencyHistogram) Count() uint64 {
+	return h.total
+}
+
+// Quantile estimates the latency below which the fraction q of the latencies in the histogram fall,
+// interpolating within the bucket. It returns 0 for an empty histogram.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := q * float64(h.total)
+	var cumulative float64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if cumulative+float64(c) >= rank {
+			lower, upper := bucketBounds(i)
+			fraction := (rank - cumulative) / float64(c)
+			return lower + time.Duration(fraction*float64(upper-lower))
+		}
+		cumulative += float64(c)
+	}
+	_, upper := bucketBounds(histogramBuckets - 1)
+	return upper
+}
+
+// LatencyPercentiles is the JSON representation of the commonly used percentiles of a histogram, in
+// milliseconds.
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50_ms"`
+	P95 float64 `json:"p95_ms"`
+	P99 float64 `json:"p99_ms"`
+}
+
+// Percentiles returns the p50, p95 and p99 latencies of the histogram.
+func (h *LatencyHistogram) Percentiles() LatencyPercentiles {
+	return LatencyPercentiles{
+		P50: durationToMillis(h.Quantile(0.50)),
+		P95: durationToMillis(h.Quantile(0.95)),
+		P99: durationToMillis(h.Quantile(0.99)),
+	}
+}
+
+func durationToMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// WindowedStats aggregates requests over a rolling time window. The window is split into one second
+// buckets held in a ring, so recording a request and taking a snapshot are both cheap.
+type WindowedStats struct {
+	sync.Mutex
+	window  time.Duration
+	buckets []statsBucket
+}
+
+// statsBucket holds the requests that finished in one second.
+type statsBucket struct {
+	second   int64
+	requests uint64
+	errors   uint64
+	latency  LatencyHistogram
+}
+
+// NewWindowedStats creates a WindowedStats that aggregates over window, rounded up to a second.
+func NewWindowedStats(window time.Duration) *WindowedStats {
+	seconds := int((window + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &WindowedStats{
+		window:  time.Duration(seconds) * time.Second,
+		buckets: make([]statsBucket, seconds),
+	}
+}
+
+// Record adds a request that finished at now with the status code and latency. Any 5xx status counts
+// as an error.
+func (ws *WindowedStats) Record(now time.Time, status int, latency time.Duration) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	sec := now.Unix()
+	b := &ws.buckets[sec%int64(len(ws.buckets))]
+	if b.second != sec {
+		*b = statsBucket{second: sec}
+	}
+	b.requests++
+	if status >= http.StatusInternalServerError {
+		b.errors++
+	}
+	b.latency.Observe(latency)
+}
+
+// StatsSnapshot is the aggregate of the requests over a window.
+type StatsSnapshot struct {
+	Window            string             `json:"window"`
+	Requests          uint64             `json:"requests"`
+	RequestsPerSecond float64            `json:"requests_per_sec"`
+	ErrorRate         float64            `json:"error_rate"`
+	Latency           LatencyPercentiles `json:"latency"`
+	HealthyServers    int                `json:"healthy_servers"`
+	TotalServers      int                `json:"total_servers"`
+}
+
+// Snapshot aggregates the requests that finished in the window ending at now.
+func (ws *WindowedStats) Snapshot(now time.Time) StatsSnapshot {
+	ws.Lock()
+	defer ws.Unlock()
+
+	var requests, errors uint64
+	var latency LatencyHistogram
+	oldest := now.Unix() - int64(len(ws.buckets))
+	for i := range ws.buckets {
+		b := &ws.buckets[i]
+		if b.second <= oldest || b.second > now.Unix() {
+			continue
+		}
+		requests += b.requests
+		errors += b.errors
+		latency.Merge(&b.latency)
+	}
+
+	snapshot := StatsSnapshot{
+		Window:            ws.window.String(),
+		Requests:          requests,
+		RequestsPerSecond: float64(requests) / ws.window.Seconds(),
+		Latency:           latency.Percentiles(),
+	}
+	if requests > 0 {
+		snapshot.ErrorRate = float64(errors) / float64(requests)
+	}
+	return snapshot
+}
+
+// RecordResponse adds a response from the target server s, with its status code and the time it took
+// for the response headers to come back. A request that failed without a response counts as a 502.
+// It also feeds the outlier detection and the slow server ejection of s.
+func (s *TargetServer) RecordResponse(status int, latency time.Duration) {
+	now := time.Now()
+	s.responses.Record(now, status, latency)
+	s.observeOutcome(now, status)
+	s.observeLatency(now, latency)
+}
+
+// ResponseStats returns the aggregate of the responses from the target server s over StatsWindow.
+func (s *TargetServer) ResponseStats() StatsSnapshot {
+	return s.responses.Snapshot(time.Now())
+}
+
+// RequestStats returns the aggregate of the requests forwarded to the pool over StatsWindow, along
+// with the number of healthy servers in it.
+func (pool *ServerPool) RequestStats() StatsSnapshot {
+	snapshot := pool.requestStats().Snapshot(time.Now())
+	stats := pool.Stats()
+	snapshot.HealthyServers, snapshot.TotalServers = stats.Healthy, stats.Total
+	return snapshot
+}
+
+// requestStats returns the aggregator of the requests forwarded to the pool. It is created on first use,
+// so that the pools created in any way get one, once StatsWindow has been set from the flags.
+func (pool *ServerPool) requestStats() *WindowedStats {
+	pool.requestsOnce.Do(func() {
+		pool.requests = NewWindowedStats(StatsWindow)
+	})
+	return pool.requests
+}
+
+// adminStatsHandler serves the aggregate statistics of the requests over the stats window for each of
+// the pools, by the names given by namedPools.
+func (lb *LoadBalancer) adminStatsHandler(w http.ResponseWriter, req *http.Request) {
+	stats := make(map[string]StatsSnapshot)
+	for name, p := range lb.namedPools() {
+		stats[name] = p.RequestStats()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
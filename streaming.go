@@ -0,0 +1,53 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// isStreamingResponse returns true if resp is meant to reach the client as it is produced, rather than
+// whenever the response writer's buffer fills up. That's the case for server-sent events, and for any
+// response whose length isn't known up front, like a chunked response.
+func isStreamingResponse(resp *http.Response) bool {
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && mediaType == "text/event-stream" {
+		return true
+	}
+	return resp.ContentLength == -1
+}
+
+// copyResponseBody copies the body of resp to w. Streaming responses are flushed to the client after
+// every write, so that they are passed through as they come.
+func copyResponseBody(w http.ResponseWriter, resp *http.Response) (int64, error) {
+	if !isStreamingResponse(resp) {
+		return io.Copy(w, resp.Body)
+	}
+	return io.Copy(&flushWriter{w: w, rc: http.NewResponseController(w)}, resp.Body)
+}
+
+// flushWriter flushes the response to the client after every write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+	// gz, if set, is the gzip writer that w writes through. It is flushed first, so that the data it
+	// holds on to reaches the client.
+	gz *gzip.Writer
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if f.gz != nil {
+		if err := f.gz.Flush(); err != nil {
+			return n, err
+		}
+	}
+	// Writers that can't flush, like the recorders used in tests, are written to as usual
+	if err := f.rc.Flush(); err != nil && err != http.ErrNotSupported {
+		return n, err
+	}
+	return n, nil
+}
@@ -7,7 +7,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/teejays/clog"
@@ -16,12 +19,67 @@ import (
 // HealthEndpoint is the backend server endpoint that provides the health status information
 const HealthEndpoint string = "_health"
 
-// Health Status identifiers
+// Health check modes, which decide how the response from the health endpoint is interpreted
 const (
-	StatusDegraded HealthStatus = iota
+	// HealthModeJSON expects a JSON body with a State field that is either "healthy" or "degraded".
+	HealthModeJSON string = "json"
+	// HealthModeStatus only looks at the status code. Any 2xx response means healthy, anything else
+	// means degraded.
+	HealthModeStatus string = "status"
+	// HealthModeTCP doesn't make a request at all. A server that accepts a TCP connection within
+	// HealthCheckTimeout is healthy, for the servers that have no health endpoint.
+	HealthModeTCP string = "tcp"
+	// HealthModeGRPC calls the Check method of the standard gRPC health service (grpc.health.v1) of the
+	// server. A server that reports SERVING is healthy. It is only available in the builds with the
+	// grpchealth build tag.
+	HealthModeGRPC string = "grpc"
+)
+
+// grpcHealthStatus checks the health of the target server s with the gRPC health service, within
+// timeout. It is set by main_grpchealth.go, and is nil in the builds without the grpchealth build tag.
+var grpcHealthStatus func(s *TargetServer, timeout time.Duration) (HealthStatus, error)
+
+// HealthCheckMode is the mode used by all the target servers for checking their health.
+var HealthCheckMode = HealthModeJSON
+
+// HealthCheckTimeout is the longest a health check can take, including reading the response, before
+// the target server is considered degraded. It keeps a server that accepts connections but never
+// responds from holding up the health checks.
+var HealthCheckTimeout = 5 * time.Second
+
+// HealthyThreshold is the number of health checks in a row that need to pass for a target server to
+// become healthy, and UnhealthyThreshold the number that need to fail for it to become degraded. Higher
+// values keep a flapping server from going in and out of rotation on every check.
+var (
+	HealthyThreshold   = 1
+	UnhealthyThreshold = 1
+)
+
+// BackendMaxConns caps the number of requests in flight to each target server, so that a burst can't
+// overwhelm a single one of them. A server at its cap is skipped by the selection algorithms until one
+// of its requests is done. A value of 0 means there is no limit.
+var BackendMaxConns int
+
+// HealthDecorator is an optional hook that can adjust the result of every health check before it is
+// applied to the target server, e.g. to force a server out of rotation based on an external signal. It
+// gets the status and error from the health check, and returns the status to apply. The error of the
+// health check is still returned by RefreshHealthStatus as is.
+var HealthDecorator func(server *TargetServer, status HealthStatus, err error) HealthStatus
+
+// Health Status identifiers. StatusUnknown is the zero value, so a new server is neither healthy nor
+// degraded until its first health check. Like a degraded server, it is never picked for requests.
+// StatusWarming is only used when warmup is on, for a server that passed its health checks but hasn't
+// been warmed up yet, and isn't picked for requests either.
+const (
+	StatusUnknown HealthStatus = iota
+	StatusDegraded
 	StatusHealthy
+	StatusWarming
 )
 
+// healthHistorySize is the number of most recent health transitions kept for each target server.
+const healthHistorySize int = 16
+
 type (
 	TargetServer struct {
 		Address       string
@@ -29,11 +87,132 @@ type (
 		Load          int
 		Health        HealthStatus
 		HealthUpdated time.Time
+
+		// SocketPath is the path of the Unix socket of a server with a unix:// address, and transport is
+		// the transport that dials it. Both are empty for the other servers.
+		SocketPath string
+		transport  http.RoundTripper
+		// tlsServerName is the host name of an https server whose address has the IP address it resolved
+		// to instead, and transport is then the transport that uses it for TLS. It is empty otherwise.
+		tlsServerName string
+
+		// conns mirrors Load, which is guarded by the pool lock, so that it can be checked against
+		// MaxConns without the pool lock.
+		conns atomic.Int64
+
+		// healthLock guards Health and everything that changes along with it: HealthUpdated, the health
+		// check schedule, recoveredAt and the health history. The health of a server is updated both by
+		// the health checks and by the requests it fails.
+		healthLock sync.RWMutex
+
+		// settings are the configurable settings of the server.
+		settings atomic.Pointer[ServerSettings]
+
+		// healthChecksPassed and healthChecksFailed count the health checks in a row that passed or
+		// failed since the health of the server last changed.
+		healthChecksPassed int
+		healthChecksFailed int
+		// warmingFrom is the health of the server before it started warming up.
+		warmingFrom HealthStatus
+
+		// currentWeight is the running weight of the server in the smooth weighted round robin.
+		currentWeight int
+
+		// draining is true when the server should not receive any new requests, while the requests
+		// already sent to it are allowed to finish. It is independent of the health of the server. It is
+		// set through the admin API while the requests read it, hence the atomic.
+		draining atomic.Bool
+
+		// inMaintenance is true while the server is in its maintenance window, during which it is
+		// drained. It is set by the maintenance scheduler while the requests read it, hence the atomic.
+		inMaintenance atomic.Bool
+
+		// NextHealthCheck is the time at which the health of the server should be checked again.
+		NextHealthCheck time.Time
+		// healthCheckBackoff is the current wait between two health checks of the server. It grows
+		// while the server stays degraded.
+		healthCheckBackoff time.Duration
+		// clock tells the time the next health check is scheduled from. It is time.Now, unless the tests
+		// fake it.
+		clock func() time.Time
+
+		// responseTime is the exponentially weighted moving average of the time the server takes to
+		// respond. It is 0 until the server has responded once.
+		responseTime time.Duration
+
+		// backOffUntil is the time, in Unix nanoseconds, until which the server asked not to get any new
+		// requests with a Retry-After header, or 0.
+		backOffUntil atomic.Int64
+		// penaltyUntil is the time, in Unix nanoseconds, until which the server is passed over after a
+		// failed request, or 0.
+		penaltyUntil atomic.Int64
+
+		// outliers tracks the errors of the server for outlier detection, and whether it is ejected.
+		outliers outlierDetector
+
+		// responses aggregates the responses of the server over StatsWindow, for its latency percentiles.
+		responses *WindowedStats
+
+		// recoveredAt is the last time the server went from degraded to healthy. It is when its slow
+		// start window begins.
+		recoveredAt time.Time
+
+		// healthHistory is a ring buffer of the most recent health transitions of the server.
+		healthHistory [healthHistorySize]HealthTransition
+		// healthHistoryNext is the position in healthHistory where the next transition goes.
+		healthHistoryNext int
+		// healthHistoryCount is the number of transitions held in healthHistory.
+		healthHistoryCount int
+	}
+
+	// ServerSettings are the configurable settings of a target server. They are never changed in place:
+	// a configuration reload or the admin API swaps in a new copy, so that the requests and the health
+	// checks can read them without a lock.
+	ServerSettings struct {
+		// HealthEndpoint is the path of the health endpoint of the server, relative to its address.
+		HealthEndpoint string
+		// HealthHeaders are sent with every health check of the server. A Host header sets the host the
+		// health check is made for.
+		HealthHeaders http.Header
+		// HealthExpect is what the body of the health responses of the server should meet. HealthExpect
+		// applies when it is nil.
+		HealthExpect *HealthExpectation
+		// HealthyThreshold and UnhealthyThreshold are the numbers of health checks in a row that need to
+		// pass or fail for the server to become healthy or degraded.
+		HealthyThreshold   int
+		UnhealthyThreshold int
+		// HealthCheckInterval is how often the health of the server is checked while it is healthy. The
+		// interval of its pool applies when it is 0.
+		HealthCheckInterval time.Duration
+
+		// StripPrefix is removed from the path of the requests forwarded to the server, and AddPrefix is
+		// then added to it. The path of the server address itself always comes first.
+		StripPrefix string
+		AddPrefix   string
+
+		// Weight is the relative share of requests the server gets from the weighted algorithms. A
+		// server with a weight of 0 is never picked by them.
+		Weight int
+		// MaxConns is the most requests the server can have in flight at the same time. 0 means no limit.
+		MaxConns int
+		// Tier is TierBackup for a server that only gets requests while none of the primary servers of its
+		// pool can take them, and TierPrimary otherwise.
+		Tier string
+
+		// Maintenance is the daily maintenance window of the server, if it has one.
+		Maintenance *MaintenanceWindow
 	}
 
 	// HealthStatus is a type alias to better handle target server states.
 	HealthStatus int
 
+	// HealthTransition records a change in the health status of a target server.
+	HealthTransition struct {
+		From HealthStatus `json:"from"`
+		To   HealthStatus `json:"to"`
+		At   time.Time    `json:"at"`
+	}
+
 	// HealthResponse is the structure of response received from the /_health endpoint of the target servers.
 	HealthResponse struct {
 		State   string
@@ -45,6 +224,9 @@ var (
 	ErrEmptyAddress                  = errors.New("address passed for NewTargetServer is empty")
 	ErrEmptyStatusInHealthResponse   = errors.New("status field in the health response is empty")
 	ErrInvalidStatusInHealthResponse = errors.New("status field in the health response is invalid")
+	ErrInvalidHealthThreshold        = errors.New("healthy and unhealthy thresholds should be at least 1")
+	ErrInvalidHealthCheckMode        = fmt.Errorf("health check mode should be one of: %s, %s, %s, %s", HealthModeJSON, HealthModeStatus, HealthModeTCP, HealthModeGRPC)
+	ErrGRPCHealthNotBuiltIn          = errors.New("health check mode grpc is only available in builds with the grpchealth build tag")
 )
 
 func NewTargetServer(address string) (*TargetServer, error) {
@@ -59,31 +241,241 @@ func NewTargetServer(address string) (*TargetServer, error) {
 	}
 
 	server := TargetServer{
-		Address: address,
-		URL:     _url,
+		Address:   address,
+		URL:       _url,
+		responses: NewWindowedStats(StatsWindow),
+		clock:     time.Now,
+	}
+	server.settings.Store(&ServerSettings{
+		HealthEndpoint:     HealthEndpoint,
+		Weight:             1,
+		Tier:               TierPrimary,
+		MaxConns:           BackendMaxConns,
+		HealthyThreshold:   HealthyThreshold,
+		UnhealthyThreshold: UnhealthyThreshold,
+	})
+
+	if _url.Scheme == schemeUnix {
+		if err := server.setUnixSocket(_url); err != nil {
+			return nil, err
+		}
 	}
 
 	return &server, nil
 
 }
 
+// NewTargetServerFromConfig creates a new TargetServer for the backend config b, applying any of the
+// optional settings that are present in it.
+func NewTargetServerFromConfig(b BackendConfig) (*TargetServer, error) {
+	server, err := NewTargetServer(b.Address)
+	if err != nil {
+		return nil, err
+	}
+	settings := *server.Settings()
+	if b.Weight != nil {
+		settings.Weight = *b.Weight
+	}
+	if b.Tier != "" {
+		settings.Tier = b.Tier
+	}
+	if b.MaxConns > 0 {
+		settings.MaxConns = b.MaxConns
+	}
+	if b.HealthPath != "" {
+		settings.HealthEndpoint = strings.TrimPrefix(b.HealthPath, "/")
+	}
+	for name, value := range b.HealthHeaders {
+		if settings.HealthHeaders == nil {
+			settings.HealthHeaders = make(http.Header)
+		}
+		settings.HealthHeaders.Set(name, value)
+	}
+	settings.HealthExpect = b.HealthExpect
+	if b.HealthyThreshold > 0 {
+		settings.HealthyThreshold = b.HealthyThreshold
+	}
+	if b.UnhealthyThreshold > 0 {
+		settings.UnhealthyThreshold = b.UnhealthyThreshold
+	}
+	settings.HealthCheckInterval = time.Duration(b.HealthInterval)
+	settings.StripPrefix = b.StripPrefix
+	settings.AddPrefix = b.AddPrefix
+	if b.Maintenance != nil {
+		window := *b.Maintenance
+		if err := window.parse(); err != nil {
+			return nil, err
+		}
+		settings.Maintenance = &window
+	}
+	server.settings.Store(&settings)
+	if b.serverName != "" {
+		server.setTLSServerName(b.serverName)
+	}
+	return server, nil
+}
+
+// Settings returns the current settings of the target server s. They must not be changed: use
+// UpdateSettings instead.
+func (s *TargetServer) Settings() *ServerSettings {
+	return s.settings.Load()
+}
+
+// UpdateSettings changes the settings of the target server s with update, which is given a copy of
+// the current settings to change. The copy then replaces the settings as a whole.
+func (s *TargetServer) UpdateSettings(update func(*ServerSettings)) {
+	for {
+		current := s.settings.Load()
+		settings := *current
+		update(&settings)
+		if s.settings.CompareAndSwap(current, &settings) {
+			return
+		}
+	}
+}
+
+// applySettings copies the configurable settings of the target server c over to s, leaving the state
+// of s as is. Nothing is written if the settings are the same, so that the servers that are reconciled
+// over and over again by a discoverer aren't touched while they are in use.
+func (s *TargetServer) applySettings(c *TargetServer) {
+	settings := c.Settings()
+	if reflect.DeepEqual(s.Settings(), settings) {
+		return
+	}
+	s.settings.Store(settings)
+	if settings.Maintenance == nil {
+		s.SetInMaintenance(false)
+	}
+}
+
 // IsHealthy returns true if the target server s is in a healthy state.
 func (s *TargetServer) IsHealthy() bool {
-	if s.Health == StatusHealthy {
-		return true
+	return s.Status() == StatusHealthy
+}
+
+// Status returns the health status of the target server s.
+func (s *TargetServer) Status() HealthStatus {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+	return s.Health
+}
+
+// LastHealthUpdate returns the last time the health status of the target server s was set.
+func (s *TargetServer) LastHealthUpdate() time.Time {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+	return s.HealthUpdated
+}
+
+// IsSelectable returns true if the target server s can be picked for forwarding a new client request.
+// A server needs to be healthy, and neither draining, in maintenance, ejected, backing off nor at its
+// MaxConns, to be selectable.
+func (s *TargetServer) IsSelectable() bool {
+	now := time.Now()
+	return s.IsHealthy() && !s.IsDraining() && !s.IsInMaintenance() && !s.IsEjected(now) && !s.IsBackingOff(now) && !s.atMaxConns()
+}
+
+// atMaxConns returns true if the target server s has as many requests in flight as it can take.
+func (s *TargetServer) atMaxConns() bool {
+	maxConns := s.Settings().MaxConns
+	return maxConns > 0 && s.conns.Load() >= int64(maxConns)
+}
+
+// SetDraining puts the target server s in or out of the draining mode. A draining server is not
+// picked for new requests, but its health is still checked as usual.
+func (s *TargetServer) SetDraining(draining bool) {
+	if s.draining.Swap(draining) == draining {
+		return
+	}
+	if draining {
+		clog.Noticef("A server is being drained: %s", s.Address)
+	} else {
+		clog.Noticef("A server is no longer being drained: %s", s.Address)
 	}
-	return false
+}
+
+// IsDraining returns true if the target server s is in the draining mode.
+func (s *TargetServer) IsDraining() bool {
+	return s.draining.Load()
 }
 
 // RefreshHealthStatus refreshes the health status record of the target server s by making a fresh call
 // to the health endpoint for the target server.
 func (s *TargetServer) RefreshHealthStatus() error {
+	return s.refreshHealthStatus(HealthCheckInterval)
+}
+
+// refreshHealthStatus is like RefreshHealthStatus, but schedules the next health check of a healthy s
+// after interval.
+func (s *TargetServer) refreshHealthStatus(interval time.Duration) error {
 	// Get the new health & update the instance
 	status, err := s.GetNewHealthStatus()
-	s.SetStatus(status)
+	if HealthDecorator != nil {
+		status = HealthDecorator(s, status, err)
+	}
+	s.applyHealthCheck(status)
+	s.scheduleNextHealthCheck(s.clock(), interval)
 	return err
 }
 
+// applyHealthCheck updates the health of the target server s with the status from a health check. The
+// health only changes once HealthyThreshold checks in a row have passed, or UnhealthyThreshold checks
+// in a row have failed.
+func (s *TargetServer) applyHealthCheck(status HealthStatus) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+
+	next := s.Health
+	switch status {
+	case StatusHealthy:
+		s.healthChecksPassed++
+		s.healthChecksFailed = 0
+		if s.healthChecksPassed >= s.Settings().HealthyThreshold {
+			next = StatusHealthy
+		}
+	case StatusDegraded:
+		s.healthChecksFailed++
+		s.healthChecksPassed = 0
+		if s.healthChecksFailed >= s.Settings().UnhealthyThreshold {
+			next = StatusDegraded
+		}
+	default:
+		next = status
+	}
+	s.setStatus(next)
+}
+
+// IsHealthCheckDue returns true if it is time to check the health of the target server s again.
+func (s *TargetServer) IsHealthCheckDue(now time.Time) bool {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+	return !now.Before(s.NextHealthCheck)
+}
+
+// scheduleNextHealthCheck sets the time for the next health check of the target server s. A healthy
+// server is checked every interval, or its own HealthCheckInterval if it has one, while a degraded server
+// is checked with an exponential backoff, doubling the wait after every check up to
+// HealthCheckMaxBackoff.
+func (s *TargetServer) scheduleNextHealthCheck(now time.Time, interval time.Duration) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+
+	if own := s.Settings().HealthCheckInterval; own > 0 {
+		interval = own
+	}
+
+	switch {
+	case s.Health == StatusHealthy, s.Health == StatusWarming, s.healthCheckBackoff == 0:
+		s.healthCheckBackoff = interval
+	default:
+		s.healthCheckBackoff *= 2
+		if s.healthCheckBackoff > HealthCheckMaxBackoff {
+			s.healthCheckBackoff = HealthCheckMaxBackoff
+		}
+	}
+	s.NextHealthCheck = now.Add(s.healthCheckBackoff)
+}
+
 // Degrade marks the target server s as degraded. It is equivalent to calling SetStatus(StatusDegraded).
 // A degraded server is excluded while selecting target servers for forwarding client requests.
 func (s *TargetServer) Degrade() {
@@ -92,45 +484,199 @@ func (s *TargetServer) Degrade() {
 
 // SetStatus sets the health to status.
 func (s *TargetServer) SetStatus(status HealthStatus) {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	s.setStatus(status)
+}
+
+// setStatus is SetStatus for a caller that holds the health lock of s. A change of the health starts
+// the count of the health checks in a row over. When warmup is on, a server that becomes healthy is
+// warming instead until it has been warmed up.
+func (s *TargetServer) setStatus(status HealthStatus) {
+	if status == StatusHealthy && warmupEnabled() && s.Health != StatusHealthy {
+		if s.Health != StatusWarming {
+			logEvent(levelNotice, "A server is warming up", logField{"backend", s.Address})
+			s.warmingFrom = s.Health
+			go s.warmUp()
+		}
+		status = StatusWarming
+	}
+	s.changeStatus(status)
+}
+
+// finishWarmup marks the warming server s healthy. The caller should hold the health lock of s.
+func (s *TargetServer) finishWarmup() {
+	s.changeStatus(StatusHealthy)
+}
+
+// changeStatus sets the health of s to status as is. The caller should hold the health lock of s.
+func (s *TargetServer) changeStatus(status HealthStatus) {
 	if status == StatusDegraded && s.Health == StatusHealthy {
-		clog.Warningf("A server is being unhealthy: %s", s.Address)
+		logEvent(levelWarning, "A server is being unhealthy", logField{"backend", s.Address})
+	}
+	if status == StatusHealthy && s.Health != StatusHealthy {
+		logEvent(levelNotice, "A server is being marked healthy", logField{"backend", s.Address})
+	}
+	now := time.Now()
+	if status != s.Health {
+		s.recordHealthTransition(HealthTransition{From: s.Health, To: status, At: now})
+		s.healthChecksPassed, s.healthChecksFailed = 0, 0
 	}
-	if status == StatusHealthy && s.Health == StatusDegraded {
-		clog.Noticef("A server is being marked healthy: %s", s.Address)
+	if status == StatusHealthy && (s.Health == StatusDegraded || s.Health == StatusWarming && s.warmingFrom == StatusDegraded) {
+		s.recoveredAt = now
 	}
 	s.Health = status
-	s.HealthUpdated = time.Now()
+	s.HealthUpdated = now
+}
 
+// recordHealthTransition adds t to the health history of the target server s, overwriting the
+// oldest transition if the history is full. The caller should hold the health lock of s.
+func (s *TargetServer) recordHealthTransition(t HealthTransition) {
+	s.healthHistory[s.healthHistoryNext] = t
+	s.healthHistoryNext = (s.healthHistoryNext + 1) % healthHistorySize
+	if s.healthHistoryCount < healthHistorySize {
+		s.healthHistoryCount++
+	}
+}
+
+// HealthHistory returns the most recent health transitions of the target server s, oldest first.
+func (s *TargetServer) HealthHistory() []HealthTransition {
+	s.healthLock.RLock()
+	defer s.healthLock.RUnlock()
+
+	history := make([]HealthTransition, s.healthHistoryCount)
+	start := s.healthHistoryNext - s.healthHistoryCount
+	if start < 0 {
+		start += healthHistorySize
+	}
+	for i := range history {
+		history[i] = s.healthHistory[(start+i)%healthHistorySize]
+	}
+	return history
 }
 
 // GetNewHealthStatus returns a new HealthStatus for the target server. It does not update
 // the state for the server, only fetches a new state. It returns a StatusDegraded and an error
 // if it encounters an error.
 func (s *TargetServer) GetNewHealthStatus() (HealthStatus, error) {
+	// In the TCP mode, the servers may not speak HTTP at all
+	if ProxyMode == ProxyModeTCP {
+		return s.dialHealthStatus(TCPDialTimeout)
+	}
+	if HealthCheckMode == HealthModeTCP {
+		return s.dialHealthStatus(HealthCheckTimeout)
+	}
+	if HealthCheckMode == HealthModeGRPC && grpcHealthStatus != nil {
+		return grpcHealthStatus(s, HealthCheckTimeout)
+	}
 
 	// Make a get request to _health endpoint
-	url := fmt.Sprintf("%s/%s", s.Address, HealthEndpoint)
-	resp, err := http.Get(url)
+	settings := s.Settings()
+	url := fmt.Sprintf("%s/%s", s.baseURL(), settings.HealthEndpoint)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return StatusDegraded, err
+	}
+	for name, values := range settings.HealthHeaders {
+		req.Header[name] = values
+	}
+	if host := settings.HealthHeaders.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := s.httpClient(nil).Do(req)
 	if err != nil {
 		return StatusDegraded, err
 	}
 	defer resp.Body.Close()
 
+	expect := settings.HealthExpect
+	if expect == nil {
+		expect = &HealthExpect
+	}
+
+	// In status mode, the body only matters if there is an expectation on it
+	var status HealthStatus
+	if HealthCheckMode == HealthModeStatus {
+		status, err = getHealthStatusFromStatusCode(resp.StatusCode)
+		if status != StatusHealthy || expect.IsZero() {
+			return status, err
+		}
+	}
+
 	// Read the response
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return StatusDegraded, err
 	}
 
-	// Unmarshall the response into Json
-	var hr HealthResponse
-	err = json.Unmarshal(b, &hr)
-	if err != nil {
+	if HealthCheckMode == HealthModeJSON {
+		// Unmarshall the response into Json
+		var hr HealthResponse
+		err = json.Unmarshal(b, &hr)
+		if err != nil {
+			return StatusDegraded, err
+		}
+
+		// Get the status from the response
+		status, err = getHealthStatusFromResponse(hr)
+		if status != StatusHealthy {
+			return status, err
+		}
+	}
+
+	// A healthy server is still degraded if its response doesn't meet the expectation
+	if err = expect.Check(b); err != nil {
 		return StatusDegraded, err
 	}
+	return status, nil
+}
+
+// String returns the name of the health status, as used in the health endpoint responses.
+func (h HealthStatus) String() string {
+	switch h {
+	case StatusHealthy:
+		return "healthy"
+	case StatusDegraded:
+		return "degraded"
+	case StatusUnknown:
+		return "unknown"
+	case StatusWarming:
+		return "warming"
+	}
+	return fmt.Sprintf("HealthStatus(%d)", int(h))
+}
+
+// MarshalText implements encoding.TextMarshaler so that health statuses show up by name in JSON.
+func (h HealthStatus) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// getHealthStatusFromStatusCode is a util function for GetNewHealthStatus when running in status
+// mode. A 2xx code means healthy and a 5xx means degraded. Any other code also means degraded, but
+// it is reported as an error since it usually points to a misconfigured health endpoint.
+func getHealthStatusFromStatusCode(code int) (HealthStatus, error) {
+	if code >= 200 && code < 300 {
+		return StatusHealthy, nil
+	}
+	if code >= 500 {
+		return StatusDegraded, nil
+	}
+	return StatusDegraded, fmt.Errorf("unexpected status code from health endpoint: %d", code)
+}
 
-	// Get the status from the response and return
-	return getHealthStatusFromResponse(hr)
+// ValidateHealthCheckMode returns an error if mode is not one of the supported health check modes.
+func ValidateHealthCheckMode(mode string) error {
+	switch mode {
+	case HealthModeJSON, HealthModeStatus, HealthModeTCP:
+		return nil
+	case HealthModeGRPC:
+		if grpcHealthStatus == nil {
+			return ErrGRPCHealthNotBuiltIn
+		}
+		return nil
+	}
+	return ErrInvalidHealthCheckMode
 }
 
 // getHealthStatusFromResponse is a util function for GetNewHealthStatus. It maps the response
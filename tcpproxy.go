@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+	"golang.org/x/sync/errgroup"
+)
+
+// Proxy modes, which decide what the load balancer proxies to the target servers
+const (
+	// ProxyModeHTTP proxies HTTP requests, one request at a time.
+	ProxyModeHTTP string = "http"
+	// ProxyModeTCP proxies raw TCP connections. Every client connection is piped to a target server as
+	// is, so it works for any protocol, but none of the HTTP features apply.
+	ProxyModeTCP string = "tcp"
+)
+
+// ProxyMode is the mode the load balancer runs in. In the TCP mode, the target servers are given as
+// tcp://host:port, and their health is checked by opening a connection to them.
+var ProxyMode = ProxyModeHTTP
+
+// TCPDialTimeout is how long the load balancer waits for a connection to a target server in the TCP
+// mode, for both the proxied connections and the health checks.
+var TCPDialTimeout time.Duration = 5 * time.Second
+
+var (
+	ErrInvalidProxyMode         = errors.New("invalid proxy mode, it should be either http or tcp")
+	ErrProxyProtocolWithTCPMode = errors.New("the PROXY protocol is not supported in the tcp mode, the connections are piped to the target servers as they are")
+)
+
+// ValidateProxyMode returns an error if mode is not one of the supported proxy modes, or if it is the
+// TCP mode along with ProxyProtocol, which only the listeners of the HTTP mode read.
+func ValidateProxyMode(mode string) error {
+	switch mode {
+	case ProxyModeHTTP:
+		return nil
+	case ProxyModeTCP:
+		if ProxyProtocol {
+			return ErrProxyProtocolWithTCPMode
+		}
+		return nil
+	}
+	return ErrInvalidProxyMode
+}
+
+// startTCPListeners listens for TCP connections on each of the ports, and pipes every connection to a
+// target server from pool picked by the selection algorithm, while serving the admin server alongside if
+// it isn't nil. It is blocking, and returns once ctx is done or one of the listeners fails. The
+// connections in flight then get up to ShutdownTimeout to finish, after which they are closed.
+func startTCPListeners(ctx context.Context, ports []int, pool *ServerPool, admin *http.Server) error {
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	for _, port := range ports {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		clog.Infof("Staring the TCP server: %s", l.Addr())
+		listeners = append(listeners, l)
+	}
+	var adminListener net.Listener
+	if admin != nil {
+		var err error
+		adminListener, err = net.Listen("tcp", admin.Addr)
+		if err != nil {
+			closeListeners()
+			return err
+		}
+		clog.Infof("Staring the server: %s", admin.Addr)
+	}
+
+	conns := newTCPConns()
+	g, gctx := errgroup.WithContext(ctx)
+	for _, l := range listeners {
+		l := l
+		g.Go(func() error { return serveTCP(gctx, l, conns, pool) })
+	}
+	if admin != nil {
+		g.Go(func() error {
+			err := admin.Serve(adminListener)
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	// Stop accepting connections once we're asked to, or as soon as one of the listeners fails
+	g.Go(func() error {
+		<-gctx.Done()
+		clog.Infof("Shutting down the TCP servers")
+		closeListeners()
+		if admin != nil {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+			defer cancel()
+			if err := admin.Shutdown(shutdownCtx); err != nil {
+				clog.Errorf("Failed to shut down the server %s gracefully: %s", admin.Addr, err)
+			}
+		}
+		return nil
+	})
+	err := g.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(ShutdownTimeout):
+		clog.Warningf("Some TCP connections were still open after %s, closing them", ShutdownTimeout)
+		conns.closeAll()
+		<-done
+	}
+	return err
+}
+
+// tcpConns tracks the connections of the TCP mode, both to the clients and to the target servers, so
+// that the ones still open at the end of the shutdown can be closed. The WaitGroup counts the client
+// connections being proxied.
+type tcpConns struct {
+	sync.WaitGroup
+
+	mu     sync.Mutex
+	open   map[net.Conn]bool
+	closed bool
+}
+
+func newTCPConns() *tcpConns {
+	return &tcpConns{open: make(map[net.Conn]bool)}
+}
+
+// track adds c to the open connections. It returns false, and closes c, if the connections have
+// already been closed by closeAll.
+func (t *tcpConns) track(c net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		c.Close()
+		return false
+	}
+	t.open[c] = true
+	return true
+}
+
+// untrack removes c from the open connections, once it has been closed.
+func (t *tcpConns) untrack(c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.open, c)
+}
+
+// closeAll closes all the open connections, and every connection tracked from then on.
+func (t *tcpConns) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for c := range t.open {
+		c.Close()
+	}
+}
+
+// serveTCP accepts the connections on l until ctx is done, and proxies each of them to pool in a
+// goroutine of its own, tracked by conns.
+func serveTCP(ctx context.Context, l net.Listener, conns *tcpConns, pool *ServerPool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			proxyTCPConn(conn, pool, conns)
+		}()
+	}
+}
+
+// proxyTCPConn pipes the client connection to a target server from pool, in both directions, until both
+// sides are done sending. The connection is closed right away if no target server can be reached. Both
+// connections are tracked in conns while they are open.
+func proxyTCPConn(client net.Conn, pool *ServerPool, conns *tcpConns) {
+	defer client.Close()
+	if !conns.track(client) {
+		return
+	}
+	defer conns.untrack(client)
+
+	// The algorithms that look at the request, like IPHash, only get the address of the client
+	req := &http.Request{RemoteAddr: client.RemoteAddr().String(), Header: make(http.Header)}
+	server, backend, err := connectTCPTarget(pool, req)
+	if err != nil {
+		clog.Warningf("No target server for the connection from %s: %s", client.RemoteAddr(), err)
+		return
+	}
+	defer pool.AddLoad(server, -1)
+	defer backend.Close()
+	if !conns.track(backend) {
+		return
+	}
+	defer conns.untrack(backend)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pipeTCP(backend, client)
+	}()
+	go func() {
+		defer wg.Done()
+		pipeTCP(client, backend)
+	}()
+	wg.Wait()
+}
+
+// connectTCPTarget picks a target server from pool for req, and connects to it. A server that can't be
+// connected to is penalized, and degraded if it refused the connection, like in the HTTP mode, and
+// another one is tried, up to MaxRetries times. The connection counts towards the load of the server
+// until it is released with AddLoad.
+func connectTCPTarget(pool *ServerPool, req *http.Request) (*TargetServer, net.Conn, error) {
+	for retries := 0; ; {
+		server, err := pool.GetTargetServer(selectionFor(req))
+		if err != nil {
+			return nil, nil, err
+		}
+		// If other connections took the last slots of the server since it was picked, nothing has been
+		// sent to it, so we pick again without counting it as a retry
+		if !pool.acquireLoad(server) {
+			continue
+		}
+
+		start := time.Now()
+		backend, err := net.DialTimeout("tcp", server.URL.Host, TCPDialTimeout)
+		elapsed := time.Since(start)
+		if err == nil {
+			server.RecordResponse(http.StatusOK, elapsed)
+			return server, backend, nil
+		}
+		pool.AddLoad(server, -1)
+		server.RecordResponse(http.StatusBadGateway, elapsed)
+		server.Penalize(time.Now())
+		pool.ObserveFailure(server, elapsed)
+		clog.Warningf("Could not connect to the target server %s: %s", server.Address, err)
+		if isConnectionError(err) {
+			server.Degrade()
+		}
+		if retries >= MaxRetries {
+			return nil, nil, err
+		}
+		retries++
+	}
+}
+
+// pipeTCP copies from src to dst until src is done sending, and then closes the writing side of dst so
+// that its peer sees the end of the stream, while the other direction keeps going.
+func pipeTCP(dst, src net.Conn) {
+	_, err := io.Copy(dst, src)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		clog.Debugf("TCP connection between %s and %s ended with: %s", src.RemoteAddr(), dst.RemoteAddr(), err)
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// dialHealthStatus checks the health of the target server s by opening a TCP connection to it, or a
+// connection to its Unix socket if it has one. The server is healthy if it accepts the connection within
+// timeout. The default port of the scheme is used for the addresses without a port.
+func (s *TargetServer) dialHealthStatus(timeout time.Duration) (HealthStatus, error) {
+	network, address := "tcp", net.JoinHostPort(s.URL.Hostname(), urlPort(s.URL))
+	if s.SocketPath != "" {
+		network, address = "unix", s.SocketPath
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return StatusDegraded, err
+	}
+	conn.Close()
+	return StatusHealthy, nil
+}
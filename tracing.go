@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OtelEndpoint is the URL of the OpenTelemetry collector that the traces are exported to over OTLP/HTTP
+// e.g. http://localhost:4318. Tracing is disabled when it is empty.
+var OtelEndpoint string
+
+// tracer creates the spans of the load balancer. Until initTracing sets up a tracer provider, it is the
+// no-op tracer of the otel package, so the spans cost next to nothing when tracing is disabled.
+var tracer = otel.Tracer("github.com/teejays/loadbalancer")
+
+// initTracing sets up the export of the traces to OtelEndpoint, and the propagation of the trace
+// context in the W3C traceparent headers. It should be called once the flags have been parsed, and is
+// a no-op if OtelEndpoint is empty.
+func initTracing() error {
+	if OtelEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(OtelEndpoint))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "loadbalancer"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// startRequestSpan starts the root span for a client request, continuing the trace of the client if
+// it sent a traceparent header. The returned function ends the span with the final status code.
+func startRequestSpan(req *http.Request) (*http.Request, func(status int)) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, "loadbalancer.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	return req.WithContext(ctx), func(status int) {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}
+}
+
+// injectTraceContext adds the trace context of req to its headers, so that the target server can
+// continue the trace.
+func injectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// endSpanWithError ends span, marking it as failed with err if err is not nil.
+func endSpanWithError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BackendH2MaxStreams caps the number of concurrent streams the load balancer opens on a single HTTP/2
+// connection to a target server. Once all the connections to a server are at the cap, an additional
+// connection is opened, so that one slow stream can't hold up the requests queued behind it on a busy
+// connection. A value of 0 leaves it to the limit advertised by the target server. It only applies to
+// the https target servers that negotiate HTTP/2, and to the http ones with BackendH2C.
+var BackendH2MaxStreams int
+
+// BackendH2StrictStreams makes requests wait for a free stream when the limit advertised by an HTTP/2
+// target server is reached on a connection, instead of opening an additional connection.
+var BackendH2StrictStreams bool
+
+// Connection reuse settings of the backend transport. Reusing the connections to the target servers
+// saves a TCP (and TLS) handshake on every request, but only works if enough idle connections are kept
+// around. Go keeps only 2 idle connections per host by default, which is far too few for a load
+// balancer, where all the traffic to a target server goes to the same host: under any real
+// concurrency, most connections get closed right after their request and a new one is opened for the
+// next request.
+var (
+	// BackendMaxIdleConns is the maximum number of idle connections kept open across all the target
+	// servers. 0 means no limit.
+	BackendMaxIdleConns = 1000
+	// BackendMaxIdleConnsPerHost is the maximum number of idle connections kept open to each target
+	// server. It should be about the number of concurrent requests a target server gets.
+	BackendMaxIdleConnsPerHost = 100
+	// BackendIdleConnTimeout is how long an idle connection is kept open. It should be shorter than the
+	// keep-alive timeout of the target servers, so that we don't send a request on a connection that
+	// the target server is closing.
+	BackendIdleConnTimeout = 90 * time.Second
+	// BackendNoKeepAlive opens a new connection for every request to a target server, and closes it once
+	// the request is done. It overrides the settings above, and is meant for diagnosing target servers
+	// that mishandle persistent connections.
+	BackendNoKeepAlive bool
+)
+
+// BackendH2C makes the load balancer talk HTTP/2 without TLS (h2c with prior knowledge) to the http://
+// target servers, as needed for gRPC servers. Requests to https:// target servers negotiate HTTP/2
+// during the TLS handshake either way.
+var BackendH2C bool
+
+// backendTransport is used for making the requests to the target servers of all the pools that don't
+// have a transport of their own.
+var backendTransport http.RoundTripper = http.DefaultTransport
+
+// initBackendTransport sets up the transport for the requests to the target servers based on the
+// Backend* settings. It should be called once the flags have been parsed.
+func initBackendTransport() {
+	backendTransport = newBackendTransport("")
+}
+
+// newBackendTransport creates a transport for the requests to the target servers based on the Backend*
+// settings. serverName, if it is set, is sent for SNI and checked against the certificates of the https
+// target servers instead of the host of the requests.
+func newBackendTransport(serverName string) http.RoundTripper {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	if serverName != "" {
+		base.TLSClientConfig = &tls.Config{ServerName: serverName}
+	}
+	base.HTTP2 = &http.HTTP2Config{StrictMaxConcurrentRequests: BackendH2StrictStreams}
+	base.MaxIdleConns = BackendMaxIdleConns
+	base.MaxIdleConnsPerHost = BackendMaxIdleConnsPerHost
+	base.IdleConnTimeout = BackendIdleConnTimeout
+	base.DisableKeepAlives = BackendNoKeepAlive
+	if BackendH2C {
+		var protocols http.Protocols
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		base.Protocols = &protocols
+	}
+
+	if BackendH2MaxStreams > 0 {
+		return newH2StreamLimiter(base, BackendH2MaxStreams)
+	}
+	return base
+}
+
+// h2StreamLimiter is a http.RoundTripper that spreads the requests to each HTTP/2 target server over
+// as many connections as needed to keep every connection under maxStreams concurrent streams. Each
+// connection is held by a separate "lane" transport, which never opens more than one connection. The
+// requests to the target servers that speak HTTP/1.1 go through base as usual, as a lane would only
+// let one of them through at a time.
+type h2StreamLimiter struct {
+	base       *http.Transport
+	maxStreams int
+
+	sync.Mutex
+	lanes map[string][]*h2Lane
+	// negotiated holds whether each https target server negotiated HTTP/2, once it has responded.
+	negotiated map[string]bool
+}
+
+// h2Lane is a transport with a single connection to a target server, along with the number of
+// streams currently open on it.
+type h2Lane struct {
+	transport *http.Transport
+	active    int
+}
+
+func newH2StreamLimiter(base *http.Transport, maxStreams int) *h2StreamLimiter {
+	return &h2StreamLimiter{
+		base:       base,
+		maxStreams: maxStreams,
+		lanes:      make(map[string][]*h2Lane),
+		negotiated: make(map[string]bool),
+	}
+}
+
+// RoundTrip implements http.RoundTripper. The stream is considered open until the response body is
+// closed.
+func (l *h2StreamLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	h2, known := l.speaksHTTP2(req)
+	if !h2 {
+		resp, err := l.base.RoundTrip(req)
+		if !known && err == nil {
+			l.Lock()
+			l.negotiated[host] = resp.ProtoMajor == 2
+			l.Unlock()
+		}
+		return resp, err
+	}
+
+	lane := l.acquire(host)
+	resp, err := lane.transport.RoundTrip(req)
+	if err != nil {
+		l.release(host, lane)
+		return nil, err
+	}
+
+	var once sync.Once
+	resp.Body = &releasingBody{
+		ReadCloser: resp.Body,
+		release:    func() { once.Do(func() { l.release(host, lane) }) },
+	}
+	return resp, nil
+}
+
+// speaksHTTP2 returns whether the target server of req speaks HTTP/2, and whether that is known yet. The
+// http target servers speak it with h2c only, while the https ones are only known to once HTTP/2 has
+// been negotiated with them through ALPN, on their first response.
+func (l *h2StreamLimiter) speaksHTTP2(req *http.Request) (h2, known bool) {
+	if req.URL.Scheme != "https" {
+		return l.base.Protocols != nil && l.base.Protocols.UnencryptedHTTP2(), true
+	}
+	l.Lock()
+	defer l.Unlock()
+	h2, known = l.negotiated[req.URL.Host]
+	return h2, known
+}
+
+// acquire returns a lane to host that has a free stream, opening a new lane if all are saturated.
+func (l *h2StreamLimiter) acquire(host string) *h2Lane {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, lane := range l.lanes[host] {
+		if lane.active < l.maxStreams {
+			lane.active++
+			return lane
+		}
+	}
+
+	t := l.base.Clone()
+	t.MaxConnsPerHost = 1
+	t.ForceAttemptHTTP2 = true
+	lane := &h2Lane{transport: t, active: 1}
+	l.lanes[host] = append(l.lanes[host], lane)
+	return lane
+}
+
+// release frees a stream on the lane. Lanes that are no longer in use are closed, except for the
+// first one to each host.
+func (l *h2StreamLimiter) release(host string, lane *h2Lane) {
+	l.Lock()
+	defer l.Unlock()
+
+	lane.active--
+	lanes := l.lanes[host]
+	if lane.active > 0 || len(lanes) < 2 || lanes[0] == lane {
+		return
+	}
+	for i, ln := range lanes {
+		if ln == lane {
+			l.lanes[host] = append(lanes[:i], lanes[i+1:]...)
+			break
+		}
+	}
+	lane.transport.CloseIdleConnections()
+}
+
+// releasingBody calls release once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teejays/clog"
+)
+
+var ErrHijackNotSupported = errors.New("Connection upgrades are not supported over this connection")
+
+// isUpgradeRequest returns true if req asks to switch the connection to a different protocol, like a
+// WebSocket handshake does.
+func isUpgradeRequest(req *http.Request) bool {
+	return hasHeaderToken(req.Header, "Connection", "upgrade") && req.Header.Get("Upgrade") != ""
+}
+
+// hasHeaderToken returns true if the comma separated values of the header name in h include token,
+// ignoring case.
+func hasHeaderToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tunnelRequest handles a request that asks for a connection upgrade. It forwards the handshake to a
+// target server over a dedicated connection, and if the target server agrees to switch protocols, it
+// hijacks the client connection and pipes bytes both ways until either side closes its connection.
+// Upgraded requests are never retried, as we can't tell if a target server failed half way through.
+func tunnelRequest(w http.ResponseWriter, req *http.Request, pool *ServerPool, entry *accessLogEntry) {
+	target, err := pool.GetTargetServer(selectionFor(req))
+	if err != nil {
+		writeGatewayError(w, req, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	entry.Backend = target.Address
+
+	// Put back the upgrade headers, as they are dropped along with the other hop-by-hop headers
+	outReq := req.Clone(req.Context())
+	redirectRequestToServer(outReq, target)
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+
+	// Count the tunnel towards the load of the target server for as long as it is open. If other
+	// requests took its last slots since it was picked, we turn the client away, as upgrades aren't
+	// retried.
+	if !pool.acquireLoad(target) {
+		clog.Warningf("The target server %s is at its connection cap, turning down the connection upgrade", target.Address)
+		writeGatewayError(w, req, ErrNoHealthyServer.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer pool.AddLoad(target, -1)
+
+	backendConn, err := dialTarget(req.Context(), target)
+	if err != nil {
+		clog.Warningf("Could not connect to the target server %s for a connection upgrade: %s", target.Address, err)
+		writeGatewayError(w, req, ErrBadGateway.Error(), http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	// Send the handshake to the target server and read its response
+	if err := outReq.Write(backendConn); err != nil {
+		writeGatewayError(w, req, ErrBadGateway.Error(), http.StatusBadGateway)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, outReq)
+	if err != nil {
+		writeGatewayError(w, req, ErrBadGateway.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The target server turned the upgrade down, so we pass on its response like we normally would
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		removeHopByHopHeaders(resp.Header)
+		removeEchoedRequestID(resp.Header)
+		copyHeader(w.Header(), resp.Header)
+		pool.ResponseHeaders.Apply(w.Header())
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, ErrHijackNotSupported.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	// The listener server set deadlines on the connection for reading and writing the request, which
+	// would cut the tunnel off. Hijacking clears them in the current net/http, but the tunnel depends on
+	// it, so we clear them ourselves too. The tunnel lives for as long as the two sides keep it open.
+	clientConn.SetDeadline(time.Time{})
+
+	if err := resp.Write(clientBuf); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	// Pipe the bytes both ways. Anything already buffered on either side is sent first, as the readers
+	// wrap the connections. Once either side is done, closing both connections ends the other copy too.
+	var once sync.Once
+	closeBoth := func() {
+		clientConn.Close()
+		backendConn.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(backendConn, clientBuf)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(clientConn, backendReader)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// dialTarget opens a connection to the target server, over TLS if the target server uses https, or to
+// its Unix socket if it has one.
+func dialTarget(ctx context.Context, target *TargetServer) (net.Conn, error) {
+	if target.SocketPath != "" {
+		return dialUnix(ctx, target.SocketPath)
+	}
+	host := target.URL.Hostname()
+	port := target.URL.Port()
+	if port == "" {
+		port = "80"
+		if target.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	addr := net.JoinHostPort(host, port)
+
+	if target.URL.Scheme == "https" {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: target.serverName()}}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
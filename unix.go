@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// schemeUnix is the scheme of the addresses of the target servers that listen on a Unix domain socket,
+// e.g. unix:///var/run/app.sock
+const schemeUnix = "unix"
+
+// unixSocketHost is the host of the requests to the target servers on a Unix socket. It is only used
+// for the URL of the requests: every server has a transport of its own that always dials its socket.
+const unixSocketHost = "localhost"
+
+var ErrEmptySocketPath = errors.New("Unix socket address has no socket path")
+
+// setUnixSocket points the target server s at the Unix socket of its unix:// address u, with a transport
+// of its own that dials the socket for every connection.
+func (s *TargetServer) setUnixSocket(u *url.URL) error {
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	if path == "" {
+		return ErrEmptySocketPath
+	}
+	s.SocketPath = path
+	s.URL = &url.URL{Scheme: "http", Host: unixSocketHost}
+	s.transport = newUnixTransport(path)
+	return nil
+}
+
+// newUnixTransport creates a transport that sends all its requests over the Unix socket at path, with
+// the same connection reuse settings as the transport for the other target servers.
+func newUnixTransport(path string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.MaxIdleConns = BackendMaxIdleConns
+	t.MaxIdleConnsPerHost = BackendMaxIdleConnsPerHost
+	t.IdleConnTimeout = BackendIdleConnTimeout
+	t.DisableKeepAlives = BackendNoKeepAlive
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialUnix(ctx, path)
+	}
+	return t
+}
+
+// dialUnix opens a connection to the Unix socket at path.
+func dialUnix(ctx context.Context, path string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", path)
+}
+
+// baseURL returns the URL the paths of the requests to the target server s are added to. It is the
+// address of s, except for the servers on a Unix socket, whose requests are sent over the socket.
+func (s *TargetServer) baseURL() string {
+	if s.SocketPath != "" {
+		return s.URL.String()
+	}
+	return s.Address
+}
+
+// httpClient returns a client for the requests of the load balancer itself to the target server s, like
+// its health checks, which goes through the transport of s if it has one.
+func (s *TargetServer) httpClient(fallback http.RoundTripper) *http.Client {
+	client := &http.Client{Transport: fallback, Timeout: HealthCheckTimeout}
+	if s.transport != nil {
+		client.Transport = s.transport
+	}
+	return client
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, set at build time with e.g.
+// go build -ldflags "-X main.Version=v1.2.0 -X main.Commit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	// Version is the version of the load balancer.
+	Version = "dev"
+	// Commit is the git commit the load balancer was built from.
+	Commit = "unknown"
+	// BuildDate is when the load balancer was built.
+	BuildDate = "unknown"
+)
+
+// versionString returns the build information of the load balancer in a single line.
+func versionString() string {
+	return fmt.Sprintf("load-balancer %s (commit %s, built %s, %s)", Version, Commit, BuildDate, runtime.Version())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Warmup requests are sent to a target server when it becomes healthy, before it gets any client
+// requests, for backends that need a few hits to warm up their JIT or prime their caches. In the meantime
+// the server is warming, which is reported as such but is not selectable.
+var (
+	// WarmupPath is the path of the warmup requests, relative to the address of the server. Warmup is off
+	// when it is empty.
+	WarmupPath string
+	// WarmupMethod is the HTTP method of the warmup requests.
+	WarmupMethod = http.MethodGet
+	// WarmupRequests is the number of warmup requests, sent one after the other.
+	WarmupRequests = 3
+)
+
+// warmupEnabled returns true if the servers should be warmed up before they become healthy.
+func warmupEnabled() bool {
+	return WarmupPath != "" && WarmupRequests > 0 && ProxyMode == ProxyModeHTTP
+}
+
+// warmUp sends the warmup requests to the target server s, and then marks it healthy unless its health
+// has changed in the meantime, e.g. because it failed a health check. A warmup request that fails is
+// logged, but doesn't stop the server from becoming healthy: that is left to the health checks.
+func (s *TargetServer) warmUp() {
+	client := s.httpClient(backendTransport)
+	url := s.baseURL() + "/" + strings.TrimPrefix(WarmupPath, "/")
+	for i := 0; i < WarmupRequests; i++ {
+		req, err := http.NewRequest(WarmupMethod, url, nil)
+		if err != nil {
+			logEvent(levelWarning, "Failed to create the warmup request", logField{"backend", s.Address}, logField{"error", err.Error()})
+			break
+		}
+		if host := s.Settings().HealthHeaders.Get("Host"); host != "" {
+			req.Host = host
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			logEvent(levelWarning, "Warmup request failed", logField{"backend", s.Address}, logField{"error", err.Error()})
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	if s.Health == StatusWarming {
+		s.finishWarmup()
+	}
+}